@@ -0,0 +1,130 @@
+package asciicast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// Header is the first line of an asciicast v2 file. Players ignore fields they
+// don't know, so the metadata of the session goes in here too.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+
+	User   string `json:"user,omitempty"`
+	KeyId  string `json:"keyId,omitempty"`
+	Remote string `json:"remote,omitempty"`
+}
+
+// Event codes, see https://docs.asciinema.org/manual/asciicast/v2/
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+	EventMarker = "m"
+)
+
+// Writer writes a terminal session in the asciicast v2 format: a header line
+// followed by one JSON array [time, code, data] a line.
+// A Writer is not safe for concurrent use.
+type Writer struct {
+	w       io.Writer
+	start   time.Time
+	written int64
+	// partial holds the start of a UTF-8 sequence split across writes, per event code.
+	partial map[string][]byte
+}
+
+// NewWriter writes the header to w. The times of the events count from start.
+func NewWriter(w io.Writer, h Header, start time.Time) (*Writer, error) {
+	if h.Width <= 0 || h.Height <= 0 {
+		return nil, errors.New("asciicast: terminal needs a size")
+	}
+	h.Version = 2
+	h.Timestamp = start.Unix()
+	aw := &Writer{w: w, start: start, partial: make(map[string][]byte)}
+	line, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	if err := aw.writeLine(line); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// Written returns the number of bytes written so far.
+func (w *Writer) Written() int64 {
+	return w.written
+}
+
+// Output records p as written to the terminal.
+func (w *Writer) Output(p []byte) error {
+	return w.event(EventOutput, p)
+}
+
+// Input records p as typed by the user.
+func (w *Writer) Input(p []byte) error {
+	return w.event(EventInput, p)
+}
+
+// Resize records a new terminal size.
+func (w *Writer) Resize(width, height int) error {
+	return w.event(EventResize, []byte(fmt.Sprintf("%dx%d", width, height)))
+}
+
+// Marker records a marker, like a chapter in the recording.
+func (w *Writer) Marker(label string) error {
+	return w.event(EventMarker, []byte(label))
+}
+
+func (w *Writer) event(code string, p []byte) error {
+	if code == EventOutput || code == EventInput {
+		p = append(w.partial[code], p...)
+		w.partial[code] = nil
+		if cut := incompleteTail(p); cut > 0 {
+			w.partial[code] = append([]byte(nil), p[len(p)-cut:]...)
+			p = p[:len(p)-cut]
+		}
+		if len(p) == 0 {
+			return nil
+		}
+	}
+	t := time.Since(w.start).Seconds()
+	line, err := json.Marshal([]interface{}{json.Number(fmt.Sprintf("%.6f", t)), code, string(p)})
+	if err != nil {
+		return err
+	}
+	return w.writeLine(line)
+}
+
+func (w *Writer) writeLine(line []byte) error {
+	n, err := w.w.Write(append(line, '\n'))
+	w.written += int64(n)
+	return err
+}
+
+// incompleteTail returns how many bytes at the end of p are the start of a UTF-8
+// sequence that isn't complete yet.
+func incompleteTail(p []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(p); i++ {
+		b := p[len(p)-i]
+		if !utf8.RuneStart(b) {
+			continue
+		}
+		if utf8.FullRune(p[len(p)-i:]) {
+			return 0
+		}
+		return i
+	}
+	return 0
+}
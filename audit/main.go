@@ -0,0 +1,268 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// genesis is the previous hash of the first record in a log.
+var genesis = strings.Repeat("0", sha256.Size*2)
+
+// tailSize is how much of the end of a log is read to find where the chain stands.
+const tailSize = 1 << 20
+
+// Fields are the details of an audit record, like the fingerprint of a key or the
+// size of a transfer.
+type Fields map[string]string
+
+// Record is one line in the audit log. Each record carries the hash of the one
+// before it, so records can't be changed, removed or put in between without
+// breaking the chain. The hash covers the record as JSON with Hash left empty.
+type Record struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Event   string    `json:"event"`
+	User    string    `json:"user,omitempty"`
+	Remote  string    `json:"remote,omitempty"`
+	Fields  Fields    `json:"fields,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Prev    string    `json:"prev"`
+	Hash    string    `json:"hash"`
+}
+
+// hash computes the hash of the record.
+func (r Record) hash() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log is an append-only JSON Lines audit log. It is safe for concurrent use, and
+// a nil Log records nothing.
+type Log struct {
+	mu   sync.Mutex
+	f    *os.File
+	path string
+	seq  uint64
+	last string
+}
+
+// Open opens the log at path for appending, carrying on the chain of the records
+// already there.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+	l := &Log{f: f, path: path, last: genesis}
+	last, err := lastRecord(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("audit log %s: %w", path, err)
+	}
+	if last != nil {
+		l.seq, l.last = last.Seq, last.Hash
+	}
+	return l, nil
+}
+
+// lastRecord reads the last record in the file, or nil if there are none.
+func lastRecord(f *os.File) (*Record, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - tailSize
+	if offset < 0 {
+		offset = 0
+	}
+	buf := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	var r Record
+	if err := json.Unmarshal(buf, &r); err != nil || r.Hash == "" {
+		return nil, errors.New("the last record is broken, check it with verify")
+	}
+	return &r, nil
+}
+
+// Path returns where the log is.
+func (l *Log) Path() string {
+	if l == nil {
+		return ""
+	}
+	return l.path
+}
+
+// Write chains the record to the ones before it and appends it to the log.
+func (l *Log) Write(r Record) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r.Seq = l.seq + 1
+	r.Time = time.Now().UTC()
+	r.Prev = l.last
+	hash, err := r.hash()
+	if err != nil {
+		return err
+	}
+	r.Hash = hash
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("audit log: %w", err)
+	}
+	l.seq, l.last = r.Seq, r.Hash
+	return nil
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Verification is the outcome of checking a log.
+type Verification struct {
+	Records int    `json:"records"`
+	First   uint64 `json:"first"`
+	Last    uint64 `json:"last"`
+	Hash    string `json:"hash"`
+}
+
+// ErrTrimmed is returned for a log that doesn't start at record 1 and isn't
+// allowed to.
+var ErrTrimmed = errors.New("the log has been trimmed at the front")
+
+// VerifyOptions say what a log is checked against besides itself.
+type VerifyOptions struct {
+	// AllowTrimmed accepts a log that starts after record 1.
+	AllowTrimmed bool
+	// Anchor is the last hash of an earlier verification, kept away from the
+	// log. The log must still hold that record, or start right after it.
+	Anchor string
+}
+
+// Verify checks that every record in the log is intact and follows the one before.
+// It stops at the first that isn't. The chain only shows that the records agree
+// with each other: a log cut short at the end, or written anew from the start,
+// verifies too. Catching that takes the Hash of a verification kept elsewhere,
+// and given as the Anchor of the next.
+func Verify(r io.Reader, opts VerifyOptions) (Verification, error) {
+	v := Verification{}
+	prev := ""
+	anchored := false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return v, fmt.Errorf("line %d: not a record: %w", line, err)
+		}
+		hash, err := rec.hash()
+		if err != nil {
+			return v, fmt.Errorf("line %d: %w", line, err)
+		}
+		if hash != rec.Hash {
+			return v, fmt.Errorf("line %d: record %d has been changed", line, rec.Seq)
+		}
+		if v.Records == 0 {
+			// The log may have been trimmed at the front; the chain holds from
+			// the first record we have.
+			if rec.Seq == 1 && rec.Prev != genesis {
+				return v, fmt.Errorf("line %d: record 1 does not start a chain", line)
+			}
+			v.First = rec.Seq
+			anchored = opts.Anchor != "" && rec.Prev == opts.Anchor
+		} else {
+			if rec.Prev != prev {
+				return v, fmt.Errorf("line %d: record %d does not follow record %d", line, rec.Seq, v.Last)
+			}
+			if rec.Seq != v.Last+1 {
+				return v, fmt.Errorf("line %d: record %d follows record %d", line, rec.Seq, v.Last)
+			}
+		}
+		prev = rec.Hash
+		v.Records++
+		v.Last = rec.Seq
+		v.Hash = rec.Hash
+		anchored = anchored || rec.Hash == opts.Anchor
+	}
+	if err := scanner.Err(); err != nil {
+		return v, err
+	}
+	switch {
+	case opts.Anchor != "" && !anchored:
+		return v, fmt.Errorf("the log does not reach the anchor %s", opts.Anchor)
+	case v.First > 1 && opts.Anchor == "" && !opts.AllowTrimmed:
+		return v, fmt.Errorf("%w: it starts at record %d", ErrTrimmed, v.First)
+	}
+	return v, nil
+}
+
+// VerifyFile verifies the log in the named file.
+func VerifyFile(path string, opts VerifyOptions) (Verification, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Verification{}, err
+	}
+	defer f.Close()
+	return Verify(f, opts)
+}
+
+// Tail returns the last n records of the log at path.
+func Tail(path string, n int) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		records = append(records, rec)
+		if len(records) > n {
+			records = records[1:]
+		}
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,233 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testLines writes n records to a new log and returns its lines.
+func testLines(t *testing.T, n int) [][]byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		r := Record{Source: "test", Event: "session", User: "alice", Message: fmt.Sprintf("record %d", i)}
+		if err := l.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+}
+
+// rehash gives a changed record a hash that matches it again.
+func rehash(t *testing.T, line []byte, change func(*Record)) []byte {
+	t.Helper()
+	var r Record
+	if err := json.Unmarshal(line, &r); err != nil {
+		t.Fatal(err)
+	}
+	change(&r)
+	hash, err := r.hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Hash = hash
+	out, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// hashOf returns the hash of the record on the line.
+func hashOf(t *testing.T, line []byte) string {
+	t.Helper()
+	var r Record
+	if err := json.Unmarshal(line, &r); err != nil {
+		t.Fatal(err)
+	}
+	return r.Hash
+}
+
+func TestVerify(t *testing.T) {
+	lines := testLines(t, 5)
+	tests := []struct {
+		name    string
+		lines   func() [][]byte
+		opts    VerifyOptions
+		records int
+		first   uint64
+		last    uint64
+		err     string
+	}{
+		{
+			name:    "intact",
+			lines:   func() [][]byte { return lines },
+			records: 5, first: 1, last: 5,
+		},
+		{
+			name:    "blank lines",
+			lines:   func() [][]byte { return [][]byte{lines[0], nil, lines[1], []byte("  ")} },
+			records: 2, first: 1, last: 2,
+		},
+		{
+			name:    "trimmed at the front",
+			lines:   func() [][]byte { return lines[2:] },
+			records: 3, first: 3, last: 5,
+			err: "the log has been trimmed at the front: it starts at record 3",
+		},
+		{
+			name:    "trimmed at the front, allowed",
+			lines:   func() [][]byte { return lines[2:] },
+			opts:    VerifyOptions{AllowTrimmed: true},
+			records: 3, first: 3, last: 5,
+		},
+		{
+			name:    "trimmed right after the anchor",
+			lines:   func() [][]byte { return lines[2:] },
+			opts:    VerifyOptions{Anchor: hashOf(t, lines[1])},
+			records: 3, first: 3, last: 5,
+		},
+		{
+			name:    "trimmed past the anchor",
+			lines:   func() [][]byte { return lines[2:] },
+			opts:    VerifyOptions{Anchor: hashOf(t, lines[0])},
+			records: 3, first: 3, last: 5,
+			err: "the log does not reach the anchor",
+		},
+		{
+			name:    "reaches the anchor",
+			lines:   func() [][]byte { return lines },
+			opts:    VerifyOptions{Anchor: hashOf(t, lines[3])},
+			records: 5, first: 1, last: 5,
+		},
+		{
+			name:    "cut short before the anchor",
+			lines:   func() [][]byte { return lines[:3] },
+			opts:    VerifyOptions{Anchor: hashOf(t, lines[3])},
+			records: 3, first: 1, last: 3,
+			err: "the log does not reach the anchor",
+		},
+		{
+			name: "written anew",
+			lines: func() [][]byte {
+				return testLines(t, 5)
+			},
+			opts:    VerifyOptions{Anchor: hashOf(t, lines[4])},
+			records: 5, first: 1, last: 5,
+			err: "the log does not reach the anchor",
+		},
+		{
+			name:    "cut short at the end",
+			lines:   func() [][]byte { return lines[:3] },
+			records: 3, first: 1, last: 3,
+		},
+		{
+			name: "modified",
+			lines: func() [][]byte {
+				changed := bytes.Replace(lines[2], []byte("record 3"), []byte("record X"), 1)
+				return [][]byte{lines[0], lines[1], changed, lines[3], lines[4]}
+			},
+			records: 2, first: 1, last: 2,
+			err: "line 3: record 3 has been changed",
+		},
+		{
+			name: "modified and hashed again",
+			lines: func() [][]byte {
+				changed := rehash(t, lines[2], func(r *Record) { r.User = "mallory" })
+				return [][]byte{lines[0], lines[1], changed, lines[3], lines[4]}
+			},
+			records: 3, first: 1, last: 3,
+			err: "line 4: record 4 does not follow record 3",
+		},
+		{
+			name:    "removed",
+			lines:   func() [][]byte { return [][]byte{lines[0], lines[1], lines[3], lines[4]} },
+			records: 2, first: 1, last: 2,
+			err: "line 3: record 4 does not follow record 2",
+		},
+		{
+			name: "removed and renumbered",
+			lines: func() [][]byte {
+				changed := rehash(t, lines[3], func(r *Record) { r.Seq = 3 })
+				return [][]byte{lines[0], lines[1], changed}
+			},
+			records: 2, first: 1, last: 2,
+			err: "line 3: record 3 does not follow record 2",
+		},
+		{
+			name:    "reordered",
+			lines:   func() [][]byte { return [][]byte{lines[0], lines[2], lines[1], lines[3], lines[4]} },
+			records: 1, first: 1, last: 1,
+			err: "line 2: record 3 does not follow record 1",
+		},
+		{
+			name: "first record replaced",
+			lines: func() [][]byte {
+				changed := rehash(t, lines[0], func(r *Record) { r.Prev = "elsewhere" })
+				return [][]byte{changed, lines[1]}
+			},
+			err: "line 1: record 1 does not start a chain",
+		},
+		{
+			name:    "not a record",
+			lines:   func() [][]byte { return [][]byte{lines[0], []byte("garbage")} },
+			records: 1, first: 1, last: 1,
+			err: "line 2: not a record",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append(bytes.Join(tt.lines(), []byte("\n")), '\n')
+			v, err := Verify(bytes.NewReader(data), tt.opts)
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+			if v.Records != tt.records || v.First != tt.first || v.Last != tt.last {
+				t.Errorf("verified %d records, %d to %d, want %d, %d to %d",
+					v.Records, v.First, v.Last, tt.records, tt.first, tt.last)
+			}
+		})
+	}
+}
+
+func TestOpenContinuesChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	for i := 0; i < 2; i++ {
+		l, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Write(Record{Source: "test", Event: "start"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err := VerifyFile(path, VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Records != 2 || v.Last != 2 {
+		t.Errorf("verified %d records up to %d, want 2 up to 2", v.Records, v.Last)
+	}
+}
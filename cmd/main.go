@@ -2,21 +2,31 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	log "github.com/celerway/chainsaw"
 	"github.com/joho/godotenv"
+	"github.com/perbu/sshpod/audit"
 	"github.com/perbu/sshpod/httpd"
 	"github.com/perbu/sshpod/sshd"
 	"github.com/perbu/sshpod/sshkeys"
 	"github.com/perbu/sshpod/sshmonitor"
+	gossh "golang.org/x/crypto/ssh"
 	"math/rand"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		verifyAudit(os.Args[2:])
+		return
+	}
 	err := realMain()
 	if err != nil {
 		log.Fatal(err)
@@ -24,12 +34,38 @@ func main() {
 	fmt.Println("Exiting...")
 }
 
+// verifyAudit checks an audit log and exits non-zero if it has been tampered with.
+// The last hash it prints is worth keeping away from the log, to check the next
+// verification against with -anchor.
+func verifyAudit(args []string) {
+	fs := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	allowTrimmed := fs.Bool("allow-trimmed", false, "accept a log that doesn't start at record 1")
+	anchor := fs.String("anchor", "", "last hash of an earlier verification, which the log must reach")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s verify-audit [-allow-trimmed] [-anchor hash] <file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+	v, err := audit.VerifyFile(path, audit.VerifyOptions{AllowTrimmed: *allowTrimmed, Anchor: *anchor})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s (%d good records)\n", path, err, v.Records)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: %d records, %d to %d, last hash %s\n", path, v.Records, v.First, v.Last, v.Hash)
+	fmt.Println("keep the last hash elsewhere and give it as -anchor next time; the log alone can't show it was cut short or written anew")
+}
+
 func realMain() error {
 	logger := log.MakeLogger("main")
 	logger.SetLevel(log.TraceLevel)
 	err := godotenv.Load()
 	if err != nil {
-		logger.Errorf("Error loading .env file: ", err)
+		logger.Errorf("Error loading .env file: %s", err)
 	}
 	httpUser := getEnvString("HTTP_USER", "", true)
 	httpPass := getEnvString("HTTP_PASS", "", true)
@@ -39,19 +75,66 @@ func realMain() error {
 	privCertPath := getEnvString("PRIV_CERT_PATH", "", true)
 	pubKeyPath := getEnvString("PUB_KEY_PATH", "", true)
 	sshPort := getEnvInt("SSHD_PORT", 0, false)
+	sshIdleTimeout := getEnvDuration("SSHD_IDLE_TIMEOUT", 30*time.Minute, false)
+	sshMaxSession := getEnvDuration("SSHD_MAX_SESSION", 12*time.Hour, false)
+	sshTimeoutWarning := getEnvDuration("SSHD_TIMEOUT_WARNING", time.Minute, false)
+	sshMaxConns := getEnvInt("SSHD_MAX_CONNS", 100, false)
+	sshMaxConnsPerUser := getEnvInt("SSHD_MAX_CONNS_PER_USER", 20, false)
+	sshMaxConnsPerSource := getEnvInt("SSHD_MAX_CONNS_PER_SOURCE", 20, false)
+	sshMaxAuthFailures := getEnvInt("SSHD_MAX_AUTH_FAILURES", 5, false)
+	sshAuthFailureWindow := getEnvDuration("SSHD_AUTH_FAILURE_WINDOW", 10*time.Minute, false)
+	sshBanTime := getEnvDuration("SSHD_BAN_TIME", time.Hour, false)
+	sshBanExempt := getEnvString("SSHD_BAN_EXEMPT", "", false)
+	sshMaxUnauthenticated := getEnvInt("SSHD_MAX_UNAUTHENTICATED", 10, false)
+	sshLoginGrace := getEnvDuration("SSHD_LOGIN_GRACE", time.Minute, false)
+	hostKeyDir := getEnvString("HOST_KEY_DIR", "", false)
+	hostKeyTypes := getEnvString("HOST_KEY_TYPES", "ed25519,ecdsa,rsa", false)
 	target := getEnvString("TARGET", "", true)
+	rateLimit := getEnvString("RATE_LIMIT", "0", false)
+	selfTestInterval := getEnvDuration("SELFTEST_INTERVAL", time.Minute, false)
+	selfTestFailures := getEnvInt("SELFTEST_FAILURES", 3, false)
+	tunnelConns := getEnvInt("TUNNEL_CONNECTIONS", 1, false)
+	historyDir := getEnvString("HISTORY_DIR", "", false)
+	historySize := getEnvInt("HISTORY_SIZE", 500, false)
+	captureDir := getEnvString("CAPTURE_DIR", filepath.Join(os.TempDir(), "sshpod-captures"), false)
+	recordingDir := getEnvString("RECORDING_DIR", filepath.Join(os.TempDir(), "sshpod-recordings"), false)
+	recordingMaxAge := getEnvDuration("RECORDING_MAX_AGE", 30*24*time.Hour, false)
+	recordingMaxBytes := getEnvInt("RECORDING_MAX_BYTES", 1<<30, false)
+	auditPath := getEnvString("AUDIT_LOG", filepath.Join(os.TempDir(), "sshpod-audit.jsonl"), false)
+	authorizedKeys := getEnvString("AUTHORIZED_KEYS", "", false)
+	revokedKeys := getEnvString("REVOKED_KEYS", "", false)
+	forwardAllow := getEnvString("FORWARD_ALLOW", "", false)
+	bastionPrincipal := getEnvString("BASTION_POD_PRINCIPAL", "", false)
+	bastionBind := getEnvString("BASTION_BIND", "127.0.0.1", false)
+	bastionFleet := getEnvString("BASTION_FLEET_FILE", "", false)
+	bastionRouteUser := getEnvString("BASTION_ROUTE_USER", "root", false)
+	bastionRouteCA := getEnvString("BASTION_ROUTE_CA_KEY", "", false)
+	bastionDomain := getEnvString("BASTION_DOMAIN", "", false)
+	bastionLabels := getEnvString("BASTION_LABEL_EXTENSION", "", false)
+	policyFile := getEnvString("POLICY_FILE", "", false)
+	sftpRoot := getEnvString("SFTP_ROOT", "", false)
+	sftpReadOnly := getEnvString("SFTP_READONLY", "", false) != ""
+	sftpAccess := getEnvString("SFTP_ACCESS", "", false)
 	targetUsername := getEnvString("TARGET_USERNAME", "", true)
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 	wg := sync.WaitGroup{}
 
+	auditLog, err := audit.Open(auditPath)
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+	logger.Infof("writing audit log to %s", auditLog.Path())
+
 	httpLogger := log.MakeLogger("httpd")
 	httpLogger.SetLevel(log.TraceLevel)
 	httpServer, err := httpd.New(httpLogger, routerId, httpPort, httpUser, httpPass)
 	if err != nil {
 		return err
 	}
+	httpServer.SetAuditLog(auditLog)
 
 	// Start the httpd server
 	wg.Add(1)
@@ -79,6 +162,91 @@ func realMain() error {
 	if err != nil {
 		return fmt.Errorf("error creating ssh server: %s", err)
 	}
+	sshServer.SetHistory(historyDir, historySize)
+	err = sshServer.SetHostKeys(sshd.HostKeys{Dir: hostKeyDir, Types: strings.Split(hostKeyTypes, ",")})
+	if err != nil {
+		return fmt.Errorf("HOST_KEY_DIR: %w", err)
+	}
+	sshServer.SetAuditLog(auditLog)
+	err = sshServer.SetLimits(sshd.Limits{
+		IdleTimeout:       sshIdleTimeout,
+		MaxSession:        sshMaxSession,
+		Warning:           sshTimeoutWarning,
+		MaxConns:          sshMaxConns,
+		MaxConnsPerUser:   sshMaxConnsPerUser,
+		MaxConnsPerSource: sshMaxConnsPerSource,
+	})
+	if err != nil {
+		return fmt.Errorf("sshd limits: %w", err)
+	}
+	err = sshServer.SetBruteForce(sshd.BruteForce{
+		MaxFailures:        sshMaxAuthFailures,
+		Window:             sshAuthFailureWindow,
+		BanTime:            sshBanTime,
+		MaxUnauthenticated: sshMaxUnauthenticated,
+		LoginGrace:         sshLoginGrace,
+		Exempt:             strings.Split(sshBanExempt, ","),
+	})
+	if err != nil {
+		return fmt.Errorf("sshd brute force protection: %w", err)
+	}
+	err = sshServer.SetRecording(recordingDir, recordingMaxAge, int64(recordingMaxBytes))
+	if err != nil {
+		return fmt.Errorf("RECORDING_DIR: %w", err)
+	}
+	httpServer.SetRecordings(sshServer)
+	httpServer.SetBans(sshServer)
+	err = sshServer.SetAuthorizedKeys(authorizedKeys)
+	if err != nil {
+		return fmt.Errorf("AUTHORIZED_KEYS: %w", err)
+	}
+	err = sshServer.SetRevocationList(revokedKeys)
+	if err != nil {
+		return fmt.Errorf("REVOKED_KEYS: %w", err)
+	}
+	if policyFile != "" {
+		policy, err := sshd.LoadPolicy(policyFile)
+		if err != nil {
+			return err
+		}
+		err = sshServer.SetPolicy(policy)
+		if err != nil {
+			return err
+		}
+	}
+	var routeCA gossh.Signer
+	if bastionRouteCA != "" {
+		routeCA, err = sshkeys.GetPrivateKeyFile(bastionRouteCA)
+		if err != nil {
+			return fmt.Errorf("BASTION_ROUTE_CA_KEY: %w", err)
+		}
+	}
+	err = sshServer.SetBastion(sshd.Bastion{
+		PodPrincipal:   bastionPrincipal,
+		BindHost:       bastionBind,
+		FleetFile:      bastionFleet,
+		RouteUser:      bastionRouteUser,
+		RouteCA:        routeCA,
+		LabelExtension: bastionLabels,
+	})
+	if err != nil {
+		return fmt.Errorf("bastion: %w", err)
+	}
+	if bastionPrincipal != "" {
+		httpServer.SetPods(sshServer.PodHTTPAddr, bastionDomain)
+	}
+	err = sshServer.SetForwarding(strings.Split(forwardAllow, ","))
+	if err != nil {
+		return fmt.Errorf("FORWARD_ALLOW: %w", err)
+	}
+	access, err := sshd.ParseAccess(sftpAccess)
+	if err != nil {
+		return fmt.Errorf("SFTP_ACCESS: %w", err)
+	}
+	err = sshServer.SetFileTransfer(sshd.FileTransfer{Root: sftpRoot, ReadOnly: sftpReadOnly, Access: access})
+	if err != nil {
+		return fmt.Errorf("SFTP_ROOT: %w", err)
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -90,11 +258,35 @@ func realMain() error {
 	// sshMonitor := sshmonitor.Connect(ctx, )
 	monitorLogger := log.MakeLogger("sshmonitor")
 	monitorLogger.SetLevel(log.TraceLevel)
+	monitor := sshmonitor.New(signer, targetUsername, target, monitorLogger, httpServer.Port(), sshServer.Port())
+	monitor.SetCaptureDir(captureDir)
+	monitor.SetAuditLog(auditLog)
+	// The web interface is the one likely to move a lot of data, keep it away from the ssh sessions.
+	err = monitor.SetForwardClass(httpServer.Port(), sshmonitor.ClassBulk)
+	if err != nil {
+		return fmt.Errorf("setting forward class: %w", err)
+	}
+	err = monitor.SetConnections(tunnelConns)
+	if err != nil {
+		return fmt.Errorf("TUNNEL_CONNECTIONS: %w", err)
+	}
+	monitor.SetHostKeys(sshServer.HostPublicKeys)
+	monitor.SetSelfTest(httpServer.Port(), selfTestInterval, selfTestFailures)
+	tunnelRate, err := sshmonitor.ParseRate(rateLimit)
+	if err != nil {
+		return fmt.Errorf("RATE_LIMIT: %w", err)
+	}
+	err = monitor.SetRateLimit(0, tunnelRate)
+	if err != nil {
+		return fmt.Errorf("setting rate limit: %w", err)
+	}
+	httpServer.SetMonitor(monitor)
+	sshServer.SetMonitor(monitor)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		logger.Info("Starting SSH monitor")
-		sshmonitor.Connect(ctx, signer, targetUsername, target, monitorLogger, httpServer.Port(), sshServer.Port())
+		monitor.Run(ctx)
 	}()
 
 	logger.Info("Services up and running. Waiting for interrupt...")
@@ -128,3 +320,18 @@ func getEnvInt(key string, defaultValue int, required bool) int {
 	}
 	return i
 }
+
+func getEnvDuration(key string, defaultValue time.Duration, required bool) time.Duration {
+	value := os.Getenv(key)
+	if value == "" && required {
+		log.Fatalf("%s environment variable is required", key)
+	}
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s environment variable is not a duration: %s", key, err)
+	}
+	return d
+}
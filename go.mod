@@ -1,17 +1,19 @@
 module github.com/perbu/sshpod
 
-go 1.19
+go 1.20
 
 require (
 	github.com/celerway/chainsaw v0.0.0-20211219154652-008b7204929c
-	github.com/gliderlabs/ssh v0.3.4
+	github.com/gliderlabs/ssh v0.3.8
 	github.com/gorilla/mux v1.8.0
 	github.com/joho/godotenv v1.4.0
-	golang.org/x/crypto v0.0.0-20220817201139-bc19a97f63c8
+	github.com/pkg/sftp v1.13.5
+	golang.org/x/crypto v0.31.0
 )
 
 require (
 	github.com/anmitsu/go-shlex v0.0.0-20200514113438-38f4b401e2be // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
-	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/term v0.27.0 // indirect
 )
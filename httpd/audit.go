@@ -0,0 +1,30 @@
+package httpd
+
+import (
+	"fmt"
+	"github.com/perbu/sshpod/audit"
+	"net/http"
+)
+
+// SetAuditLog records failed logins, changes and access to pods in the audit log.
+func (s *Server) SetAuditLog(l *audit.Log) {
+	s.auditLog = l
+}
+
+// audit records a request we want to be able to account for later.
+func (s *Server) audit(r *http.Request, event string, fields audit.Fields, format string, args ...interface{}) {
+	user, _, _ := r.BasicAuth()
+	msg := fmt.Sprintf(format, args...)
+	s.logger.Infof("audit %s: user %s from %s: %s", event, user, r.RemoteAddr, msg)
+	err := s.auditLog.Write(audit.Record{
+		Source:  "httpd",
+		Event:   event,
+		User:    user,
+		Remote:  r.RemoteAddr,
+		Fields:  fields,
+		Message: msg,
+	})
+	if err != nil {
+		s.logger.Errorf("writing audit log: %s", err)
+	}
+}
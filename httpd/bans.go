@@ -0,0 +1,42 @@
+package httpd
+
+import (
+	"github.com/perbu/sshpod/audit"
+	"github.com/perbu/sshpod/sshd"
+	"net/http"
+)
+
+// Bans is where httpd finds the addresses sshd has banned.
+type Bans interface {
+	Bans() []sshd.Ban
+	Unban(addr string) error
+}
+
+// SetBans makes the ban list available under /bans.
+func (s *Server) SetBans(b Bans) {
+	s.bans = b
+}
+
+// bansHandler lists the bans in force.
+func (s *Server) bansHandler(w http.ResponseWriter, _ *http.Request) {
+	if s.bans == nil {
+		http.Error(w, "no ban list", http.StatusServiceUnavailable)
+		return
+	}
+	s.writeJSON(w, s.bans.Bans())
+}
+
+// unbanHandler lifts the ban on the address in the form value address.
+func (s *Server) unbanHandler(w http.ResponseWriter, r *http.Request) {
+	if s.bans == nil {
+		http.Error(w, "no ban list", http.StatusServiceUnavailable)
+		return
+	}
+	addr := r.FormValue("address")
+	if err := s.bans.Unban(addr); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.audit(r, "ban", audit.Fields{"action": "unban", "address": addr}, "lifted the ban on %s", addr)
+	s.writeJSON(w, s.bans.Bans())
+}
@@ -0,0 +1,93 @@
+package httpd
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/perbu/sshpod/audit"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// capturesHandler lists the active and recently finished captures.
+func (s *Server) capturesHandler(w http.ResponseWriter, _ *http.Request) {
+	if s.monitor == nil {
+		http.Error(w, "no monitor", http.StatusServiceUnavailable)
+		return
+	}
+	s.writeJSON(w, s.monitor.Captures())
+}
+
+// captureStartHandler starts a capture. Takes port, and optionally maxBytes and duration (like "90s").
+func (s *Server) captureStartHandler(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		http.Error(w, "no monitor", http.StatusServiceUnavailable)
+		return
+	}
+	port, err := strconv.Atoi(r.FormValue("port"))
+	if err != nil {
+		http.Error(w, "bad or missing port", http.StatusBadRequest)
+		return
+	}
+	var maxBytes int64
+	if v := r.FormValue("maxBytes"); v != "" {
+		maxBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "bad maxBytes", http.StatusBadRequest)
+			return
+		}
+	}
+	var duration time.Duration
+	if v := r.FormValue("duration"); v != "" {
+		duration, err = time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "bad duration", http.StatusBadRequest)
+			return
+		}
+	}
+	info, err := s.monitor.StartCapture(port, maxBytes, duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.audit(r, "capture", audit.Fields{"state": "started", "port": strconv.Itoa(port), "file": info.File},
+		"started capture on port %d", port)
+	s.writeJSON(w, info)
+}
+
+// captureStopHandler stops the capture on the given port.
+func (s *Server) captureStopHandler(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		http.Error(w, "no monitor", http.StatusServiceUnavailable)
+		return
+	}
+	port, err := strconv.Atoi(r.FormValue("port"))
+	if err != nil {
+		http.Error(w, "bad or missing port", http.StatusBadRequest)
+		return
+	}
+	info, err := s.monitor.StopCapture(port)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.audit(r, "capture", audit.Fields{"state": "stopped", "port": strconv.Itoa(port), "file": info.File},
+		"stopped capture on port %d", port)
+	s.writeJSON(w, info)
+}
+
+// captureFileHandler serves a capture file for download.
+func (s *Server) captureFileHandler(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		http.Error(w, "no monitor", http.StatusServiceUnavailable)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	path, err := s.monitor.CaptureFile(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+	http.ServeFile(w, r, path)
+}
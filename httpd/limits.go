@@ -0,0 +1,48 @@
+package httpd
+
+import (
+	"github.com/perbu/sshpod/audit"
+	"github.com/perbu/sshpod/sshmonitor"
+	"net/http"
+	"strconv"
+)
+
+// limitsHandler shows the rate limits and current rates of the tunnel and its forwards.
+func (s *Server) limitsHandler(w http.ResponseWriter, _ *http.Request) {
+	if s.monitor == nil {
+		http.Error(w, "no monitor", http.StatusServiceUnavailable)
+		return
+	}
+	s.writeJSON(w, s.monitor.RateLimits())
+}
+
+// setLimitHandler sets a rate limit. Takes rate (like "512k", 0 to remove the limit)
+// and optionally port. Without a port the limit applies to the whole tunnel.
+func (s *Server) setLimitHandler(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		http.Error(w, "no monitor", http.StatusServiceUnavailable)
+		return
+	}
+	port := 0
+	if v := r.FormValue("port"); v != "" {
+		var err error
+		port, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "bad port", http.StatusBadRequest)
+			return
+		}
+	}
+	rate, err := sshmonitor.ParseRate(r.FormValue("rate"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = s.monitor.SetRateLimit(port, rate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.audit(r, "limit", audit.Fields{"port": strconv.Itoa(port), "rate": r.FormValue("rate")},
+		"set rate limit of port %d to %s", port, r.FormValue("rate"))
+	s.writeJSON(w, s.monitor.RateLimits())
+}
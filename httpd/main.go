@@ -3,9 +3,12 @@ package httpd
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	log "github.com/celerway/chainsaw"
 	"github.com/gorilla/mux"
+	"github.com/perbu/sshpod/audit"
+	"github.com/perbu/sshpod/sshmonitor"
 	"net"
 	"net/http"
 	"strings"
@@ -16,16 +19,23 @@ const useAuth = false
 
 type Server struct {
 	routerId int
+	monitor  *sshmonitor.Monitor
 	user     string
 	pass     string
 	logger   log.Logger
 	port     int
 	router   *mux.Router
 	listener net.Listener
+
+	locatePod  PodLocator
+	podDomain  string
+	recordings Recordings
+	auditLog   *audit.Log
+	bans       Bans
 }
 
-func New(logger log.Logger, routerId int, port int, user, pass string) (Server, error) {
-	server := Server{
+func New(logger log.Logger, routerId int, port int, user, pass string) (*Server, error) {
+	server := &Server{
 		routerId: routerId,
 		user:     user,
 		pass:     pass,
@@ -39,30 +49,44 @@ func New(logger log.Logger, routerId int, port int, user, pass string) (Server,
 	actualPort := listener.Addr().(*net.TCPAddr).Port
 	server.port = actualPort
 	router := mux.NewRouter()
-	if useAuth {
-		router.HandleFunc("/", use(server.myHandler, server.basicAuth))
-	} else {
-		router.HandleFunc("/", server.myHandler)
-	}
-	router.HandleFunc("/stream", server.streamHandler) // no auth.
+	router.HandleFunc("/", server.protect(server.myHandler))
+	router.HandleFunc("/stream", server.streamHandler)                                                             // no auth.
+	router.HandleFunc("/selftest", server.selfTestHandler)                                                         // no auth, used by the tunnel self-test.
+	router.HandleFunc("/monitor", server.basicAuth(server.monitorHandler))                                         // always auth.
+	router.HandleFunc("/limits", server.basicAuth(server.limitsHandler)).Methods(http.MethodGet)                   // always auth.
+	router.HandleFunc("/limits", server.basicAuth(server.setLimitHandler)).Methods(http.MethodPost)                // always auth.
+	router.HandleFunc("/captures", server.basicAuth(server.capturesHandler)).Methods(http.MethodGet)               // always auth.
+	router.HandleFunc("/captures", server.basicAuth(server.captureStartHandler)).Methods(http.MethodPost)          // always auth.
+	router.HandleFunc("/captures/stop", server.basicAuth(server.captureStopHandler)).Methods(http.MethodPost)      // always auth.
+	router.HandleFunc("/captures/{name}", server.basicAuth(server.captureFileHandler)).Methods(http.MethodGet)     // always auth.
+	router.HandleFunc("/recordings", server.basicAuth(server.recordingsHandler)).Methods(http.MethodGet)           // always auth.
+	router.HandleFunc("/recordings/{name}", server.basicAuth(server.recordingFileHandler)).Methods(http.MethodGet) // always auth.
+	router.HandleFunc("/bans", server.basicAuth(server.bansHandler)).Methods(http.MethodGet)                       // always auth.
+	router.HandleFunc("/bans/remove", server.basicAuth(server.unbanHandler)).Methods(http.MethodPost)              // always auth.
+	router.PathPrefix("/pods/{id:[0-9]+}").HandlerFunc(server.basicAuth(server.podPathHandler))                    // always auth.
 
 	server.router = router
 	server.listener = listener
 	return server, nil
 }
 
-func (s Server) Port() int {
+// SetMonitor makes the tunnel monitor available under /monitor and /captures.
+func (s *Server) SetMonitor(m *sshmonitor.Monitor) {
+	s.monitor = m
+}
+
+func (s *Server) Port() int {
 	return s.port
 }
 
-func (s Server) Run(ctx context.Context) {
+func (s *Server) Run(ctx context.Context) {
 	s.logger.Infof("Webserver for ID %d on: :%d", s.routerId, s.port)
 
 	go func() {
 		<-ctx.Done()
 		s.listener.Close()
 	}()
-	err := http.Serve(s.listener, s.router)
+	err := http.Serve(s.listener, s.handler())
 	if err != nil {
 		if ctx.Err() == nil {
 			log.Fatal("http.Serve: ", err)
@@ -71,6 +95,14 @@ func (s Server) Run(ctx context.Context) {
 	}
 }
 
+// protect puts basic auth in front of the handler if auth is enabled.
+func (s *Server) protect(h http.HandlerFunc) http.HandlerFunc {
+	if useAuth {
+		return use(h, s.basicAuth)
+	}
+	return h
+}
+
 func use(h http.HandlerFunc, middleware ...func(http.HandlerFunc) http.HandlerFunc) http.HandlerFunc {
 	for _, m := range middleware {
 		h = m(h)
@@ -78,7 +110,7 @@ func use(h http.HandlerFunc, middleware ...func(http.HandlerFunc) http.HandlerFu
 	return h
 }
 
-func (s Server) myHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) myHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_, err := w.Write([]byte(fmt.Sprintf("This is the router HTTP interface for router %d", s.routerId)))
 	if err != nil {
@@ -88,7 +120,7 @@ func (s Server) myHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func (s Server) streamHandler(w http.ResponseWriter, _ *http.Request) {
+func (s *Server) streamHandler(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Content-type", "text/event-stream")
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -107,8 +139,48 @@ func (s Server) streamHandler(w http.ResponseWriter, _ *http.Request) {
 	return
 }
 
+// monitorHandler returns the tunnel status and connection attempt history as JSON.
+func (s *Server) monitorHandler(w http.ResponseWriter, _ *http.Request) {
+	if s.monitor == nil {
+		http.Error(w, "no monitor", http.StatusServiceUnavailable)
+		return
+	}
+	resp := struct {
+		Status      sshmonitor.Status         `json:"status"`
+		Connections []sshmonitor.ConnStatus   `json:"connections"`
+		Rates       []sshmonitor.RateStatus   `json:"rates"`
+		SelfTest    sshmonitor.SelfTestStatus `json:"selfTest"`
+		History     []sshmonitor.Attempt      `json:"history"`
+	}{
+		Status:      s.monitor.Status(),
+		Connections: s.monitor.Connections(),
+		Rates:       s.monitor.RateLimits(),
+		SelfTest:    s.monitor.SelfTest(),
+		History:     s.monitor.History(),
+	}
+	s.writeJSON(w, resp)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		s.logger.Info("write error: ", err)
+	}
+}
+
+// selfTestHandler echoes the nonce so the tunnel self-test knows it reached this server.
+func (s *Server) selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	nonce := r.FormValue("nonce")
+	w.WriteHeader(http.StatusOK)
+	_, err := fmt.Fprintf(w, "selftest router %d nonce %s\n", s.routerId, nonce)
+	if err != nil {
+		s.logger.Info("write error: ", err)
+	}
+}
+
 // Leverages nemo's answer in http://stackoverflow.com/a/21937924/556573
-func (s Server) basicAuth(h http.HandlerFunc) http.HandlerFunc {
+func (s *Server) basicAuth(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
 		auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
@@ -127,6 +199,7 @@ func (s Server) basicAuth(h http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 		if pair[0] != s.user || pair[1] != s.pass {
+			s.audit(r, "auth", audit.Fields{"method": "basic", "result": "rejected"}, "rejected login to %s", r.URL.Path)
 			http.Error(w, "Not authorized", http.StatusUnauthorized)
 			return
 		}
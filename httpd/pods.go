@@ -0,0 +1,122 @@
+package httpd
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/perbu/sshpod/audit"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PodLocator returns the address on the bastion where the httpd of a pod is
+// reachable through its tunnel.
+type PodLocator func(routerId int) (string, error)
+
+// podHostPattern matches the host names that go to a pod, like router-42.<domain>.
+var podHostPattern = regexp.MustCompile(`^router-(\d+)\.(.+)$`)
+
+// SetPods makes this httpd a reverse proxy for the web interfaces of the pods
+// connected to the bastion, under /pods/<id>/ and, if domain isn't empty, on the
+// host router-<id>.<domain>. Both always need the basic auth credentials.
+func (s *Server) SetPods(locate PodLocator, domain string) {
+	s.locatePod = locate
+	s.podDomain = strings.ToLower(strings.TrimPrefix(domain, "."))
+}
+
+// handler routes requests for pod hosts to the pods, and everything else to the router.
+func (s *Server) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if routerId, ok := s.podHost(r.Host); ok {
+			s.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+				s.proxyPod(w, r, routerId, "")
+			})(w, r)
+			return
+		}
+		s.router.ServeHTTP(w, r)
+	})
+}
+
+// podHost tells if the host is router-<id>.<domain>.
+func (s *Server) podHost(host string) (int, bool) {
+	if s.locatePod == nil || s.podDomain == "" {
+		return 0, false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	m := podHostPattern.FindStringSubmatch(strings.ToLower(host))
+	if m == nil || m[2] != s.podDomain {
+		return 0, false
+	}
+	return parseRouterId(m[1])
+}
+
+// parseRouterId reads a router id written the one way it is written, so that
+// every pod has a single name: no sign, no leading zeros.
+func parseRouterId(s string) (int, bool) {
+	routerId, err := strconv.Atoi(s)
+	if err != nil || strconv.Itoa(routerId) != s || routerId < 0 {
+		return 0, false
+	}
+	return routerId, true
+}
+
+// podPathHandler proxies /pods/<id>/... to the pod, and sends /pods/<id> there.
+func (s *Server) podPathHandler(w http.ResponseWriter, r *http.Request) {
+	routerId, ok := parseRouterId(mux.Vars(r)["id"])
+	prefix := fmt.Sprintf("/pods/%d", routerId)
+	if !ok || (r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/")) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Path == prefix {
+		http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+		return
+	}
+	s.proxyPod(w, r, routerId, prefix)
+}
+
+// proxyPod passes the request on to the pod, without prefix in the path. Responses
+// are flushed as they come, so streams like /stream work.
+func (s *Server) proxyPod(w http.ResponseWriter, r *http.Request, routerId int, prefix string) {
+	if s.locatePod == nil {
+		http.Error(w, "this is not a bastion", http.StatusNotFound)
+		return
+	}
+	addr, err := s.locatePod(routerId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = addr
+			req.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
+			if req.URL.RawPath != "" {
+				req.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, prefix)
+			}
+			if req.URL.Path == "" {
+				req.URL.Path = "/"
+			}
+			// The credentials are the bastion's, the pod has no business with them.
+			req.Header.Del("Authorization")
+			if prefix != "" {
+				req.Header.Set("X-Forwarded-Prefix", prefix)
+			}
+			req.Header.Set("X-Forwarded-Host", r.Host)
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			s.logger.Warnf("proxying to router %d at %s: %s", routerId, addr, err)
+			http.Error(w, fmt.Sprintf("router %d: %s", routerId, err), http.StatusBadGateway)
+		},
+	}
+	s.audit(r, "proxy", audit.Fields{"routerId": strconv.Itoa(routerId), "method": r.Method, "path": r.URL.Path},
+		"%s %s on router %d", r.Method, r.URL.Path, routerId)
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,51 @@
+package httpd
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/perbu/sshpod/sshd"
+	"net/http"
+)
+
+// Recordings is where httpd finds the recorded ssh sessions.
+type Recordings interface {
+	Recordings() ([]sshd.RecordingInfo, error)
+	RecordingFile(name string) (string, error)
+}
+
+// SetRecordings makes the session recordings available under /recordings.
+func (s *Server) SetRecordings(r Recordings) {
+	s.recordings = r
+}
+
+// recordingsHandler lists the recorded sessions, newest first.
+func (s *Server) recordingsHandler(w http.ResponseWriter, _ *http.Request) {
+	if s.recordings == nil {
+		http.Error(w, "no recordings", http.StatusServiceUnavailable)
+		return
+	}
+	list, err := s.recordings.Recordings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	s.writeJSON(w, list)
+}
+
+// recordingFileHandler serves a recording. It plays with asciinema play <url>.
+func (s *Server) recordingFileHandler(w http.ResponseWriter, r *http.Request) {
+	if s.recordings == nil {
+		http.Error(w, "no recordings", http.StatusServiceUnavailable)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	path, err := s.recordings.RecordingFile(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-type", "application/x-asciicast")
+	if r.FormValue("download") != "" {
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+	}
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,252 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Writer writes synthesized TCP streams into a pcapng file. The packets carry raw IP
+// (LINKTYPE_RAW) so both IPv4 and IPv6 addresses can be represented.
+// A Writer is not safe for concurrent use.
+type Writer struct {
+	w       io.Writer
+	written int64
+}
+
+// Direction says which end of a stream sent the data.
+type Direction int
+
+const (
+	FromSrc Direction = iota
+	FromDst
+)
+
+const (
+	blockSHB     = 0x0A0D0D0A
+	blockIDB     = 0x00000001
+	blockEPB     = 0x00000006
+	byteOrder    = 0x1A2B3C4D
+	linkTypeRaw  = 101
+	maxSegment   = 16384
+	tcpFlagFIN   = 0x01
+	tcpFlagSYN   = 0x02
+	tcpFlagPSH   = 0x08
+	tcpFlagACK   = 0x10
+	tcpHeaderLen = 20
+)
+
+// NewWriter writes the section header and interface description to w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	pw := &Writer{w: w}
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], byteOrder)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // major
+	binary.LittleEndian.PutUint16(shb[6:], 0) // minor
+	binary.LittleEndian.PutUint64(shb[8:], 0xFFFFFFFFFFFFFFFF)
+	if err := pw.writeBlock(blockSHB, shb); err != nil {
+		return nil, err
+	}
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], 0) // no snaplen
+	if err := pw.writeBlock(blockIDB, idb); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Written returns the number of bytes written so far.
+func (w *Writer) Written() int64 {
+	return w.written
+}
+
+func (w *Writer) writeBlock(blockType uint32, body []byte) error {
+	pad := (4 - len(body)%4) % 4
+	total := 12 + len(body) + pad
+	buf := make([]byte, total)
+	binary.LittleEndian.PutUint32(buf[0:], blockType)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(total))
+	copy(buf[8:], body)
+	binary.LittleEndian.PutUint32(buf[total-4:], uint32(total))
+	n, err := w.w.Write(buf)
+	w.written += int64(n)
+	return err
+}
+
+func (w *Writer) writePacket(ts time.Time, pkt []byte) error {
+	body := make([]byte, 20+len(pkt))
+	us := uint64(ts.UnixNano() / 1000)
+	binary.LittleEndian.PutUint32(body[0:], 0) // interface id
+	binary.LittleEndian.PutUint32(body[4:], uint32(us>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(us))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(pkt)))
+	copy(body[20:], pkt)
+	return w.writeBlock(blockEPB, body)
+}
+
+// Stream is a synthesized TCP connection between src and dst.
+type Stream struct {
+	w      *Writer
+	addrs  [2]*net.TCPAddr
+	seq    [2]uint32
+	closed bool
+}
+
+// NewStream writes a three-way handshake from src to dst and returns the stream.
+func (w *Writer) NewStream(src, dst *net.TCPAddr) (*Stream, error) {
+	if src == nil || dst == nil {
+		return nil, errors.New("pcapng: stream needs both addresses")
+	}
+	s := &Stream{
+		w:     w,
+		addrs: [2]*net.TCPAddr{src, dst},
+		seq:   [2]uint32{rand.Uint32(), rand.Uint32()},
+	}
+	if err := s.segment(FromSrc, tcpFlagSYN, nil); err != nil {
+		return nil, err
+	}
+	s.seq[FromSrc]++
+	if err := s.segment(FromDst, tcpFlagSYN|tcpFlagACK, nil); err != nil {
+		return nil, err
+	}
+	s.seq[FromDst]++
+	if err := s.segment(FromSrc, tcpFlagACK, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write records p as sent in the given direction.
+func (s *Stream) Write(dir Direction, p []byte) error {
+	if s.closed {
+		return errors.New("pcapng: write on closed stream")
+	}
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxSegment {
+			n = maxSegment
+		}
+		if err := s.segment(dir, tcpFlagPSH|tcpFlagACK, p[:n]); err != nil {
+			return err
+		}
+		s.seq[dir] += uint32(n)
+		p = p[n:]
+	}
+	return nil
+}
+
+// Close writes the FIN exchange that ends the stream.
+func (s *Stream) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if err := s.segment(FromSrc, tcpFlagFIN|tcpFlagACK, nil); err != nil {
+		return err
+	}
+	s.seq[FromSrc]++
+	if err := s.segment(FromDst, tcpFlagFIN|tcpFlagACK, nil); err != nil {
+		return err
+	}
+	s.seq[FromDst]++
+	return s.segment(FromSrc, tcpFlagACK, nil)
+}
+
+// segment writes a single TCP segment sent from the dir end of the stream.
+func (s *Stream) segment(dir Direction, flags byte, payload []byte) error {
+	from, to := s.addrs[dir], s.addrs[1-dir]
+	var ack uint32
+	if flags&tcpFlagACK != 0 {
+		ack = s.seq[1-dir]
+	}
+	tcp := make([]byte, tcpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(from.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(to.Port))
+	binary.BigEndian.PutUint32(tcp[4:], s.seq[dir])
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = (tcpHeaderLen / 4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xFFFF) // window
+	copy(tcp[tcpHeaderLen:], payload)
+
+	src4, dst4 := from.IP.To4(), to.IP.To4()
+	var pkt []byte
+	if src4 != nil && dst4 != nil {
+		pkt = ipv4Packet(src4, dst4, tcp)
+	} else {
+		pkt = ipv6Packet(to16(from.IP), to16(to.IP), tcp)
+	}
+	return s.w.writePacket(time.Now(), pkt)
+}
+
+func to16(ip net.IP) net.IP {
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16
+	}
+	return net.IPv6unspecified
+}
+
+func ipv4Packet(src, dst net.IP, tcp []byte) []byte {
+	pkt := make([]byte, 20+len(tcp))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[6:], 0x4000) // don't fragment
+	pkt[8] = 64
+	pkt[9] = 6 // tcp
+	copy(pkt[12:16], src)
+	copy(pkt[16:20], dst)
+	binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:20], 0))
+
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:4], src)
+	copy(pseudo[4:8], dst)
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	copy(pkt[20:], tcp)
+	return pkt
+}
+
+func ipv6Packet(src, dst net.IP, tcp []byte) []byte {
+	pkt := make([]byte, 40+len(tcp))
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(tcp)))
+	pkt[6] = 6 // tcp
+	pkt[7] = 64
+	copy(pkt[8:24], src)
+	copy(pkt[24:40], dst)
+
+	pseudo := make([]byte, 40)
+	copy(pseudo[0:16], src)
+	copy(pseudo[16:32], dst)
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+	pseudo[39] = 6
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	copy(pkt[40:], tcp)
+	return pkt
+}
+
+// sum is the ones' complement sum of b, not yet folded.
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+func checksum(b []byte, initial uint32) uint16 {
+	s := initial + sum(b)
+	for s > 0xFFFF {
+		s = (s >> 16) + (s & 0xFFFF)
+	}
+	return ^uint16(s)
+}
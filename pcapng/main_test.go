@@ -0,0 +1,259 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+)
+
+type block struct {
+	typ  uint32
+	body []byte
+}
+
+// readBlocks splits a pcapng file into its blocks, checking the lengths around each.
+func readBlocks(t *testing.T, data []byte) []block {
+	t.Helper()
+	var blocks []block
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("%d bytes left over", len(data))
+		}
+		total := int(binary.LittleEndian.Uint32(data[4:]))
+		if total%4 != 0 || total < 12 || total > len(data) {
+			t.Fatalf("bad block length %d with %d bytes left", total, len(data))
+		}
+		if trailer := int(binary.LittleEndian.Uint32(data[total-4:])); trailer != total {
+			t.Fatalf("block length %d, trailing length %d", total, trailer)
+		}
+		blocks = append(blocks, block{typ: binary.LittleEndian.Uint32(data), body: data[8 : total-4]})
+		data = data[total:]
+	}
+	return blocks
+}
+
+// segment is what a test looks at in a packet.
+type segment struct {
+	from, to  string
+	flags     byte
+	seq, ack  uint32
+	payload   int
+	ipVersion int
+}
+
+// parsePacket reads an enhanced packet block, checking the lengths and checksums.
+func parsePacket(t *testing.T, b block) segment {
+	t.Helper()
+	if b.typ != blockEPB {
+		t.Fatalf("block type %#x, want an enhanced packet block", b.typ)
+	}
+	captured, orig := binary.LittleEndian.Uint32(b.body[12:]), binary.LittleEndian.Uint32(b.body[16:])
+	if captured != orig || int(captured) > len(b.body)-20 || len(b.body)-20-int(captured) > 3 {
+		t.Fatalf("captured %d of %d bytes in a body of %d", captured, orig, len(b.body))
+	}
+	pkt := b.body[20 : 20+captured]
+	var seg segment
+	var tcp, pseudo []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		seg.ipVersion = 4
+		if int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+			t.Fatalf("ipv4 total length %d, packet of %d", binary.BigEndian.Uint16(pkt[2:]), len(pkt))
+		}
+		if checksum(pkt[:20], 0) != 0 {
+			t.Errorf("bad ipv4 header checksum")
+		}
+		tcp = pkt[20:]
+		pseudo = append(append(append([]byte{}, pkt[12:20]...), 0, 6), byte(len(tcp)>>8), byte(len(tcp)))
+		seg.from, seg.to = net.IP(pkt[12:16]).String(), net.IP(pkt[16:20]).String()
+	case 6:
+		seg.ipVersion = 6
+		if int(binary.BigEndian.Uint16(pkt[4:])) != len(pkt)-40 {
+			t.Fatalf("ipv6 payload length %d, packet of %d", binary.BigEndian.Uint16(pkt[4:]), len(pkt))
+		}
+		tcp = pkt[40:]
+		pseudo = append(append([]byte{}, pkt[8:40]...), byte(len(tcp)>>24), byte(len(tcp)>>16), byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, 6)
+		seg.from, seg.to = net.IP(pkt[8:24]).String(), net.IP(pkt[24:40]).String()
+	default:
+		t.Fatalf("ip version %d", pkt[0]>>4)
+	}
+	if checksum(tcp, sum(pseudo)) != 0 {
+		t.Errorf("bad tcp checksum")
+	}
+	seg.from = net.JoinHostPort(seg.from, strconv.Itoa(int(binary.BigEndian.Uint16(tcp[0:]))))
+	seg.to = net.JoinHostPort(seg.to, strconv.Itoa(int(binary.BigEndian.Uint16(tcp[2:]))))
+	seg.seq, seg.ack = binary.BigEndian.Uint32(tcp[4:]), binary.BigEndian.Uint32(tcp[8:])
+	seg.flags = tcp[13]
+	seg.payload = len(tcp) - int(tcp[12]>>4)*4
+	return seg
+}
+
+func TestNewWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Written() != int64(buf.Len()) {
+		t.Errorf("Written() = %d, wrote %d", w.Written(), buf.Len())
+	}
+	blocks := readBlocks(t, buf.Bytes())
+	if len(blocks) != 2 || blocks[0].typ != blockSHB || blocks[1].typ != blockIDB {
+		t.Fatalf("got blocks %v, want a section header and an interface description", blocks)
+	}
+	if magic := binary.LittleEndian.Uint32(blocks[0].body); magic != byteOrder {
+		t.Errorf("byte order magic %#x", magic)
+	}
+	if major := binary.LittleEndian.Uint16(blocks[0].body[4:]); major != 1 {
+		t.Errorf("version %d", major)
+	}
+	if link := binary.LittleEndian.Uint16(blocks[1].body); link != linkTypeRaw {
+		t.Errorf("link type %d, want %d", link, linkTypeRaw)
+	}
+}
+
+func TestWriteBlockPadding(t *testing.T) {
+	for n := 0; n < 9; n++ {
+		buf := &bytes.Buffer{}
+		w := &Writer{w: buf}
+		if err := w.writeBlock(blockEPB, bytes.Repeat([]byte{0xAA}, n)); err != nil {
+			t.Fatal(err)
+		}
+		blocks := readBlocks(t, buf.Bytes())
+		if len(blocks) != 1 || len(blocks[0].body) != (n+3)/4*4 {
+			t.Errorf("a body of %d went into %v", n, blocks)
+		}
+		if w.Written() != int64(buf.Len()) {
+			t.Errorf("Written() = %d, wrote %d", w.Written(), buf.Len())
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	const (
+		syn    = tcpFlagSYN
+		synAck = tcpFlagSYN | tcpFlagACK
+		ack    = tcpFlagACK
+		data   = tcpFlagPSH | tcpFlagACK
+		fin    = tcpFlagFIN | tcpFlagACK
+	)
+	type write struct {
+		dir Direction
+		n   int
+	}
+	tests := []struct {
+		name     string
+		src, dst string
+		writes   []write
+		// flags and payloads are what each packet on the wire carries, in order.
+		flags    []byte
+		payloads []int
+		ip       int
+	}{
+		{
+			name:     "ipv4, nothing sent",
+			src:      "192.0.2.1:40000",
+			dst:      "192.0.2.2:22",
+			flags:    []byte{syn, synAck, ack, fin, fin, ack},
+			payloads: []int{0, 0, 0, 0, 0, 0},
+			ip:       4,
+		},
+		{
+			name:     "ipv4, both ways",
+			src:      "192.0.2.1:40000",
+			dst:      "192.0.2.2:22",
+			writes:   []write{{FromSrc, 5}, {FromDst, 7}, {FromSrc, 1}},
+			flags:    []byte{syn, synAck, ack, data, data, data, fin, fin, ack},
+			payloads: []int{0, 0, 0, 5, 7, 1, 0, 0, 0},
+			ip:       4,
+		},
+		{
+			name:     "ipv6, split into segments",
+			src:      "[2001:db8::1]:40000",
+			dst:      "[2001:db8::2]:80",
+			writes:   []write{{FromDst, 2*maxSegment + 3}},
+			flags:    []byte{syn, synAck, ack, data, data, data, fin, fin, ack},
+			payloads: []int{0, 0, 0, maxSegment, maxSegment, 3, 0, 0, 0},
+			ip:       6,
+		},
+		{
+			name:     "ipv4 to ipv6",
+			src:      "192.0.2.1:40000",
+			dst:      "[2001:db8::2]:80",
+			writes:   []write{{FromSrc, 3}},
+			flags:    []byte{syn, synAck, ack, data, fin, fin, ack},
+			payloads: []int{0, 0, 0, 3, 0, 0, 0},
+			ip:       6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w, err := NewWriter(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src, _ := net.ResolveTCPAddr("tcp", tt.src)
+			dst, _ := net.ResolveTCPAddr("tcp", tt.dst)
+			s, err := w.NewStream(src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, wr := range tt.writes {
+				if err := s.Write(wr.dir, bytes.Repeat([]byte{'x'}, wr.n)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Errorf("closing twice: %v", err)
+			}
+			if err := s.Write(FromSrc, []byte("x")); err == nil {
+				t.Errorf("wrote on a closed stream")
+			}
+
+			blocks := readBlocks(t, buf.Bytes())[2:]
+			if len(blocks) != len(tt.flags) {
+				t.Fatalf("got %d packets, want %d", len(blocks), len(tt.flags))
+			}
+			// next is the sequence number each end is at, as the other end acknowledged it.
+			next := map[string]uint32{}
+			for i, b := range blocks {
+				seg := parsePacket(t, b)
+				if seg.ipVersion != tt.ip {
+					t.Errorf("packet %d is ipv%d, want ipv%d", i, seg.ipVersion, tt.ip)
+				}
+				if seg.flags != tt.flags[i] || seg.payload != tt.payloads[i] {
+					t.Errorf("packet %d has flags %#x and %d bytes, want %#x and %d", i, seg.flags, seg.payload, tt.flags[i], tt.payloads[i])
+				}
+				if want, ok := next[seg.from]; ok && seg.seq != want {
+					t.Errorf("packet %d from %s has seq %d, want %d", i, seg.from, seg.seq, want)
+				}
+				if want, ok := next[seg.to]; ok && seg.flags&tcpFlagACK != 0 && seg.ack != want {
+					t.Errorf("packet %d from %s acks %d, want %d", i, seg.from, seg.ack, want)
+				}
+				next[seg.from] = seg.seq + uint32(seg.payload)
+				if seg.flags&(tcpFlagSYN|tcpFlagFIN) != 0 {
+					next[seg.from]++
+				}
+			}
+			if len(next) != 2 {
+				t.Errorf("packets went between %v, want two ends", next)
+			}
+		})
+	}
+}
+
+func TestStreamNeedsAddresses(t *testing.T) {
+	w, err := NewWriter(&bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.NewStream(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}, nil); err == nil {
+		t.Errorf("made a stream to nowhere")
+	}
+}
@@ -0,0 +1,183 @@
+package sshd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/perbu/sshpod/audit"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SetAuditLog records auth attempts, sessions, commands, file transfers, forwards
+// and tunnels in the audit log, besides the ordinary log.
+func (app *Server) SetAuditLog(l *audit.Log) {
+	app.auditLog = l
+}
+
+// audit records something a user did that we want to be able to account for later.
+func (a *Server) audit(ctx context.Context, event string, format string, args ...interface{}) {
+	a.auditFields(ctx, event, nil, format, args...)
+}
+
+// auditFields is audit with details that go into the audit log as they are.
+func (a *Server) auditFields(ctx context.Context, event string, fields audit.Fields, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	user := sessionUser(ctx)
+	remote := ""
+	if addr, ok := ctx.Value(ssh.ContextKeyRemoteAddr).(net.Addr); ok {
+		remote = addr.String()
+	}
+	if cert, ok := ctx.Value(ctxKeyCert).(*gossh.Certificate); ok {
+		if fields == nil {
+			fields = audit.Fields{}
+		}
+		fields["keyId"] = cert.KeyId
+		fields["serial"] = strconv.FormatUint(cert.Serial, 10)
+	}
+	if sctx, ok := ctx.(ssh.Context); ok {
+		a.logger.Infof("audit %s: user %s: %s", event, who(sctx), msg)
+	} else {
+		a.logger.Infof("audit %s: user %s from %s: %s", event, user, remote, msg)
+	}
+	a.writeAudit(audit.Record{Event: event, User: user, Remote: remote, Fields: fields, Message: msg})
+}
+
+// writeAudit puts a record in the audit log, if there is one.
+func (a *Server) writeAudit(r audit.Record) {
+	r.Source = "sshd"
+	if err := a.auditLog.Write(r); err != nil {
+		a.logger.Errorf("writing audit log: %s", err)
+	}
+}
+
+// auditAuth records what became of a key or certificate the client tried to log
+// in with: rejected or offered when the client puts it forward, and accepted once
+// the client has proven it holds the key.
+func (a *Server) auditAuth(ctx ssh.Context, key ssh.PublicKey, result string) {
+	fields := audit.Fields{"method": "publickey", "keyType": key.Type(), "result": result}
+	if cert, ok := key.(*gossh.Certificate); ok {
+		fields["fingerprint"] = gossh.FingerprintSHA256(cert.Key)
+		fields["ca"] = gossh.FingerprintSHA256(cert.SignatureKey)
+		fields["keyId"] = cert.KeyId
+		fields["serial"] = strconv.FormatUint(cert.Serial, 10)
+		fields["principals"] = strings.Join(cert.ValidPrincipals, ",")
+	} else {
+		fields["fingerprint"] = gossh.FingerprintSHA256(key)
+	}
+	a.writeAudit(audit.Record{
+		Event:   "auth",
+		User:    ctx.User(),
+		Remote:  ctx.RemoteAddr().String(),
+		Fields:  fields,
+		Message: fmt.Sprintf("%s %s key %s", fields["result"], key.Type(), fields["fingerprint"]),
+	})
+}
+
+// auditSession records the start of a session. The function it returns records the end.
+func (a *Server) auditSession(s ssh.Session) func() {
+	ctx := s.Context()
+	fields := audit.Fields{"kind": "shell"}
+	if forced := a.forcedCommand(ctx); forced != "" {
+		fields["kind"], fields["command"] = "exec", forced
+	} else if _, ok := a.routedPod(ctx); ok {
+		fields["kind"] = "route"
+	} else if s.RawCommand() != "" {
+		fields["kind"], fields["command"] = "exec", s.RawCommand()
+	}
+	if _, _, isPty := s.Pty(); isPty {
+		fields["pty"] = "yes"
+	}
+	if rs, ok := s.(*recordedSession); ok {
+		fields["recording"] = rs.rec.info.Name
+	}
+	started := time.Now()
+	a.auditFields(ctx, "session", fields, "%s session started", fields["kind"])
+	return func() {
+		end := audit.Fields{"kind": fields["kind"], "seconds": strconv.Itoa(int(time.Since(started).Seconds()))}
+		a.auditFields(ctx, "session", end, "%s session ended after %s", fields["kind"], time.Since(started).Round(time.Second))
+	}
+}
+
+// transferFields are the details of a file transfer.
+func transferFields(direction, path string, n int64) audit.Fields {
+	return audit.Fields{"direction": direction, "path": path, "bytes": strconv.FormatInt(n, 10)}
+}
+
+type auditCommand struct{ app *Server }
+
+func (auditCommand) Name() string  { return "audit" }
+func (auditCommand) Usage() string { return "audit verify [-allow-trimmed] [-anchor hash] | tail [n]" }
+func (auditCommand) Help() string {
+	return "Checks the audit log for tampering, or shows the last records in it.\n" +
+		"verify checks that every record is intact and chained to the one before, and\n" +
+		"that the log starts at the first record unless -allow-trimmed is given. Keep the\n" +
+		"last hash it shows elsewhere and give it as -anchor next time: the log must still\n" +
+		"reach it, which catches a log cut short or written anew."
+}
+
+func (c auditCommand) Parse(args []string) (Runner, error) {
+	if len(args) == 0 || (args[0] != "verify" && args[0] != "tail") {
+		return nil, fmt.Errorf("audit needs verify or tail")
+	}
+	if args[0] == "verify" {
+		fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		allowTrimmed := fs.Bool("allow-trimmed", false, "")
+		anchor := fs.String("anchor", "", "")
+		if err := fs.Parse(args[1:]); err != nil {
+			return nil, err
+		}
+		if fs.NArg() > 0 {
+			return nil, fmt.Errorf("audit verify takes no arguments besides its flags")
+		}
+		return func(_ context.Context, w io.Writer) error {
+			return c.app.verifyAudit(w, audit.VerifyOptions{AllowTrimmed: *allowTrimmed, Anchor: *anchor})
+		}, nil
+	}
+	n := 20
+	if len(args) > 1 {
+		var err error
+		n, err = strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("audit tail: bad count '%s'", args[1])
+		}
+	}
+	return func(_ context.Context, w io.Writer) error {
+		return c.app.tailAudit(w, n)
+	}, nil
+}
+
+// tailAudit shows the last n records of the audit log.
+func (a *Server) tailAudit(w io.Writer, n int) error {
+	if a.auditLog == nil {
+		return fmt.Errorf("there is no audit log")
+	}
+	records, err := audit.Tail(a.auditLog.Path(), n)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		fmt.Fprintf(w, "%6d %s %-5s %-8s %-12s %s\n", r.Seq, r.Time.Format(time.RFC3339), r.Source, r.Event, r.User, r.Message)
+	}
+	return nil
+}
+
+// verifyAudit checks the audit log for tampering.
+func (a *Server) verifyAudit(w io.Writer, opts audit.VerifyOptions) error {
+	if a.auditLog == nil {
+		return fmt.Errorf("there is no audit log")
+	}
+	v, err := audit.VerifyFile(a.auditLog.Path(), opts)
+	if err != nil {
+		return fmt.Errorf("audit log %s did NOT verify: %w (%d good records)", a.auditLog.Path(), err, v.Records)
+	}
+	_, err = fmt.Fprintf(w, "audit log %s is intact: %d records, %d to %d, last hash %s\n",
+		a.auditLog.Path(), v.Records, v.First, v.Last, v.Hash)
+	return err
+}
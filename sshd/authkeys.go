@@ -0,0 +1,273 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyOptions are the options of an authorized_keys entry that sshd honours.
+type keyOptions struct {
+	from             []string
+	command          string
+	noPty            bool
+	noPortForwarding bool
+	// principals limits the certificates of a cert-authority to these principals.
+	// On a plain key they are the principals the key stands for, as the login
+	// name is up to the client.
+	principals []string
+	expiry     time.Time
+}
+
+// authorizedKey is one line of an authorized_keys file.
+type authorizedKey struct {
+	key           gossh.PublicKey
+	certAuthority bool
+	comment       string
+	options       keyOptions
+}
+
+// authorizedKeys is an authorized_keys file. It is read again when it changes.
+type authorizedKeys struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	keys    []authorizedKey
+	logger  interface{ Warnf(string, ...interface{}) }
+}
+
+// SetAuthorizedKeys makes sshd accept the keys and certificate authorities in an
+// authorized_keys file, in addition to the key given to New. The file is read
+// again whenever it changes.
+func (app *Server) SetAuthorizedKeys(filename string) error {
+	if filename == "" {
+		app.authKeys = nil
+		return nil
+	}
+	if _, err := os.Stat(filename); err != nil {
+		return fmt.Errorf("authorized keys: %w", err)
+	}
+	ak := &authorizedKeys{path: filename, logger: app.logger}
+	if err := ak.reload(); err != nil {
+		return err
+	}
+	app.authKeys = ak
+	app.logger.Infof("loaded %d authorized keys from %s", len(ak.keys), filename)
+	return nil
+}
+
+// reload reads the file if it has changed since it was last read. A file that is
+// gone has no keys. Must be called with the lock held.
+func (ak *authorizedKeys) reload() error {
+	info, err := os.Stat(ak.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if ak.keys != nil || !ak.modTime.IsZero() {
+			ak.logger.Warnf("%s is gone, no authorized keys", ak.path)
+		}
+		ak.keys, ak.modTime, ak.size = nil, time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("authorized keys: %w", err)
+	}
+	if info.ModTime().Equal(ak.modTime) && info.Size() == ak.size {
+		return nil
+	}
+	data, err := os.ReadFile(ak.path)
+	if err != nil {
+		return fmt.Errorf("authorized keys: %w", err)
+	}
+	ak.keys = parseAuthorizedKeys(data, func(line int, err error) {
+		ak.logger.Warnf("%s line %d ignored: %s", ak.path, line, err)
+	})
+	ak.modTime = info.ModTime()
+	ak.size = info.Size()
+	return nil
+}
+
+// current returns the entries of the file, reading it again if it has changed.
+// If the file can't be read, the entries last read are kept. If it has been
+// removed, there are none.
+func (ak *authorizedKeys) current() []authorizedKey {
+	ak.mu.Lock()
+	defer ak.mu.Unlock()
+	if err := ak.reload(); err != nil {
+		ak.logger.Warnf("%s, keeping the %d keys loaded earlier", err, len(ak.keys))
+	}
+	return ak.keys
+}
+
+// parseAuthorizedKeys parses the lines of an authorized_keys file. Lines that can't be
+// parsed are reported to bad and skipped, like OpenSSH does.
+func parseAuthorizedKeys(data []byte, bad func(line int, err error)) []authorizedKey {
+	var keys []authorizedKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 16*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, comment, options, _, err := gossh.ParseAuthorizedKey(line)
+		if err != nil {
+			bad(n, err)
+			continue
+		}
+		ak := authorizedKey{key: key, comment: comment}
+		if err := ak.parseOptions(options); err != nil {
+			bad(n, err)
+			continue
+		}
+		keys = append(keys, ak)
+	}
+	return keys
+}
+
+func (ak *authorizedKey) parseOptions(options []string) error {
+	for _, opt := range options {
+		name, value, hasValue := strings.Cut(opt, "=")
+		name = strings.ToLower(name)
+		if hasValue {
+			var err error
+			value, err = unquoteOption(value)
+			if err != nil {
+				return fmt.Errorf("option %s: %w", name, err)
+			}
+		}
+		switch name {
+		case "cert-authority":
+			ak.certAuthority = true
+		case "from":
+			ak.options.from = strings.Split(value, ",")
+		case "command":
+			ak.options.command = value
+		case "no-pty":
+			ak.options.noPty = true
+		case "no-port-forwarding":
+			ak.options.noPortForwarding = true
+		case "restrict":
+			ak.options.noPty = true
+			ak.options.noPortForwarding = true
+		case "principals":
+			ak.options.principals = strings.Split(value, ",")
+		case "expiry-time":
+			t, err := parseExpiryTime(value)
+			if err != nil {
+				return err
+			}
+			ak.options.expiry = t
+		case "no-agent-forwarding", "no-x11-forwarding", "no-user-rc":
+			// We don't offer these anyway.
+		default:
+			return fmt.Errorf("unsupported option %s", name)
+		}
+		if hasValue != (name == "from" || name == "command" || name == "principals" || name == "expiry-time") {
+			return fmt.Errorf("option %s used wrong", name)
+		}
+	}
+	return nil
+}
+
+// unquoteOption strips the double quotes around an option value.
+func unquoteOption(v string) (string, error) {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return "", fmt.Errorf("value must be quoted")
+	}
+	return strings.ReplaceAll(v[1:len(v)-1], `\"`, `"`), nil
+}
+
+// parseExpiryTime parses YYYYMMDD[HHMM[SS]] in local time, or UTC with a Z suffix.
+func parseExpiryTime(v string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(v, "Z") || strings.HasSuffix(v, "z") {
+		loc = time.UTC
+		v = v[:len(v)-1]
+	}
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(v) == len(layout) {
+			return time.ParseInLocation(layout, v, loc)
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad expiry-time %s", v)
+}
+
+// allows checks the options that limit when a key can be used.
+func (o *keyOptions) allows(remote net.Addr, now time.Time) error {
+	if !o.expiry.IsZero() && !now.Before(o.expiry) {
+		return fmt.Errorf("key expired at %s", o.expiry.Format(time.RFC3339))
+	}
+	if len(o.from) > 0 && !matchFrom(o.from, remote) {
+		return fmt.Errorf("not allowed from %s", remote)
+	}
+	return nil
+}
+
+// matchFrom checks an address against a from= list. Entries are addresses with
+// wildcards, or CIDR blocks, and a leading ! makes a match refuse. Host names are
+// not looked up.
+func matchFrom(patterns []string, remote net.Addr) bool {
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		host = remote.String()
+	}
+	ip := net.ParseIP(host)
+	matched := false
+	for _, p := range patterns {
+		negate := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		var hit bool
+		if _, block, err := net.ParseCIDR(p); err == nil {
+			hit = ip != nil && block.Contains(ip)
+		} else {
+			hit, _ = path.Match(p, host)
+		}
+		if hit && negate {
+			return false
+		}
+		matched = matched || hit
+	}
+	return matched
+}
+
+// authorizedKeysFor returns the entries for key, either plain keys or cert authorities.
+// A key may be listed more than once with different options.
+func (a *Server) authorizedKeysFor(key gossh.PublicKey, certAuthority bool) []authorizedKey {
+	if a.authKeys == nil {
+		return nil
+	}
+	var res []authorizedKey
+	for _, ak := range a.authKeys.current() {
+		if ak.certAuthority == certAuthority && ssh.KeysEqual(ak.key, key) {
+			res = append(res, ak)
+		}
+	}
+	return res
+}
+
+// sessionOptions returns the authorized_keys options of the key the user logged in with.
+func sessionOptions(ctx ssh.Context) keyOptions {
+	if o, ok := ctx.Value(ctxKeyOptions).(*keyOptions); ok {
+		return *o
+	}
+	return keyOptions{}
+}
+
+// ptyCallback refuses terminals to keys marked no-pty.
+func (a *Server) ptyCallback(ctx ssh.Context, _ ssh.Pty) bool {
+	if sessionOptions(ctx).noPty {
+		a.logger.Infof("pty refused for %s from %s: no-pty", ctx.User(), ctx.RemoteAddr())
+		return false
+	}
+	return true
+}
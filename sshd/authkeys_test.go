@@ -0,0 +1,116 @@
+package sshd
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAuthorizedKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBSwcw25zpWE2j/YAZL4EiwrxrZzqDCa+OjtYKwIRS9v"
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	tests := []struct {
+		name          string
+		line          string
+		bad           string
+		want          keyOptions
+		certAuthority bool
+	}{
+		{name: "plain", line: testAuthorizedKey + " alice"},
+		{name: "comment", line: "# " + testAuthorizedKey},
+		{name: "unknown option", line: `no-such-option ` + testAuthorizedKey, bad: "unsupported option no-such-option"},
+		{name: "environment", line: `environment="A=b" ` + testAuthorizedKey, bad: "unsupported option environment"},
+		{name: "flag with value", line: `no-pty="yes" ` + testAuthorizedKey, bad: "option no-pty used wrong"},
+		{name: "value without value", line: `from ` + testAuthorizedKey, bad: "option from used wrong"},
+		{name: "unquoted value", line: `from=10.0.0.1 ` + testAuthorizedKey, bad: "value must be quoted"},
+		{
+			name: "from",
+			line: `from="10.0.0.0/8,!10.1.2.3,192.168.1.*" ` + testAuthorizedKey,
+			want: keyOptions{from: []string{"10.0.0.0/8", "!10.1.2.3", "192.168.1.*"}},
+		},
+		{
+			name: "expiry-time utc",
+			line: `expiry-time="202501021504Z" ` + testAuthorizedKey,
+			want: keyOptions{expiry: time.Date(2025, 1, 2, 15, 4, 0, 0, time.UTC)},
+		},
+		{
+			name: "expiry-time date",
+			line: `expiry-time="20250102Z" ` + testAuthorizedKey,
+			want: keyOptions{expiry: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)},
+		},
+		{name: "expiry-time bad", line: `expiry-time="2025" ` + testAuthorizedKey, bad: "bad expiry-time 2025"},
+		{
+			name: "restrict",
+			line: `restrict,command="uptime" ` + testAuthorizedKey,
+			want: keyOptions{noPty: true, noPortForwarding: true, command: "uptime"},
+		},
+		{
+			name:          "cert authority",
+			line:          `cert-authority,principals="admin,ops" ` + testAuthorizedKey,
+			want:          keyOptions{principals: []string{"admin", "ops"}},
+			certAuthority: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var bad []string
+			keys := parseAuthorizedKeys([]byte(tt.line+"\n"), func(line int, err error) {
+				bad = append(bad, err.Error())
+			})
+			if tt.bad != "" {
+				if len(keys) != 0 || len(bad) != 1 || !strings.Contains(bad[0], tt.bad) {
+					t.Fatalf("got %d keys and errors %q, want the error %q", len(keys), bad, tt.bad)
+				}
+				return
+			}
+			if len(bad) != 0 {
+				t.Fatalf("unexpected errors %q", bad)
+			}
+			if strings.HasPrefix(tt.line, "#") {
+				if len(keys) != 0 {
+					t.Fatalf("got %d keys from a comment", len(keys))
+				}
+				return
+			}
+			if len(keys) != 1 {
+				t.Fatalf("got %d keys, want 1", len(keys))
+			}
+			if keys[0].certAuthority != tt.certAuthority {
+				t.Errorf("certAuthority is %v, want %v", keys[0].certAuthority, tt.certAuthority)
+			}
+			if !reflect.DeepEqual(keys[0].options, tt.want) {
+				t.Errorf("options are %+v, want %+v", keys[0].options, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyOptionsAllows(t *testing.T) {
+	now := time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC)
+	from := []string{"10.0.0.0/8", "!10.1.2.3", "192.168.1.*"}
+	tests := []struct {
+		name    string
+		options keyOptions
+		remote  string
+		ok      bool
+	}{
+		{name: "no options", remote: "1.2.3.4", ok: true},
+		{name: "from block", options: keyOptions{from: from}, remote: "10.9.9.9", ok: true},
+		{name: "from wildcard", options: keyOptions{from: from}, remote: "192.168.1.20", ok: true},
+		{name: "from negated", options: keyOptions{from: from}, remote: "10.1.2.3"},
+		{name: "from elsewhere", options: keyOptions{from: from}, remote: "172.16.0.1"},
+		{name: "not expired", options: keyOptions{expiry: now.Add(time.Second)}, remote: "1.2.3.4", ok: true},
+		{name: "expired", options: keyOptions{expiry: now}, remote: "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := &net.TCPAddr{IP: net.ParseIP(tt.remote), Port: 50000}
+			err := tt.options.allows(remote, now)
+			if (err == nil) != tt.ok {
+				t.Errorf("allows(%s) = %v, want ok %v", tt.remote, err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package sshd
+
+import (
+	"context"
+	"fmt"
+	"github.com/perbu/sshpod/audit"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTracked is how many addresses with failures are kept before the old ones are swept out.
+const maxTracked = 4096
+
+// BruteForce configures the protection against guessing keys. Zero turns a part off.
+type BruteForce struct {
+	// MaxFailures failed logins from an address within Window get it banned for BanTime.
+	MaxFailures int
+	Window      time.Duration
+	BanTime     time.Duration
+	// MaxUnauthenticated is how many connections may be logging in at the same time.
+	MaxUnauthenticated int
+	// LoginGrace is how long a connection has to log in.
+	LoginGrace time.Duration
+	// Exempt lists addresses and networks that are never banned. None are by
+	// default. Logins through a bastion reach a pod from loopback, so exempting
+	// loopback on a pod turns banning off for all of them.
+	Exempt []string
+}
+
+// Ban is an address that may not connect for a while.
+type Ban struct {
+	Address string    `json:"address"`
+	Reason  string    `json:"reason"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+}
+
+// banList tracks failed logins per address and the bans that follow.
+type banList struct {
+	maxFailures        int
+	window             time.Duration
+	banTime            time.Duration
+	maxUnauthenticated int
+	loginGrace         time.Duration
+	exempt             []*net.IPNet
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	bans     map[string]Ban
+}
+
+func newBanList() *banList {
+	return &banList{failures: make(map[string][]time.Time), bans: make(map[string]Ban)}
+}
+
+// SetBruteForce sets how failed logins are dealt with.
+func (app *Server) SetBruteForce(cfg BruteForce) error {
+	if cfg.MaxFailures < 0 || cfg.MaxUnauthenticated < 0 {
+		return fmt.Errorf("brute force limits can't be negative")
+	}
+	if cfg.MaxFailures > 0 && (cfg.Window <= 0 || cfg.BanTime <= 0) {
+		return fmt.Errorf("banning needs a window and a ban time")
+	}
+	var exempt []*net.IPNet
+	for _, s := range cfg.Exempt {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("bad exempt network '%s': %w", s, err)
+		}
+		exempt = append(exempt, n)
+	}
+	b := app.bans
+	b.mu.Lock()
+	b.maxFailures, b.window, b.banTime = cfg.MaxFailures, cfg.Window, cfg.BanTime
+	b.maxUnauthenticated, b.loginGrace, b.exempt = cfg.MaxUnauthenticated, cfg.LoginGrace, exempt
+	b.mu.Unlock()
+	app.logger.Infof("banning for %s after %d failed logins in %s; at most %d logging in at once, %s to do it",
+		cfg.BanTime, cfg.MaxFailures, cfg.Window, cfg.MaxUnauthenticated, cfg.LoginGrace)
+	return nil
+}
+
+// Bans returns the bans in force, soonest to expire first.
+func (app *Server) Bans() []Ban {
+	b := app.bans
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	res := make([]Ban, 0, len(b.bans))
+	for addr, ban := range b.bans {
+		if now.After(ban.Until) {
+			delete(b.bans, addr)
+			continue
+		}
+		res = append(res, ban)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Until.Before(res[j].Until) })
+	return res
+}
+
+// Ban bans the address for d, whether it has failed to log in or not. Exempt
+// addresses can't be banned.
+func (app *Server) Ban(addr string, d time.Duration, reason string) error {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("'%s' is not an ip address", addr)
+	}
+	if d <= 0 {
+		return fmt.Errorf("a ban needs a duration")
+	}
+	addr = ip.String()
+	now := time.Now()
+	ban := Ban{Address: addr, Reason: reason, Since: now, Until: now.Add(d)}
+	b := app.bans
+	b.mu.Lock()
+	if b.isExempt(addr) {
+		b.mu.Unlock()
+		return fmt.Errorf("%s is exempt from bans", addr)
+	}
+	b.bans[addr] = ban
+	delete(b.failures, addr)
+	b.mu.Unlock()
+	app.logger.Warnf("banned %s until %s: %s", addr, ban.Until.Format(time.RFC3339), reason)
+	app.writeAudit(audit.Record{
+		Event:   "ban",
+		Remote:  addr,
+		Fields:  audit.Fields{"action": "ban", "until": ban.Until.UTC().Format(time.RFC3339)},
+		Message: reason,
+	})
+	return nil
+}
+
+// Unban lifts the ban on the address.
+func (app *Server) Unban(addr string) error {
+	if ip := net.ParseIP(addr); ip != nil {
+		addr = ip.String()
+	}
+	b := app.bans
+	b.mu.Lock()
+	_, ok := b.bans[addr]
+	delete(b.bans, addr)
+	delete(b.failures, addr)
+	b.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s is not banned", addr)
+	}
+	app.logger.Infof("lifted the ban on %s", addr)
+	app.writeAudit(audit.Record{Event: "ban", Remote: addr, Fields: audit.Fields{"action": "unban"}, Message: "ban lifted"})
+	return nil
+}
+
+// banned tells if the address is banned. Exempt addresses never are.
+func (b *banList) banned(addr string) (Ban, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.isExempt(addr) {
+		return Ban{}, false
+	}
+	ban, ok := b.bans[addr]
+	if ok && time.Now().After(ban.Until) {
+		delete(b.bans, addr)
+		return ban, false
+	}
+	return ban, ok
+}
+
+// isExempt tells if the address may never be banned. Must be called with the lock held.
+func (b *banList) isExempt(addr string) bool {
+	ip := net.ParseIP(addr)
+	for _, n := range b.exempt {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultBanTime is how long an address is banned for failing to log in.
+func (b *banList) defaultBanTime() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.banTime
+}
+
+// loginFailed counts a connection from the address that failed to log in, and
+// bans the address if it has failed too often.
+func (a *Server) loginFailed(addr, reason string) {
+	b := a.bans
+	b.mu.Lock()
+	if b.maxFailures == 0 || b.isExempt(addr) {
+		b.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if len(b.failures) >= maxTracked {
+		for k, times := range b.failures {
+			if now.Sub(times[len(times)-1]) > b.window {
+				delete(b.failures, k)
+			}
+		}
+	}
+	recent := b.failures[addr][:0]
+	for _, t := range b.failures[addr] {
+		if now.Sub(t) <= b.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	b.failures[addr] = recent
+	n, limit, window, banTime := len(recent), b.maxFailures, b.window, b.banTime
+	b.mu.Unlock()
+	a.logger.Infof("failed login from %s (%d in %s): %s", addr, n, window, reason)
+	if n >= limit {
+		_ = a.Ban(addr, banTime, fmt.Sprintf("%d failed logins in %s", n, window))
+	}
+}
+
+type bansCommand struct{ app *Server }
+
+func (bansCommand) Name() string { return "bans" }
+func (bansCommand) Usage() string {
+	return "bans [add <address> [duration] | remove <address>]"
+}
+func (bansCommand) Help() string {
+	return "Shows the addresses banned for failing to log in, or bans and unbans one.\n" +
+		"Without a duration, add bans for as long as a failed login would."
+}
+
+func (c bansCommand) Parse(args []string) (Runner, error) {
+	if len(args) == 0 {
+		return func(_ context.Context, w io.Writer) error {
+			return c.app.handleBans(w)
+		}, nil
+	}
+	switch {
+	case args[0] == "add" && (len(args) == 2 || len(args) == 3):
+		d := c.app.bans.defaultBanTime()
+		if len(args) == 3 {
+			var err error
+			d, err = time.ParseDuration(args[2])
+			if err != nil {
+				return nil, fmt.Errorf("bans: bad duration '%s'", args[2])
+			}
+		}
+		return func(ctx context.Context, w io.Writer) error {
+			if err := c.app.Ban(args[1], d, "banned by "+sessionUser(ctx)); err != nil {
+				return err
+			}
+			_, err := fmt.Fprintf(w, "banned %s for %s\n", args[1], d)
+			return err
+		}, nil
+	case args[0] == "remove" && len(args) == 2:
+		return func(_ context.Context, w io.Writer) error {
+			if err := c.app.Unban(args[1]); err != nil {
+				return err
+			}
+			_, err := fmt.Fprintf(w, "lifted the ban on %s\n", args[1])
+			return err
+		}, nil
+	}
+	return nil, fmt.Errorf("bans takes no arguments, add <address> [duration] or remove <address>")
+}
+
+// handleBans lists the bans.
+func (a *Server) handleBans(w io.Writer) error {
+	bans := a.Bans()
+	if len(bans) == 0 {
+		_, err := io.WriteString(w, "no bans\n")
+		return err
+	}
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "%-40s %-20s %-10s %s\n", "ADDRESS", "UNTIL", "LEFT", "REASON")
+	for _, ban := range bans {
+		left := time.Until(ban.Until).Round(time.Second)
+		fmt.Fprintf(&sb, "%-40s %-20s %-10s %s\n", ban.Address, ban.Until.UTC().Format(time.RFC3339), left, ban.Reason)
+	}
+	sb.WriteString(strconv.Itoa(len(bans)) + " banned\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,154 @@
+package sshd
+
+import (
+	log "github.com/celerway/chainsaw"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testBanServer(t *testing.T, cfg BruteForce) *Server {
+	t.Helper()
+	a := &Server{logger: log.MakeLogger("test"), bans: newBanList()}
+	if err := a.SetBruteForce(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestSetBruteForce(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  BruteForce
+		err  string
+	}{
+		{name: "off"},
+		{name: "banning", cfg: BruteForce{MaxFailures: 3, Window: time.Minute, BanTime: time.Hour}},
+		{name: "exempt", cfg: BruteForce{Exempt: []string{"10.0.0.0/8", " 192.0.2.1 ", "::1", "", "fd00::/8"}}},
+		{name: "no window", cfg: BruteForce{MaxFailures: 3, BanTime: time.Hour}, err: "needs a window"},
+		{name: "no ban time", cfg: BruteForce{MaxFailures: 3, Window: time.Minute}, err: "needs a window"},
+		{name: "negative", cfg: BruteForce{MaxFailures: -1}, err: "negative"},
+		{name: "negative unauthenticated", cfg: BruteForce{MaxUnauthenticated: -1}, err: "negative"},
+		{name: "bad network", cfg: BruteForce{Exempt: []string{"10.0.0.0/33"}}, err: "bad exempt network"},
+		{name: "host name", cfg: BruteForce{Exempt: []string{"localhost"}}, err: "bad exempt network"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Server{logger: log.MakeLogger("test"), bans: newBanList()}
+			err := a.SetBruteForce(tt.cfg)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestLoginFailed(t *testing.T) {
+	cfg := BruteForce{MaxFailures: 3, Window: time.Minute, BanTime: time.Hour, Exempt: []string{"10.0.0.0/8", "::1"}}
+	tests := []struct {
+		name string
+		cfg  BruteForce
+		addr string
+		// earlier are failures from before the test, this long ago.
+		earlier  []time.Duration
+		failures int
+		banned   bool
+	}{
+		{name: "under the limit", cfg: cfg, addr: "192.0.2.1", failures: 2},
+		{name: "at the limit", cfg: cfg, addr: "192.0.2.1", failures: 3, banned: true},
+		{name: "ipv6", cfg: cfg, addr: "2001:db8::1", failures: 3, banned: true},
+		{name: "recent failures count", cfg: cfg, addr: "192.0.2.1", earlier: []time.Duration{10 * time.Second, 20 * time.Second}, failures: 1, banned: true},
+		{name: "old failures don't", cfg: cfg, addr: "192.0.2.1", earlier: []time.Duration{2 * time.Minute, 3 * time.Minute}, failures: 1},
+		{name: "exempt network", cfg: cfg, addr: "10.1.2.3", failures: 5},
+		{name: "exempt address", cfg: cfg, addr: "::1", failures: 5},
+		{name: "loopback isn't exempt by default", cfg: BruteForce{MaxFailures: 3, Window: time.Minute, BanTime: time.Hour}, addr: "127.0.0.1", failures: 3, banned: true},
+		{name: "banning off", addr: "192.0.2.1", failures: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testBanServer(t, tt.cfg)
+			for _, ago := range tt.earlier {
+				a.bans.failures[tt.addr] = append(a.bans.failures[tt.addr], time.Now().Add(-ago))
+			}
+			for i := 0; i < tt.failures; i++ {
+				a.loginFailed(tt.addr, "test")
+			}
+			ban, banned := a.bans.banned(tt.addr)
+			if banned != tt.banned {
+				t.Fatalf("banned = %v, want %v", banned, tt.banned)
+			}
+			if !banned {
+				return
+			}
+			if d := time.Until(ban.Until); d <= 0 || d > tt.cfg.BanTime {
+				t.Errorf("banned for %s, want %s", d, tt.cfg.BanTime)
+			}
+			if _, ok := a.bans.failures[tt.addr]; ok {
+				t.Errorf("the failures were kept after the ban")
+			}
+		})
+	}
+}
+
+func TestBan(t *testing.T) {
+	tests := []struct {
+		name   string
+		addr   string
+		d      time.Duration
+		err    string
+		check  string
+		banned bool
+	}{
+		{name: "address", addr: "192.0.2.1", d: time.Hour, check: "192.0.2.1", banned: true},
+		{name: "written out ipv6", addr: "2001:db8:0:0::1", d: time.Hour, check: "2001:db8::1", banned: true},
+		{name: "other address", addr: "192.0.2.1", d: time.Hour, check: "192.0.2.2"},
+		{name: "exempt", addr: "10.0.0.1", d: time.Hour, err: "exempt", check: "10.0.0.1"},
+		{name: "not an address", addr: "example.com", d: time.Hour, err: "not an ip address"},
+		{name: "network", addr: "192.0.2.0/24", d: time.Hour, err: "not an ip address"},
+		{name: "no duration", addr: "192.0.2.1", err: "needs a duration", check: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testBanServer(t, BruteForce{Exempt: []string{"10.0.0.0/8"}})
+			err := a.Ban(tt.addr, tt.d, "test")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tt.check == "" {
+				return
+			}
+			if _, banned := a.bans.banned(tt.check); banned != tt.banned {
+				t.Errorf("banned(%s) = %v, want %v", tt.check, banned, tt.banned)
+			}
+		})
+	}
+}
+
+func TestBanExpires(t *testing.T) {
+	a := testBanServer(t, BruteForce{})
+	a.bans.bans["192.0.2.1"] = Ban{Address: "192.0.2.1", Since: time.Now().Add(-2 * time.Hour), Until: time.Now().Add(-time.Hour)}
+	a.bans.bans["192.0.2.2"] = Ban{Address: "192.0.2.2", Since: time.Now(), Until: time.Now().Add(time.Hour)}
+	if _, banned := a.bans.banned("192.0.2.1"); banned {
+		t.Errorf("the expired ban still holds")
+	}
+	bans := a.Bans()
+	if len(bans) != 1 || bans[0].Address != "192.0.2.2" {
+		t.Errorf("got bans %v, want only 192.0.2.2", bans)
+	}
+	if err := a.Unban("192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Unban("192.0.2.2"); err == nil {
+		t.Errorf("lifted a ban twice")
+	}
+}
@@ -0,0 +1,448 @@
+package sshd
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bastion configures sshd to act as the bastion that pods connect their tunnels to.
+type Bastion struct {
+	// PodPrincipal marks the certificates of pods. Only they may forward ports here.
+	PodPrincipal string
+	// BindHost is where the ports pods ask for are bound, whatever address they ask for.
+	// Pods ask for port 0 and get the port the system picks, so one pod can't take
+	// the port of another, or of a service on the host.
+	BindHost string
+	// Name is sent to pods when they open their session.
+	Name string
+	// FleetFile keeps the directory of pods across restarts. Empty keeps it in memory.
+	FleetFile string
+	// RouteUser is who the bastion logs in as when it takes a user to a pod's sshd
+	// (ssh router-42@bastion). The user's certificate must be valid for it, plain
+	// keys can't go on to pods, and the user's roles need the route capability.
+	RouteUser string
+	// RouteCA signs the certificates users log in to pods with. The pods must trust
+	// it as a user CA. Without it no one can go on to pods.
+	RouteCA ssh.Signer
+	// LabelExtension is the certificate extension holding the labels of a pod, a comma
+	// separated list like site=oslo,model=rb5009. Empty turns labels off.
+	LabelExtension string
+}
+
+// ForwardInfo is a port a pod has bound on the bastion.
+type ForwardInfo struct {
+	// Requested is the address the pod asked for.
+	Requested string `json:"requested"`
+	// Port is the port bound on the bastion.
+	Port int `json:"port"`
+	// Service is what the pod serves there, ssh or http, if the bastion could tell.
+	Service string `json:"service,omitempty"`
+}
+
+// PodInfo is a pod that is connected to the bastion.
+type PodInfo struct {
+	KeyId       string            `json:"keyId"`
+	RouterId    int               `json:"routerId"`
+	Connections int               `json:"connections"`
+	Since       time.Time         `json:"since"`
+	Remote      []string          `json:"remote"`
+	Version     string            `json:"version"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Forwards    []ForwardInfo     `json:"forwards"`
+}
+
+// routerIdPattern picks the router id off the end of a pod's key id, like pod-42 or router-42.
+var routerIdPattern = regexp.MustCompile(`(\d+)$`)
+
+// podConn is one ssh connection from a pod. Pods may run several in parallel.
+type podConn struct {
+	keyId     string
+	routerId  int
+	remote    string
+	version   string
+	since     time.Time
+	labels    map[string]string
+	conn      *gossh.ServerConn
+	listeners map[string]*podListener // by requested address
+	// key is the key of the certificate the pod logged in with.
+	key gossh.PublicKey
+	// hostKeys are the host keys of the pod's sshd, as the pod told us.
+	hostKeys []gossh.PublicKey
+}
+
+type podListener struct {
+	requested string
+	listener  net.Listener
+	port      int
+	service   string
+}
+
+// podRegistry keeps track of the connected pods and their forwards.
+type podRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*podConn // by ssh session id
+}
+
+// SetBastion turns on bastion mode. Pods logging in with a certificate carrying
+// cfg.PodPrincipal may then have ports bound on this host for their tunnels.
+func (app *Server) SetBastion(cfg Bastion) error {
+	if cfg.PodPrincipal == "" {
+		app.bastion = nil
+		app.fleet = nil
+		return nil
+	}
+	if cfg.BindHost == "" {
+		cfg.BindHost = "127.0.0.1"
+	}
+	if net.ParseIP(cfg.BindHost) == nil {
+		return fmt.Errorf("bastion bind host %s is not an IP address", cfg.BindHost)
+	}
+	if cfg.Name == "" {
+		cfg.Name = fmt.Sprintf("sshpod-%d", app.routerId)
+	}
+	if cfg.RouteUser == "" {
+		cfg.RouteUser = "root"
+	}
+	f, err := loadFleet(cfg.FleetFile)
+	if err != nil {
+		return err
+	}
+	app.bastion = &cfg
+	app.fleet = f
+	app.logger.Infof("bastion mode: pods with principal %s may bind ports on %s", cfg.PodPrincipal, cfg.BindHost)
+	return nil
+}
+
+// podCert returns the certificate of the session if it is a pod's.
+func (a *Server) podCert(ctx ssh.Context) (*gossh.Certificate, bool) {
+	cert, ok := ctx.Value(ctxKeyCert).(*gossh.Certificate)
+	if !ok || !a.isPodCert(cert) {
+		return nil, false
+	}
+	return cert, true
+}
+
+// isPodCert tells if the certificate is a pod's.
+func (a *Server) isPodCert(cert *gossh.Certificate) bool {
+	if a.bastion == nil || cert == nil {
+		return false
+	}
+	for _, p := range cert.ValidPrincipals {
+		if p == a.bastion.PodPrincipal {
+			return true
+		}
+	}
+	return false
+}
+
+// podLabels reads the labels of a pod off its certificate.
+func (a *Server) podLabels(cert *gossh.Certificate) map[string]string {
+	if a.bastion.LabelExtension == "" {
+		return nil
+	}
+	value, ok := cert.Extensions[a.bastion.LabelExtension]
+	if !ok {
+		return nil
+	}
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(value, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		if k != "" {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// podConnFor returns the registry entry of the pod connection, adding it if needed.
+// The entry goes away with the connection.
+func (a *Server) podConnFor(ctx ssh.Context, cert *gossh.Certificate) *podConn {
+	r := a.pods
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pc, ok := r.conns[ctx.SessionID()]
+	if ok {
+		return pc
+	}
+	routerId := 0
+	if m := routerIdPattern.FindStringSubmatch(cert.KeyId); m != nil {
+		routerId, _ = strconv.Atoi(m[1])
+	}
+	conn, _ := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	pc = &podConn{
+		keyId:     cert.KeyId,
+		routerId:  routerId,
+		remote:    ctx.RemoteAddr().String(),
+		version:   ctx.ClientVersion(),
+		since:     time.Now(),
+		labels:    a.podLabels(cert),
+		conn:      conn,
+		listeners: make(map[string]*podListener),
+		key:       cert.Key,
+	}
+	if ctx.Err() != nil {
+		// The connection is going down, don't bring it back into the registry.
+		return pc
+	}
+	r.conns[ctx.SessionID()] = pc
+	a.logger.Infof("pod %s (router %d) connected from %s", pc.keyId, pc.routerId, pc.remote)
+	a.audit(ctx, "tunnel", "pod %s connected", pc.keyId)
+	go func() {
+		<-ctx.Done()
+		r.mu.Lock()
+		delete(r.conns, ctx.SessionID())
+		for _, l := range pc.listeners {
+			_ = l.listener.Close()
+		}
+		r.mu.Unlock()
+		a.logger.Infof("pod %s (router %d) from %s disconnected", pc.keyId, pc.routerId, pc.remote)
+		a.audit(ctx, "tunnel", "pod %s disconnected", pc.keyId)
+		a.fleetChanged()
+	}()
+	return pc
+}
+
+// Pods returns the pods connected to the bastion, ordered by router id.
+func (app *Server) Pods() []PodInfo {
+	r := app.pods
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	byKey := make(map[string]*PodInfo)
+	for _, pc := range r.conns {
+		p, ok := byKey[pc.keyId]
+		if !ok {
+			p = &PodInfo{KeyId: pc.keyId, RouterId: pc.routerId, Since: pc.since, Version: pc.version, Labels: pc.labels}
+			byKey[pc.keyId] = p
+		}
+		p.Connections++
+		p.Remote = append(p.Remote, pc.remote)
+		if pc.since.Before(p.Since) {
+			p.Since = pc.since
+		}
+		for _, l := range pc.listeners {
+			p.Forwards = append(p.Forwards, ForwardInfo{Requested: l.requested, Port: l.port, Service: l.service})
+		}
+	}
+	res := make([]PodInfo, 0, len(byKey))
+	for _, p := range byKey {
+		sort.Strings(p.Remote)
+		sort.Slice(p.Forwards, func(i, j int) bool { return p.Forwards[i].Port < p.Forwards[j].Port })
+		res = append(res, *p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].RouterId != res[j].RouterId {
+			return res[i].RouterId < res[j].RouterId
+		}
+		return res[i].KeyId < res[j].KeyId
+	})
+	return res
+}
+
+// podOwnsPort tells if the address is a port the session's pod has bound on the bastion.
+func (a *Server) podOwnsPort(ctx ssh.Context, ip net.IP, port int) bool {
+	cert, ok := a.podCert(ctx)
+	if !ok {
+		return false
+	}
+	if !ip.Equal(net.ParseIP(a.bastion.BindHost)) && !(ip.IsLoopback() && net.ParseIP(a.bastion.BindHost).IsUnspecified()) {
+		return false
+	}
+	a.pods.mu.Lock()
+	defer a.pods.mu.Unlock()
+	for _, pc := range a.pods.conns {
+		if pc.keyId != cert.KeyId {
+			continue
+		}
+		for _, l := range pc.listeners {
+			if l.port == port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// podHostKeys returns the host keys the pod's connections told us about, or the
+// keys they logged in with if they told us none.
+func (a *Server) podHostKeys(keyId string) []gossh.PublicKey {
+	a.pods.mu.Lock()
+	defer a.pods.mu.Unlock()
+	var announced, login []gossh.PublicKey
+	for _, pc := range a.pods.conns {
+		if pc.keyId == keyId {
+			announced = append(announced, pc.hostKeys...)
+			login = append(login, pc.key)
+		}
+	}
+	if len(announced) > 0 {
+		return announced
+	}
+	return login
+}
+
+// podHostKeysHandler takes note of the host keys a pod tells us its sshd has.
+func (a *Server) podHostKeysHandler(ctx ssh.Context, _ *ssh.Server, req *gossh.Request) (bool, []byte) {
+	cert, ok := a.podCert(ctx)
+	if !ok {
+		return false, nil
+	}
+	blobs, err := parseStrings(req.Payload)
+	if err != nil {
+		a.logger.Warnf("bad %s from %s: %s", req.Type, who(ctx), err)
+		return false, nil
+	}
+	keys := make([]gossh.PublicKey, 0, len(blobs))
+	for _, blob := range blobs {
+		key, err := gossh.ParsePublicKey(blob)
+		if err != nil {
+			a.logger.Warnf("bad %s from %s: %s", req.Type, who(ctx), err)
+			return false, nil
+		}
+		keys = append(keys, key)
+	}
+	pc := a.podConnFor(ctx, cert)
+	a.pods.mu.Lock()
+	pc.hostKeys = keys
+	a.pods.mu.Unlock()
+	a.logger.Infof("pod %s has %d host keys", pc.keyId, len(keys))
+	return true, nil
+}
+
+// tcpipForward payloads, RFC 4254 section 7.1.
+type tcpipForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type tcpipForwardReply struct {
+	BindPort uint32
+}
+
+type forwardedTCPIPData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// tcpipForwardHandler handles tcpip-forward and cancel-tcpip-forward from pods.
+func (a *Server) tcpipForwardHandler(ctx ssh.Context, _ *ssh.Server, req *gossh.Request) (bool, []byte) {
+	cert, ok := a.podCert(ctx)
+	if !ok {
+		a.audit(ctx, "tunnel", "refused %s, not a pod", req.Type)
+		return false, []byte("port forwarding is not allowed")
+	}
+	var fwd tcpipForwardRequest
+	if err := gossh.Unmarshal(req.Payload, &fwd); err != nil {
+		a.logger.Warnf("bad %s from %s: %s", req.Type, who(ctx), err)
+		return false, nil
+	}
+	pc := a.podConnFor(ctx, cert)
+	requested := net.JoinHostPort(fwd.BindAddr, strconv.Itoa(int(fwd.BindPort)))
+	defer a.fleetChanged()
+	if req.Type == "cancel-tcpip-forward" {
+		return a.cancelForward(ctx, pc, requested), nil
+	}
+	if err := checkForward(fwd); err != nil {
+		a.audit(ctx, "tunnel", "refused to bind %s for pod %s: %s", requested, pc.keyId, err)
+		return false, nil
+	}
+	port, err := a.bindForward(ctx, pc, fwd)
+	if err != nil {
+		a.logger.Warnf("binding %s for pod %s: %s", requested, pc.keyId, err)
+		return false, nil
+	}
+	return true, gossh.Marshal(&tcpipForwardReply{BindPort: uint32(port)})
+}
+
+// checkForward tells if a pod may ask for the forward.
+func checkForward(fwd tcpipForwardRequest) error {
+	if fwd.BindPort != 0 {
+		return fmt.Errorf("pods ask for port 0, not %d", fwd.BindPort)
+	}
+	return nil
+}
+
+// bindForward binds the port a pod asked for and relays the connections to it.
+func (a *Server) bindForward(ctx ssh.Context, pc *podConn, fwd tcpipForwardRequest) (int, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(a.bastion.BindHost, strconv.Itoa(int(fwd.BindPort))))
+	if err != nil {
+		return 0, err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	// The pod asked for port 0 and learns the real one from the reply; it looks
+	// for that in the forwarded-tcpip channels.
+	requested := net.JoinHostPort(fwd.BindAddr, strconv.Itoa(port))
+	a.pods.mu.Lock()
+	if old, ok := pc.listeners[requested]; ok {
+		_ = old.listener.Close()
+	}
+	l := &podListener{requested: requested, listener: ln, port: port}
+	pc.listeners[requested] = l
+	a.pods.mu.Unlock()
+	a.audit(ctx, "tunnel", "pod %s bound port %d for %s", pc.keyId, port, requested)
+	go a.acceptForward(ctx, pc, ln, fwd.BindAddr, port)
+	go a.probeForward(pc, l, fwd.BindAddr)
+	return port, nil
+}
+
+// acceptForward hands the connections to a bound port over to the pod.
+func (a *Server) acceptForward(ctx ssh.Context, pc *podConn, ln net.Listener, bindAddr string, port int) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		origin := c.RemoteAddr().(*net.TCPAddr)
+		payload := gossh.Marshal(&forwardedTCPIPData{
+			DestAddr:   bindAddr,
+			DestPort:   uint32(port),
+			OriginAddr: origin.IP.String(),
+			OriginPort: uint32(origin.Port),
+		})
+		go func() {
+			ch, reqs, err := pc.conn.OpenChannel("forwarded-tcpip", payload)
+			if err != nil {
+				a.logger.Warnf("pod %s refused connection to port %d: %s", pc.keyId, port, err)
+				_ = c.Close()
+				return
+			}
+			go gossh.DiscardRequests(reqs)
+			a.pipeForward(ctx, ch, c, fmt.Sprintf("pod %s port %d from %s", pc.keyId, port, origin))
+		}()
+	}
+}
+
+// cancelForward closes a port the pod had bound.
+func (a *Server) cancelForward(ctx ssh.Context, pc *podConn, requested string) bool {
+	a.pods.mu.Lock()
+	l, ok := pc.listeners[requested]
+	delete(pc.listeners, requested)
+	a.pods.mu.Unlock()
+	if !ok {
+		return false
+	}
+	_ = l.listener.Close()
+	a.audit(ctx, "tunnel", "pod %s released port %d", pc.keyId, l.port)
+	return true
+}
+
+// podSession is the session of a pod. It only keeps the tunnel up; there is no
+// terminal, but like before the bastion tells the pod its name.
+func (a *Server) podSession(s ssh.Session, cert *gossh.Certificate) {
+	a.podConnFor(s.Context(), cert)
+	a.fleetChanged()
+	_, _ = io.WriteString(s, fmt.Sprintf("HOSTNAME=%s\r\n", a.bastion.Name))
+	// Pods send nothing, but drain the input anyway. The session lasts as long as the connection.
+	go func() { _, _ = io.Copy(io.Discard, s) }()
+	<-s.Context().Done()
+}
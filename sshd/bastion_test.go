@@ -0,0 +1,28 @@
+package sshd
+
+import "testing"
+
+func TestCheckForward(t *testing.T) {
+	tests := []struct {
+		name string
+		fwd  tcpipForwardRequest
+		ok   bool
+	}{
+		{name: "any port", fwd: tcpipForwardRequest{BindAddr: "localhost", BindPort: 0}, ok: true},
+		{name: "any port on any address", fwd: tcpipForwardRequest{BindAddr: "", BindPort: 0}, ok: true},
+		{name: "fixed port", fwd: tcpipForwardRequest{BindAddr: "localhost", BindPort: 2222}},
+		{name: "privileged port", fwd: tcpipForwardRequest{BindAddr: "localhost", BindPort: 22}},
+		{name: "highest port", fwd: tcpipForwardRequest{BindAddr: "localhost", BindPort: 65535}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkForward(tt.fwd)
+			if tt.ok && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("allowed port %d", tt.fwd.BindPort)
+			}
+		})
+	}
+}
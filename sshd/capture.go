@@ -0,0 +1,93 @@
+package sshd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+type captureCommand struct{ app *Server }
+
+func (captureCommand) Name() string { return "capture" }
+func (captureCommand) Usage() string {
+	return "capture <start|stop|list> [port] [duration] [maxbytes]"
+}
+func (captureCommand) Help() string {
+	return `Captures the traffic through a forward into a pcapng file.
+"capture start <port> [duration] [maxbytes]" starts a capture, "capture stop <port>" stops it
+and "capture list" shows the captures. Finished captures can be downloaded from httpd.`
+}
+
+func (c captureCommand) Parse(args []string) (Runner, error) {
+	if len(args) > 0 && args[0] != "list" && len(args) < 2 {
+		return nil, fmt.Errorf("capture %s requires a port", args[0])
+	}
+	return func(_ context.Context, w io.Writer) error {
+		return c.app.handleCapture(w, args)
+	}, nil
+}
+
+// handleCapture starts, stops and lists traffic captures on the forwards.
+func (a *Server) handleCapture(w io.Writer, args []string) error {
+	if a.monitor == nil {
+		return fmt.Errorf("no tunnel monitor configured")
+	}
+	if len(args) == 0 || args[0] == "list" {
+		captures := a.monitor.Captures()
+		if len(captures) == 0 {
+			_, err := io.WriteString(w, "no captures\n")
+			return err
+		}
+		for _, c := range captures {
+			state := "done"
+			if c.Active {
+				state = "active"
+			}
+			fmt.Fprintf(w, "%-40s port %-5d %-6s %4d streams %10d bytes %s\n",
+				c.File, c.Port, state, c.Streams, c.Bytes, c.Reason)
+		}
+		return nil
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("capture %s requires a port", args[0])
+	}
+	port, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("capture: bad port '%s'", args[1])
+	}
+	switch args[0] {
+	case "start":
+		var duration time.Duration
+		var maxBytes int64
+		if len(args) > 2 {
+			duration, err = time.ParseDuration(args[2])
+			if err != nil {
+				return fmt.Errorf("capture: bad duration '%s'", args[2])
+			}
+		}
+		if len(args) > 3 {
+			maxBytes, err = strconv.ParseInt(args[3], 10, 64)
+			if err != nil {
+				return fmt.Errorf("capture: bad size '%s'", args[3])
+			}
+		}
+		c, err := a.monitor.StartCapture(port, maxBytes, duration)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "capturing port %d to %s for up to %s or %d bytes\n",
+			c.Port, c.File, time.Duration(c.MaxDuration*float64(time.Second)), c.MaxBytes)
+		return err
+	case "stop":
+		c, err := a.monitor.StopCapture(port)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "stopped capture %s, %d streams, %d bytes\n", c.File, c.Streams, c.Bytes)
+		return err
+	default:
+		return fmt.Errorf("capture: unknown subcommand '%s'", args[0])
+	}
+}
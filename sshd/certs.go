@@ -0,0 +1,95 @@
+package sshd
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+)
+
+// Critical options in user certificates that sshd acts on.
+const (
+	optForceCommand  = "force-command"
+	optSourceAddress = "source-address"
+)
+
+// CertInfo identifies the certificate a user logged in with.
+type CertInfo struct {
+	KeyId      string
+	Serial     uint64
+	Principals []string
+}
+
+func (c CertInfo) String() string {
+	return fmt.Sprintf("cert %s serial %d principals %s", c.KeyId, c.Serial, strings.Join(c.Principals, ","))
+}
+
+// SessionCert returns the certificate the user of the session logged in with, if it was one.
+func SessionCert(ctx ssh.Context) (CertInfo, bool) {
+	cert, ok := ctx.Value(ctxKeyCert).(*gossh.Certificate)
+	if !ok {
+		return CertInfo{}, false
+	}
+	return CertInfo{KeyId: cert.KeyId, Serial: cert.Serial, Principals: cert.ValidPrincipals}, true
+}
+
+// who describes the user of a session for the logs.
+func who(ctx ssh.Context) string {
+	if c, ok := SessionCert(ctx); ok {
+		return fmt.Sprintf("%s from %s (%s)", ctx.User(), ctx.RemoteAddr(), c)
+	}
+	return fmt.Sprintf("%s from %s", ctx.User(), ctx.RemoteAddr())
+}
+
+// checkCriticalOptions acts on the critical options that must hold when the
+// certificate is used. options are those of the authority in authorized_keys, if any.
+func checkCriticalOptions(cert *gossh.Certificate, remote net.Addr, options *keyOptions) error {
+	if list, ok := cert.CriticalOptions[optSourceAddress]; ok {
+		allowed, err := matchSourceAddress(list, remote)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("source address %s not in %s", remote, list)
+		}
+	}
+	if forced, ok := cert.CriticalOptions[optForceCommand]; ok && options != nil {
+		if options.command != "" && options.command != forced {
+			return fmt.Errorf("forced command in the certificate conflicts with the one in authorized keys")
+		}
+	}
+	return nil
+}
+
+// matchSourceAddress checks remote against a comma separated list of addresses and CIDR blocks.
+func matchSourceAddress(list string, remote net.Addr) (bool, error) {
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return false, fmt.Errorf("remote address %s: %w", remote, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false, fmt.Errorf("remote address %s is not an IP", remote)
+	}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			if addr := net.ParseIP(entry); addr != nil {
+				if addr.Equal(ip) {
+					return true, nil
+				}
+				continue
+			}
+			return false, fmt.Errorf("bad source-address entry '%s'", entry)
+		}
+		_, block, err := net.ParseCIDR(entry)
+		if err != nil {
+			return false, fmt.Errorf("bad source-address entry '%s'", entry)
+		}
+		if block.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,219 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultHistorySize = 500
+
+// cmdHistory stores the terminal command history of each user in a directory.
+type cmdHistory struct {
+	mu   sync.Mutex
+	dir  string
+	size int
+}
+
+// SetHistory enables persistent command history. Each user gets a file in dir
+// holding at most size commands. Size 0 gives the default, an empty dir keeps no
+// history. Users with a certificate are told apart by its key ID, as many of them
+// may share a login name.
+func (app *Server) SetHistory(dir string, size int) {
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	app.history.mu.Lock()
+	defer app.history.mu.Unlock()
+	app.history.dir = dir
+	app.history.size = size
+}
+
+// path returns the file of the owner. Key IDs and logins are kept in directories
+// of their own, and names are encoded so no two share a file.
+func (h *cmdHistory) path(owner historyKey) string {
+	name := base64.RawURLEncoding.EncodeToString([]byte(owner.name))
+	if name == "" {
+		name = "_"
+	}
+	return filepath.Join(h.dir, owner.kind, name+".history")
+}
+
+// load returns the last commands of the user, oldest first.
+func (h *cmdHistory) load(user historyKey) ([]string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.dir == "" {
+		return nil, nil
+	}
+	lines, err := h.read(user)
+	if len(lines) > h.size {
+		lines = lines[len(lines)-h.size:]
+	}
+	return lines, err
+}
+
+// read returns all the lines in the user's file. Must be called with the lock held.
+func (h *cmdHistory) read(user historyKey) ([]string, error) {
+	fh, err := os.Open(h.path(user))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	var lines []string
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// add appends a command to the history of the user. The file is rewritten
+// with the last size commands when it grows too big.
+func (h *cmdHistory) add(user historyKey, line string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path(user)), 0o700); err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(h.path(user), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(fh, line)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	lines, err := h.read(user)
+	if err != nil || len(lines) <= h.size {
+		return err
+	}
+	lines = lines[len(lines)-h.size:]
+	tmp := h.path(user) + ".tmp"
+	err = os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path(user))
+}
+
+// seedReader returns a reader that replays the user's history as typed lines ahead of r.
+// The terminal only has an internal history that is filled by ReadLine, so the session
+// reads these lines with output discarded before the user gets the prompt.
+func seedReader(lines []string, r io.Reader) io.Reader {
+	if len(lines) == 0 {
+		return r
+	}
+	buf := bytes.Buffer{}
+	for _, l := range lines {
+		buf.WriteString(l)
+		buf.WriteByte('\r')
+	}
+	return io.MultiReader(&buf, r)
+}
+
+// switchWriter discards output until it is enabled.
+type switchWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	enabled bool
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.enabled {
+		return len(p), nil
+	}
+	return s.w.Write(p)
+}
+
+func (s *switchWriter) enable() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enabled = true
+}
+
+// sessionUser returns the user of the session the context belongs to.
+func sessionUser(ctx context.Context) string {
+	user, _ := ctx.Value(ssh.ContextKeyUser).(string)
+	return user
+}
+
+// historyKey names whose history it is: a certificate key ID or a login name.
+type historyKey struct {
+	kind string
+	name string
+}
+
+// historyOwner returns whose history the session uses: the key ID of the
+// certificate if the user has one, else the login name.
+func historyOwner(ctx context.Context) historyKey {
+	if cert, ok := ctx.Value(ctxKeyCert).(*gossh.Certificate); ok && cert.KeyId != "" {
+		return historyKey{kind: "keyid", name: cert.KeyId}
+	}
+	return historyKey{kind: "login", name: sessionUser(ctx)}
+}
+
+type historyCommand struct{ app *Server }
+
+func (historyCommand) Name() string  { return "history" }
+func (historyCommand) Usage() string { return "history [n]" }
+func (historyCommand) Help() string {
+	return "Shows your last n (default 20) commands. History is kept across sessions."
+}
+
+func (c historyCommand) Parse(args []string) (Runner, error) {
+	n := 20
+	if len(args) > 1 {
+		return nil, fmt.Errorf("history takes at most one argument")
+	}
+	if len(args) == 1 {
+		var err error
+		n, err = strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("history: bad count '%s'", args[0])
+		}
+	}
+	return func(ctx context.Context, w io.Writer) error {
+		lines, err := c.app.history.load(historyOwner(ctx))
+		if err != nil {
+			return fmt.Errorf("loading history: %w", err)
+		}
+		if lines == nil {
+			_, err = io.WriteString(w, "no history\n")
+			return err
+		}
+		first := 0
+		if len(lines) > n {
+			first = len(lines) - n
+		}
+		for i := first; i < len(lines); i++ {
+			if _, err := fmt.Fprintf(w, "%5d  %s\n", i+1, lines[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,258 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/perbu/sshpod/audit"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Command is something that can be run from the sshd terminal.
+type Command interface {
+	// Name is the word that invokes the command.
+	Name() string
+	// Usage is a one-line synopsis, like "chonk <n>".
+	Usage() string
+	// Help describes what the command does. The first line is used in the command list.
+	Help() string
+	// Parse checks the arguments and returns a Runner bound to them.
+	Parse(args []string) (Runner, error)
+}
+
+// Runner is a parsed command, ready to run. Output goes to w.
+type Runner func(ctx context.Context, w io.Writer) error
+
+// registry holds the commands known to the server.
+type registry struct {
+	mu   sync.RWMutex
+	cmds map[string]Command
+}
+
+func newRegistry() *registry {
+	return &registry{cmds: make(map[string]Command)}
+}
+
+func (r *registry) add(cmd Command) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cmds[cmd.Name()]; ok {
+		return fmt.Errorf("command %s already registered", cmd.Name())
+	}
+	r.cmds[cmd.Name()] = cmd
+	return nil
+}
+
+func (r *registry) get(name string) (Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.cmds[name]
+	return cmd, ok
+}
+
+// list returns the commands sorted by name.
+func (r *registry) list() []Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make([]Command, 0, len(r.cmds))
+	for _, c := range r.cmds {
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name() < res[j].Name() })
+	return res
+}
+
+// Register adds a command to the terminal. Names must be unique.
+func (app *Server) Register(cmd Command) error {
+	return app.commands.add(cmd)
+}
+
+// Commands returns the registered commands, sorted by name.
+func (app *Server) Commands() []Command {
+	return app.commands.list()
+}
+
+// registerBuiltins adds the commands that come with the server.
+func (app *Server) registerBuiltins() {
+	for _, cmd := range []Command{
+		helpCommand{app},
+		chonkCommand{},
+		echoCommand{},
+		tunnelCommand{app},
+		historyCommand{app},
+		captureCommand{app},
+		limitCommand{app},
+		selfTestCommand{app},
+		podsCommand{app},
+		fanoutCommand{app},
+		auditCommand{app},
+		bansCommand{app},
+		hostKeysCommand{app},
+	} {
+		if err := app.Register(cmd); err != nil {
+			app.logger.Fatalf("registering builtin: %s", err)
+		}
+	}
+}
+
+// Exit statuses reported for exec requests.
+const (
+	ExitOK          = 0
+	ExitFailure     = 1
+	ExitUsage       = 2
+	ExitDenied      = 126
+	ExitUnknown     = 127
+	ExitInterrupted = 130
+)
+
+// ExitError lets a command fail with a specific exit status.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// exitCode gives the exit status for an error returned by dispatch.
+func exitCode(err error) int {
+	var exitErr *ExitError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &exitErr):
+		return exitErr.Code
+	case errors.Is(err, context.Canceled):
+		return ExitInterrupted
+	default:
+		return ExitFailure
+	}
+}
+
+// dispatch looks up the command named by args[0], parses the rest of the arguments and runs it.
+func (a *Server) dispatch(ctx context.Context, w io.Writer, args []string) (err error) {
+	if len(args) == 0 {
+		return nil
+	}
+	defer func() {
+		code := exitCode(err)
+		a.auditFields(ctx, "command", audit.Fields{"command": strings.Join(args, " "), "exit": strconv.Itoa(code)},
+			"%s, exit status %d", strings.Join(args, " "), code)
+	}()
+	cmd, ok := a.commands.get(args[0])
+	if !ok {
+		return &ExitError{
+			Code: ExitUnknown,
+			Err:  fmt.Errorf("no idea what you want: '%s', try help", args[0]),
+		}
+	}
+	if !a.mayRun(ctx, cmd.Name()) {
+		a.logger.Warnf("permission denied for %s: %s", sessionUser(ctx), cmd.Name())
+		return &ExitError{
+			Code: ExitDenied,
+			Err:  fmt.Errorf("permission denied: you may not run %s", cmd.Name()),
+		}
+	}
+	run, err := cmd.Parse(args[1:])
+	if err != nil {
+		return &ExitError{
+			Code: ExitUsage,
+			Err:  fmt.Errorf("%s\nusage: %s", err, cmd.Usage()),
+		}
+	}
+	return run(ctx, w)
+}
+
+// firstLine returns the first line of s.
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// usageWidth is the width of the usage column in the command list.
+const usageWidth = 28
+
+type helpCommand struct{ app *Server }
+
+func (helpCommand) Name() string  { return "help" }
+func (helpCommand) Usage() string { return "help [command]" }
+func (helpCommand) Help() string {
+	return "Lists the commands, or shows the help for a single command."
+}
+
+func (c helpCommand) Parse(args []string) (Runner, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("help takes at most one argument")
+	}
+	if len(args) == 1 {
+		cmd, ok := c.app.commands.get(args[0])
+		if !ok {
+			return nil, fmt.Errorf("no such command: %s", args[0])
+		}
+		return func(_ context.Context, w io.Writer) error {
+			_, err := fmt.Fprintf(w, "usage: %s\n\n%s\n", cmd.Usage(), cmd.Help())
+			return err
+		}, nil
+	}
+	return func(ctx context.Context, w io.Writer) error {
+		sb := strings.Builder{}
+		sb.WriteString("commands available:\n")
+		for _, cmd := range c.app.commands.list() {
+			if !c.app.mayRun(ctx, cmd.Name()) {
+				continue
+			}
+			usage := cmd.Usage()
+			if len(usage) > usageWidth {
+				fmt.Fprintf(&sb, "  %s\n  %-*s %s\n", usage, usageWidth, "", firstLine(cmd.Help()))
+			} else {
+				fmt.Fprintf(&sb, "  %-*s %s\n", usageWidth, usage, firstLine(cmd.Help()))
+			}
+		}
+		sb.WriteString("  quit\n")
+		_, err := io.WriteString(w, sb.String())
+		return err
+	}, nil
+}
+
+type chonkCommand struct{}
+
+func (chonkCommand) Name() string  { return "chonk" }
+func (chonkCommand) Usage() string { return "chonk <n>" }
+func (chonkCommand) Help() string  { return "Writes n bytes of output, for testing the tunnel." }
+
+func (chonkCommand) Parse(args []string) (Runner, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("chonk requires a size argument")
+	}
+	size, err := strconv.Atoi(args[0])
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("chonk: bad size '%s'", args[0])
+	}
+	return func(ctx context.Context, w io.Writer) error {
+		return handleChonker(ctx, w, size)
+	}, nil
+}
+
+type echoCommand struct{}
+
+func (echoCommand) Name() string  { return "echo" }
+func (echoCommand) Usage() string { return "echo <string>" }
+func (echoCommand) Help() string  { return "Writes the arguments back." }
+
+func (echoCommand) Parse(args []string) (Runner, error) {
+	return func(_ context.Context, w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%s\n", strings.Join(args, " "))
+		return err
+	}, nil
+}
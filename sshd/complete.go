@@ -0,0 +1,119 @@
+package sshd
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+const keyTab = '\t'
+
+// Completer can be implemented by a Command to have its arguments tab completed.
+type Completer interface {
+	// Complete returns the candidates for the last element of args, which is
+	// the word being typed and may be empty.
+	Complete(args []string) []string
+}
+
+// complete is the terminal's AutoCompleteCallback, bound to the session's context.
+// On tab it completes the word before the cursor, as far as the candidates agree.
+func (a *Server) complete(ctx context.Context, line string, pos int, key rune) (string, int, bool) {
+	if key != keyTab {
+		return "", 0, false
+	}
+	before, after := line[:pos], line[pos:]
+	words := strings.Fields(before)
+	if len(words) == 0 || strings.HasSuffix(before, " ") {
+		words = append(words, "")
+	}
+	word := words[len(words)-1]
+
+	var candidates []string
+	if len(words) == 1 {
+		for _, name := range a.commandNames() {
+			if a.mayRun(ctx, name) {
+				candidates = append(candidates, name)
+			}
+		}
+		candidates = append(candidates, "quit")
+	} else if cmd, ok := a.commands.get(words[0]); ok && a.mayRun(ctx, words[0]) {
+		if c, ok := cmd.(Completer); ok {
+			candidates = c.Complete(words[1:])
+		}
+	}
+	matches := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		// Swallow the tab, there is nothing to complete.
+		return line, pos, true
+	}
+	completed := commonPrefix(matches)
+	if len(matches) == 1 {
+		completed += " "
+	}
+	newBefore := before[:len(before)-len(word)] + completed
+	return newBefore + after, len(newBefore), true
+}
+
+// commandNames returns the names of the registered commands, sorted.
+func (a *Server) commandNames() []string {
+	cmds := a.commands.list()
+	names := make([]string, 0, len(cmds)+1)
+	for _, c := range cmds {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+// forwardPorts returns the local ports that are forwarded through the tunnel, as strings.
+func (a *Server) forwardPorts() []string {
+	if a.monitor == nil {
+		return nil
+	}
+	ports := a.monitor.Ports()
+	res := make([]string, len(ports))
+	for i, p := range ports {
+		res[i] = strconv.Itoa(p)
+	}
+	return res
+}
+
+func commonPrefix(ss []string) string {
+	prefix := ss[0]
+	for _, s := range ss[1:] {
+		for !strings.HasPrefix(s, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+func (c helpCommand) Complete(args []string) []string {
+	if len(args) > 1 {
+		return nil
+	}
+	return c.app.commandNames()
+}
+
+func (c captureCommand) Complete(args []string) []string {
+	switch len(args) {
+	case 1:
+		return []string{"list", "start", "stop"}
+	case 2:
+		if args[0] == "start" || args[0] == "stop" {
+			return c.app.forwardPorts()
+		}
+	}
+	return nil
+}
+
+func (c limitCommand) Complete(args []string) []string {
+	if len(args) == 1 {
+		return append([]string{"tunnel"}, c.app.forwardPorts()...)
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+package sshd
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/perbu/sshpod/audit"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// watchInterval is how often connections are checked against the timeouts.
+	watchInterval = time.Second
+	tellTimeout   = 2 * time.Second
+)
+
+// Limits bound how long connections last and how many there may be. Zero turns a
+// limit off. Pods connected to a bastion are exempt from all but MaxConns and
+// MaxConnsPerSource; their tunnels are meant to stay up.
+type Limits struct {
+	// IdleTimeout disconnects a client that has sent nothing for this long.
+	IdleTimeout time.Duration
+	// MaxSession disconnects a client this long after it connected, busy or not.
+	MaxSession time.Duration
+	// Warning is how long before either timeout the sessions are told about it.
+	Warning time.Duration
+
+	MaxConns        int
+	MaxConnsPerUser int
+	// MaxConnsPerSource leaves out loopback, where logins through a bastion's
+	// tunnel come from; they would all share one limit.
+	MaxConnsPerSource int
+}
+
+// connCounts keeps track of the open connections.
+type connCounts struct {
+	mu       sync.Mutex
+	total    int
+	bySource map[string]int
+	byUser   map[string]int
+	// unauthenticated is the number of connections that haven't logged in yet.
+	unauthenticated int
+}
+
+// connState is what we know about a connection while it is open. The watchers
+// keep to this rather than the ssh.Context, which the connection changes as it goes.
+type connState struct {
+	conn    *watchedConn
+	source  string
+	started time.Time
+
+	mu       sync.Mutex
+	sessions map[ssh.Session]bool
+	loggedIn bool
+	user     string
+	cert     *gossh.Certificate
+	pod      bool
+	// rejected counts the keys that failed to log in.
+	rejected     int
+	graceExpired bool
+	announced    bool
+	// kexAlgorithm is the signature algorithm of the handshake, if an RSA host key made it.
+	kexAlgorithm string
+	// pending holds what the key handler decided on the keys the client offered,
+	// by fingerprint, until one of them logs in.
+	pending map[string]authDecision
+}
+
+// ctxKeyConnState holds the connState of the connection.
+var ctxKeyConnState = &contextKey{"connState"}
+
+// SetLimits sets the timeouts and connection limits.
+func (app *Server) SetLimits(l Limits) error {
+	if l.IdleTimeout < 0 || l.MaxSession < 0 || l.Warning < 0 {
+		return fmt.Errorf("timeouts can't be negative")
+	}
+	if l.MaxConns < 0 || l.MaxConnsPerUser < 0 || l.MaxConnsPerSource < 0 {
+		return fmt.Errorf("connection limits can't be negative")
+	}
+	app.limits = l
+	app.logger.Infof("idle timeout %s, max session %s, warning %s; at most %d connections, %d per user, %d per source (0 is no limit)",
+		l.IdleTimeout, l.MaxSession, l.Warning, l.MaxConns, l.MaxConnsPerUser, l.MaxConnsPerSource)
+	return nil
+}
+
+// watchedConn remembers when the client last sent something.
+type watchedConn struct {
+	net.Conn
+	lastRead int64 // unix nanoseconds
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *watchedConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+}
+
+// sourceOf returns the host part of the address, which is what the per source limit counts.
+func sourceOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// isLoopback tells if the source is this host.
+func isLoopback(source string) bool {
+	ip := net.ParseIP(source)
+	return ip != nil && ip.IsLoopback()
+}
+
+// connCallback turns away banned addresses and connections over the limits, and
+// watches the rest for the timeouts.
+func (a *Server) connCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	source := sourceOf(conn.RemoteAddr())
+	if ban, ok := a.bans.banned(source); ok {
+		a.logger.Debugf("turning away connection from %s: banned until %s", conn.RemoteAddr(), ban.Until.Format(time.RFC3339))
+		return nil
+	}
+	c := &a.conns
+	c.mu.Lock()
+	reason := ""
+	switch {
+	case a.limits.MaxConns > 0 && c.total >= a.limits.MaxConns:
+		reason = fmt.Sprintf("already %d connections", c.total)
+	case a.limits.MaxConnsPerSource > 0 && !isLoopback(source) && c.bySource[source] >= a.limits.MaxConnsPerSource:
+		reason = fmt.Sprintf("already %d connections from %s", c.bySource[source], source)
+	case a.bans.maxUnauthenticated > 0 && c.unauthenticated >= a.bans.maxUnauthenticated:
+		reason = fmt.Sprintf("already %d connections logging in", c.unauthenticated)
+	default:
+		c.total++
+		c.bySource[source]++
+		c.unauthenticated++
+	}
+	c.mu.Unlock()
+	if reason != "" {
+		a.logger.Warnf("turning away connection from %s: %s", conn.RemoteAddr(), reason)
+		a.writeAudit(audit.Record{
+			Event:   "connection",
+			Remote:  conn.RemoteAddr().String(),
+			Fields:  audit.Fields{"result": "limited"},
+			Message: reason,
+		})
+		return nil
+	}
+	wc := &watchedConn{Conn: conn, lastRead: time.Now().UnixNano()}
+	st := &connState{conn: wc, source: source, started: time.Now(), sessions: make(map[ssh.Session]bool),
+		pending: make(map[string]authDecision)}
+	ctx.SetValue(ctxKeyConnState, st)
+	go func() {
+		<-ctx.Done()
+		st.mu.Lock()
+		loggedIn, rejected, graceExpired := st.loggedIn, st.rejected, st.graceExpired
+		st.mu.Unlock()
+		c.mu.Lock()
+		c.total--
+		if c.bySource[source]--; c.bySource[source] <= 0 {
+			delete(c.bySource, source)
+		}
+		if !loggedIn {
+			c.unauthenticated--
+		}
+		c.mu.Unlock()
+		switch {
+		case loggedIn:
+		case rejected > 0:
+			a.loginFailed(source, fmt.Sprintf("%d failed attempts to log in", rejected))
+		case graceExpired:
+			a.loginFailed(source, "did not log in in time")
+		}
+	}()
+	if a.bans.loginGrace > 0 {
+		go a.watchLogin(ctx, st)
+	}
+	if a.limits.IdleTimeout > 0 || a.limits.MaxSession > 0 {
+		go a.watchConn(ctx, st)
+	}
+	return wc
+}
+
+// serverConfig hooks into the authentication of the connection to learn when the
+// client has logged in for real. The key handler can't tell, it is also asked
+// about keys the client only offers. A connection that can't be bound to what
+// was decided on its key, or that has no room left for its user, is closed.
+// Host certificates are added here, as they change when keys are retired.
+func (a *Server) serverConfig(ctx ssh.Context) *gossh.ServerConfig {
+	st, _ := ctx.Value(ctxKeyConnState).(*connState)
+	config := &gossh.ServerConfig{
+		AuthLogCallback: func(conn gossh.ConnMetadata, method string, err error) {
+			if st == nil || method == "none" {
+				return
+			}
+			if err != nil {
+				st.mu.Lock()
+				st.rejected++
+				st.mu.Unlock()
+				return
+			}
+			if !a.bindAuth(ctx, st) {
+				a.logger.Errorf("closing connection from %s: no decision on the key it logged in with", st.conn.RemoteAddr())
+				_ = st.conn.Close()
+				return
+			}
+			if !a.countUser(ctx) {
+				_ = st.conn.Close()
+				return
+			}
+			cert, _ := ctx.Value(ctxKeyCert).(*gossh.Certificate)
+			_, isPod := a.podCert(ctx)
+			kexAlgorithm := ""
+			if a.hostKeys != nil {
+				kexAlgorithm = a.hostKeys.takeKexAlgorithm(conn.SessionID())
+			}
+			st.mu.Lock()
+			st.loggedIn, st.user, st.cert, st.pod = true, sessionUser(ctx), cert, isPod
+			st.kexAlgorithm = kexAlgorithm
+			st.mu.Unlock()
+			a.conns.mu.Lock()
+			a.conns.unauthenticated--
+			a.conns.mu.Unlock()
+		},
+	}
+	if a.hostKeys != nil {
+		for _, s := range a.hostKeys.certSigners() {
+			config.AddHostKey(s)
+		}
+	}
+	return config
+}
+
+// roomForUser tells if the user may have another connection with the key decided on.
+func (a *Server) roomForUser(ctx ssh.Context, decision authDecision) bool {
+	if a.limits.MaxConnsPerUser == 0 || a.isPodCert(decision.cert) {
+		return true
+	}
+	c := &a.conns
+	c.mu.Lock()
+	n := c.byUser[ctx.User()]
+	c.mu.Unlock()
+	if n >= a.limits.MaxConnsPerUser {
+		a.logger.Warnf("turning away %s from %s: already %d connections", ctx.User(), ctx.RemoteAddr(), n)
+		a.auditFields(ctx, "connection", audit.Fields{"result": "limited"}, "already %d connections for %s", n, ctx.User())
+		return false
+	}
+	return true
+}
+
+// countUser counts the connection that has logged in towards the limit of its
+// user, and tells if there was room for it.
+func (a *Server) countUser(ctx ssh.Context) bool {
+	if a.limits.MaxConnsPerUser == 0 {
+		return true
+	}
+	if _, isPod := a.podCert(ctx); isPod {
+		return true
+	}
+	user := ctx.User()
+	c := &a.conns
+	c.mu.Lock()
+	n := c.byUser[user]
+	if n < a.limits.MaxConnsPerUser {
+		c.byUser[user]++
+	}
+	c.mu.Unlock()
+	if n >= a.limits.MaxConnsPerUser {
+		a.logger.Warnf("turning away %s: already %d connections", who(ctx), n)
+		a.auditFields(ctx, "connection", audit.Fields{"result": "limited"}, "already %d connections for %s", n, user)
+		return false
+	}
+	go func() {
+		<-ctx.Done()
+		c.mu.Lock()
+		if c.byUser[user]--; c.byUser[user] <= 0 {
+			delete(c.byUser, user)
+		}
+		c.mu.Unlock()
+	}()
+	return true
+}
+
+// trackSession lets the session hear about the timeouts of its connection. The
+// function it returns stops that.
+func (a *Server) trackSession(s ssh.Session) func() {
+	st, ok := s.Context().Value(ctxKeyConnState).(*connState)
+	if !ok {
+		return func() {}
+	}
+	st.mu.Lock()
+	st.sessions[s] = true
+	st.mu.Unlock()
+	return func() {
+		st.mu.Lock()
+		delete(st.sessions, s)
+		st.mu.Unlock()
+	}
+}
+
+// tell writes a notice to the sessions of the connection. A client that doesn't
+// read gets tellTimeout to take it.
+func (st *connState) tell(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	st.mu.Lock()
+	wg := sync.WaitGroup{}
+	for s := range st.sessions {
+		wg.Add(1)
+		go func(s ssh.Session) {
+			defer wg.Done()
+			if _, _, isPty := s.Pty(); isPty {
+				_, _ = fmt.Fprintf(s.Stderr(), "\r\n*** %s ***\r\n", msg)
+			} else {
+				_, _ = fmt.Fprintf(s.Stderr(), "*** %s ***\n", msg)
+			}
+		}(s)
+	}
+	st.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(tellTimeout):
+	}
+}
+
+// watchLogin disconnects the connection if it hasn't logged in within the grace time.
+func (a *Server) watchLogin(ctx ssh.Context, st *connState) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(a.bans.loginGrace):
+	}
+	st.mu.Lock()
+	expired := !st.loggedIn
+	st.graceExpired = expired
+	st.mu.Unlock()
+	if expired {
+		a.disconnect(st, "login-grace", fmt.Sprintf("did not log in within %s", a.bans.loginGrace))
+	}
+}
+
+// watchConn disconnects the connection when it has been idle or open for too long,
+// warning its sessions first.
+func (a *Server) watchConn(ctx ssh.Context, st *connState) {
+	l := a.limits
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	idleWarned, maxWarned := false, false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		st.mu.Lock()
+		isPod := st.pod
+		st.mu.Unlock()
+		if isPod {
+			return
+		}
+		if l.MaxSession > 0 {
+			left := l.MaxSession - time.Since(st.started)
+			if left <= 0 {
+				a.disconnect(st, "max-session", fmt.Sprintf("connected for %s, the most allowed", l.MaxSession))
+				return
+			}
+			if left <= l.Warning && !maxWarned {
+				maxWarned = true
+				st.tell("This connection reaches its time limit of %s, it closes in %s", l.MaxSession, left.Round(time.Second))
+			}
+		}
+		if l.IdleTimeout > 0 {
+			left := l.IdleTimeout - st.conn.idle()
+			if left <= 0 {
+				a.disconnect(st, "idle", fmt.Sprintf("idle for %s", l.IdleTimeout))
+				return
+			}
+			if left > l.Warning {
+				idleWarned = false
+			} else if !idleWarned {
+				idleWarned = true
+				st.tell("Idle for %s, disconnecting in %s unless there is activity", st.conn.idle().Round(time.Second), left.Round(time.Second))
+			}
+		}
+	}
+}
+
+// disconnect closes the connection because of a timeout.
+func (a *Server) disconnect(st *connState, timeout, reason string) {
+	st.tell("Disconnecting: %s", reason)
+	st.mu.Lock()
+	user, cert := st.user, st.cert
+	st.mu.Unlock()
+	fields := audit.Fields{"timeout": timeout, "seconds": strconv.FormatFloat(time.Since(st.started).Seconds(), 'f', 0, 64)}
+	if cert != nil {
+		fields["keyId"] = cert.KeyId
+		fields["serial"] = strconv.FormatUint(cert.Serial, 10)
+	}
+	a.logger.Infof("disconnecting %s from %s: %s", user, st.conn.RemoteAddr(), reason)
+	a.writeAudit(audit.Record{Event: "timeout", User: user, Remote: st.conn.RemoteAddr().String(),
+		Fields: fields, Message: "disconnected: " + reason})
+	_ = st.conn.Close()
+}
@@ -0,0 +1,96 @@
+package sshd
+
+import (
+	"context"
+	log "github.com/celerway/chainsaw"
+	"net"
+	"testing"
+)
+
+// addrConn is a connection from a given address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"192.0.2.1", false},
+		{"::", false},
+		{"localhost", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			if got := isLoopback(tt.source); got != tt.want {
+				t.Errorf("isLoopback(%q) = %v, want %v", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnCallbackLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		// sources are where the connections come from, in order; open tells which get in.
+		sources []string
+		open    []bool
+	}{
+		{
+			name:    "per source",
+			limits:  Limits{MaxConnsPerSource: 2},
+			sources: []string{"192.0.2.1", "192.0.2.1", "192.0.2.1", "192.0.2.2"},
+			open:    []bool{true, true, false, true},
+		},
+		{
+			name:    "loopback is left out",
+			limits:  Limits{MaxConnsPerSource: 1},
+			sources: []string{"127.0.0.1", "127.0.0.1", "::1", "::1", "192.0.2.1", "192.0.2.1"},
+			open:    []bool{true, true, true, true, true, false},
+		},
+		{
+			name:    "loopback still counts in total",
+			limits:  Limits{MaxConns: 2, MaxConnsPerSource: 1},
+			sources: []string{"127.0.0.1", "127.0.0.1", "127.0.0.1"},
+			open:    []bool{true, true, false},
+		},
+		{
+			name:    "no limits",
+			sources: []string{"192.0.2.1", "192.0.2.1", "192.0.2.1"},
+			open:    []bool{true, true, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Server{
+				logger: log.MakeLogger("test"),
+				limits: tt.limits,
+				conns:  connCounts{bySource: make(map[string]int), byUser: make(map[string]int)},
+				bans:   newBanList(),
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			for i, source := range tt.sources {
+				c, peer := net.Pipe()
+				defer c.Close()
+				defer peer.Close()
+				sctx := newTestContext("alice")
+				sctx.Context = ctx
+				conn := addrConn{Conn: c, remote: &net.TCPAddr{IP: net.ParseIP(source), Port: 1000 + i}}
+				if got := a.connCallback(sctx, conn) != nil; got != tt.open[i] {
+					t.Errorf("connection %d from %s let in = %v, want %v", i, source, got, tt.open[i])
+				}
+			}
+		})
+	}
+}
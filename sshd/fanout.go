@@ -0,0 +1,329 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fanoutParallel = 10
+	fanoutTimeout  = 30 * time.Second
+	// fanoutOutputLimit caps the output kept from each pod.
+	fanoutOutputLimit = 64 * 1024
+)
+
+// Results of running a command on a pod.
+const (
+	FanoutOK          = "ok"
+	FanoutFailed      = "failed"
+	FanoutTimeout     = "timeout"
+	FanoutUnreachable = "unreachable"
+)
+
+// FanoutResult is what came of running a command on one pod.
+type FanoutResult struct {
+	RouterId int     `json:"routerId"`
+	KeyId    string  `json:"keyId"`
+	Result   string  `json:"result"`
+	ExitCode int     `json:"exitCode"`
+	Seconds  float64 `json:"seconds"`
+	Output   string  `json:"output"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// podSelector picks pods by router id and label. Ids and ranges add to the
+// selection, labels narrow it.
+type podSelector struct {
+	ids    map[int]bool
+	ranges [][2]int
+	labels map[string]string
+}
+
+// parsePodSelector parses "all", or a comma separated list of router ids, ranges
+// like 40-49 and labels like site=oslo.
+func parsePodSelector(s string) (podSelector, error) {
+	sel := podSelector{ids: make(map[int]bool), labels: make(map[string]string)}
+	if s == "all" {
+		return sel, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if k, v, ok := strings.Cut(item, "="); ok {
+			sel.labels[k] = v
+			continue
+		}
+		lo, hi, isRange := strings.Cut(item, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return sel, fmt.Errorf("bad pod selection '%s'", item)
+		}
+		if !isRange {
+			sel.ids[first] = true
+			continue
+		}
+		last, err := strconv.Atoi(hi)
+		if err != nil || last < first {
+			return sel, fmt.Errorf("bad pod range '%s'", item)
+		}
+		sel.ranges = append(sel.ranges, [2]int{first, last})
+	}
+	return sel, nil
+}
+
+func (sel podSelector) matches(p PodInfo) bool {
+	if len(sel.ids) > 0 || len(sel.ranges) > 0 {
+		found := sel.ids[p.RouterId]
+		for _, r := range sel.ranges {
+			found = found || (p.RouterId >= r[0] && p.RouterId <= r[1])
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range sel.labels {
+		if got, ok := p.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Fanout runs the command on the selected pods, at most parallel at a time, giving
+// each timeout to finish. Results come ordered by router id.
+func (app *Server) Fanout(ctx context.Context, pods []PodInfo, command string, parallel int, timeout time.Duration) []FanoutResult {
+	results := make([]FanoutResult, len(pods))
+	sem := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for i, p := range pods {
+		wg.Add(1)
+		go func(i int, p PodInfo) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = FanoutResult{RouterId: p.RouterId, KeyId: p.KeyId, Result: FanoutFailed, ExitCode: -1, Error: ctx.Err().Error()}
+				return
+			}
+			results[i] = app.runOnPod(ctx, p, command, timeout)
+		}(i, p)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].RouterId < results[j].RouterId })
+	return results
+}
+
+// runOnPod runs the command on one pod and collects its output.
+func (a *Server) runOnPod(ctx context.Context, p PodInfo, command string, timeout time.Duration) (res FanoutResult) {
+	started := time.Now()
+	res = FanoutResult{RouterId: p.RouterId, KeyId: p.KeyId, ExitCode: -1}
+	defer func() { res.Seconds = time.Since(started).Round(time.Millisecond).Seconds() }()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, _, _, err := a.dialPod(ctx, p.RouterId)
+	if err != nil {
+		res.Result, res.Error = FanoutUnreachable, err.Error()
+		return res
+	}
+	defer client.Close()
+	go func() {
+		<-ctx.Done()
+		_ = client.Close()
+	}()
+	sess, err := client.NewSession()
+	if err != nil {
+		res.Result, res.Error = FanoutUnreachable, err.Error()
+		return res
+	}
+	out := &limitedBuffer{limit: fanoutOutputLimit}
+	sess.Stdout = out
+	sess.Stderr = out
+	err = sess.Run(command)
+	res.Output = out.String()
+	var exitErr *gossh.ExitError
+	switch {
+	case err == nil:
+		res.Result, res.ExitCode = FanoutOK, ExitOK
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		res.Result, res.Error = FanoutTimeout, fmt.Sprintf("no answer in %s", timeout)
+	case errors.As(err, &exitErr):
+		res.Result, res.ExitCode = FanoutFailed, exitErr.ExitStatus()
+	default:
+		res.Result, res.Error = FanoutFailed, err.Error()
+	}
+	return res
+}
+
+// shellQuote joins the arguments into a command line that splits back into the
+// same arguments, quoting those that need it the way a POSIX shell would.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, shellSafe) == "" {
+			quoted[i] = arg
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellSafe are the characters that need no quoting.
+const shellSafe = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-"
+
+// limitedBuffer keeps the first limit bytes written to it and drops the rest.
+type limitedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.buf.Write(p[:room])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]\n"
+	}
+	return b.buf.String()
+}
+
+type fanoutCommand struct{ app *Server }
+
+func (fanoutCommand) Name() string { return "fanout" }
+func (fanoutCommand) Usage() string {
+	return "fanout [-p n] [-t timeout] [-json] <pods> <command> [args]"
+}
+func (fanoutCommand) Help() string {
+	return "Runs a command on many pods at once and reports how it went.\n" +
+		"Pods are all, or a comma separated list of router ids, ranges like 40-49\n" +
+		"and labels like site=oslo. -p sets how many run at a time (default 10),\n" +
+		"-t how long each may take (default 30s), -json gives the full output as JSON.\n" +
+		"Exits with 1 unless the command succeeded everywhere."
+}
+
+func (c fanoutCommand) Parse(args []string) (Runner, error) {
+	fs := flag.NewFlagSet("fanout", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	parallel := fs.Int("p", fanoutParallel, "")
+	timeout := fs.Duration("t", fanoutTimeout, "")
+	asJSON := fs.Bool("json", false, "")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() < 2 {
+		return nil, fmt.Errorf("fanout needs pods and a command")
+	}
+	if *parallel < 1 || *timeout <= 0 {
+		return nil, fmt.Errorf("fanout: -p and -t must be positive")
+	}
+	sel, err := parsePodSelector(fs.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	command := fs.Args()[1:]
+	return func(ctx context.Context, w io.Writer) error {
+		return c.app.handleFanout(ctx, w, sel, command, *parallel, *timeout, *asJSON)
+	}, nil
+}
+
+// handleFanout runs a command on the selected pods and writes a report.
+func (a *Server) handleFanout(ctx context.Context, w io.Writer, sel podSelector, command []string, parallel int, timeout time.Duration, asJSON bool) error {
+	if a.bastion == nil {
+		return fmt.Errorf("this is not a bastion")
+	}
+	// The pods log the user in with a certificate of their own and check again.
+	if !a.mayRoute(ctx) {
+		return &ExitError{Code: ExitDenied, Err: fmt.Errorf("permission denied: you may not go on to pods")}
+	}
+	if !a.mayRun(ctx, command[0]) {
+		return &ExitError{Code: ExitDenied, Err: fmt.Errorf("permission denied: you may not run %s", command[0])}
+	}
+	var pods []PodInfo
+	connected := make(map[int]bool)
+	for _, p := range a.Pods() {
+		if sel.matches(p) {
+			pods = append(pods, p)
+			connected[p.RouterId] = true
+		}
+	}
+	// Pods asked for by id that aren't there are reported, not left out.
+	var missing []FanoutResult
+	for id := range sel.ids {
+		if !connected[id] {
+			missing = append(missing, FanoutResult{RouterId: id, Result: FanoutUnreachable, ExitCode: -1,
+				Error: fmt.Sprintf("router %d is not connected", id)})
+		}
+	}
+	if len(pods) == 0 && len(missing) == 0 {
+		return fmt.Errorf("no connected pods match")
+	}
+	line := shellQuote(command)
+	a.logger.Infof("fanout for %s: '%s' on %d pods", sessionUser(ctx), line, len(pods))
+	results := append(a.Fanout(ctx, pods, line, parallel, timeout), missing...)
+	sort.Slice(results, func(i, j int) bool { return results[i].RouterId < results[j].RouterId })
+
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.Result]++
+	}
+	summary := fmt.Sprintf("%d pods: %d ok, %d failed, %d timed out, %d unreachable",
+		len(results), counts[FanoutOK], counts[FanoutFailed], counts[FanoutTimeout], counts[FanoutUnreachable])
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(struct {
+			Command string         `json:"command"`
+			Summary map[string]int `json:"summary"`
+			Results []FanoutResult `json:"results"`
+		}{line, counts, results})
+		if err != nil {
+			return err
+		}
+	} else {
+		sb := strings.Builder{}
+		fmt.Fprintf(&sb, "%-8s %-12s %-4s %8s  %s\n", "ROUTER", "RESULT", "EXIT", "SECONDS", "OUTPUT")
+		for _, r := range results {
+			out := strings.TrimSpace(r.Output)
+			if r.Error != "" {
+				out = r.Error
+			}
+			if n := strings.Count(out, "\n"); n > 0 {
+				out = fmt.Sprintf("%s [+%d lines]", firstLine(out), n)
+			}
+			fmt.Fprintf(&sb, "%-8d %-12s %-4d %8.2f  %s\n", r.RouterId, r.Result, r.ExitCode, r.Seconds, out)
+		}
+		sb.WriteString(summary + "\n")
+		if _, err := io.WriteString(w, sb.String()); err != nil {
+			return err
+		}
+	}
+	a.logger.Infof("fanout for %s: '%s': %s", sessionUser(ctx), line, summary)
+	if failed := len(results) - counts[FanoutOK]; failed > 0 {
+		return &ExitError{Code: ExitFailure, Err: fmt.Errorf("%d of %d pods did not succeed", failed, len(results))}
+	}
+	return nil
+}
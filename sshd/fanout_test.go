@@ -0,0 +1,30 @@
+package sshd
+
+import "testing"
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "plain", args: []string{"uptime"}, want: "uptime"},
+		{name: "safe characters", args: []string{"ls", "-la", "/var/log/", "a=b,c:d@e%f+g"}, want: "ls -la /var/log/ a=b,c:d@e%f+g"},
+		{name: "space", args: []string{"echo", "two words"}, want: "echo 'two words'"},
+		{name: "empty", args: []string{"printf", ""}, want: "printf ''"},
+		{name: "quote", args: []string{"echo", "it's"}, want: `echo 'it'\''s'`},
+		{name: "only a quote", args: []string{"'"}, want: `''\'''`},
+		{name: "expansions", args: []string{"echo", "$HOME", "`id`", "*"}, want: "echo '$HOME' '`id`' '*'"},
+		{name: "separators", args: []string{"true;", "rm", "-rf", "/", "&&", "|"}, want: "'true;' rm -rf / '&&' '|'"},
+		{name: "newline", args: []string{"echo", "a\nb"}, want: "echo 'a\nb'"},
+		{name: "backslash", args: []string{`a\b`}, want: `'a\b'`},
+		{name: "no arguments", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shellQuote(tt.args); got != tt.want {
+				t.Errorf("shellQuote(%q) = %s, want %s", tt.args, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Access is what a principal may do with the file transfer directory.
+type Access int
+
+const (
+	AccessNone Access = iota
+	AccessRead
+	AccessReadWrite
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessRead:
+		return "ro"
+	case AccessReadWrite:
+		return "rw"
+	default:
+		return "none"
+	}
+}
+
+var errPermission = errors.New("permission denied")
+
+// FileTransfer configures file transfer (SFTP and SCP) to and from the pod.
+type FileTransfer struct {
+	// Root is the directory clients see as /. Empty disables file transfer.
+	Root string
+	// ReadOnly turns off all writes, whatever Access says.
+	ReadOnly bool
+	// Access maps principals to what they may do. If empty, everyone gets read-write.
+	// Principals are those of the user's certificate, or of principals= for plain keys.
+	Access map[string]Access
+}
+
+// ParseAccess parses a comma separated list of principal=ro or principal=rw.
+func ParseAccess(s string) (map[string]Access, error) {
+	res := make(map[string]Access)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("bad access entry '%s', want principal=ro|rw", item)
+		}
+		switch kv[1] {
+		case "ro":
+			res[kv[0]] = AccessRead
+		case "rw":
+			res[kv[0]] = AccessReadWrite
+		default:
+			return nil, fmt.Errorf("bad access level '%s' for %s, want ro or rw", kv[1], kv[0])
+		}
+	}
+	return res, nil
+}
+
+// SetFileTransfer enables file transfer rooted at cfg.Root.
+func (app *Server) SetFileTransfer(cfg FileTransfer) error {
+	if cfg.Root == "" {
+		app.fileTransfer = nil
+		return nil
+	}
+	root, err := filepath.Abs(cfg.Root)
+	if err != nil {
+		return fmt.Errorf("file transfer root: %w", err)
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return fmt.Errorf("file transfer root: %w", err)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return fmt.Errorf("file transfer root: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("file transfer root %s is not a directory", root)
+	}
+	cfg.Root = root
+	app.fileTransfer = &cfg
+	app.logger.Infof("file transfer enabled in %s (read-only: %v)", root, cfg.ReadOnly)
+	return nil
+}
+
+// fileAccess returns what the session's user may do with the file transfer directory.
+func (a *Server) fileAccess(ctx ssh.Context) Access {
+	ft := a.fileTransfer
+	if ft == nil {
+		return AccessNone
+	}
+	access := AccessReadWrite
+	if len(ft.Access) > 0 {
+		access = AccessNone
+		for _, p := range principals(ctx) {
+			if l := ft.Access[p]; l > access {
+				access = l
+			}
+		}
+	}
+	if ft.ReadOnly && access > AccessRead {
+		access = AccessRead
+	}
+	// The roles of the user may take away more.
+	if access > AccessRead && !a.may(ctx, CapFileWrite) {
+		access = AccessRead
+	}
+	if access > AccessNone && !a.may(ctx, CapFileRead) && !a.may(ctx, CapFileWrite) {
+		access = AccessNone
+	}
+	return access
+}
+
+// principals returns the certificate principals of the session's user, or those
+// given to a plain key with principals= in authorized_keys. Never the login name,
+// which anyone with a key may pick.
+func principals(ctx context.Context) []string {
+	if cert, ok := ctx.Value(ctxKeyCert).(*gossh.Certificate); ok {
+		return cert.ValidPrincipals
+	}
+	if o, ok := ctx.Value(ctxKeyOptions).(*keyOptions); ok {
+		return o.principals
+	}
+	return nil
+}
+
+// sandbox maps client paths onto a root directory.
+type sandbox struct {
+	root string
+}
+
+// resolve turns a client path into a path on disk. Clients see the root as /, so
+// ".." can't take them above it. Symlinks are followed and must lead inside the
+// root; a link that leads nowhere is refused, as writing through it would create
+// a file wherever it points.
+func (sb sandbox) resolve(p string) (string, error) {
+	full, err := sb.resolveLink(p)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(full)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return full, nil
+	}
+	target, err := filepath.EvalSymlinks(full)
+	if err != nil || !sb.contains(target) {
+		return "", errPermission
+	}
+	return target, nil
+}
+
+// resolveLink is resolve for acting on a link itself: the directory the path is
+// in is resolved, the last element is left as it is.
+func (sb sandbox) resolveLink(p string) (string, error) {
+	clean := path.Clean("/" + p)
+	if clean == "/" {
+		return sb.root, nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(sb.root, filepath.FromSlash(path.Dir(clean))))
+	if err != nil {
+		// Keep where on disk it failed from the client.
+		var pe *os.PathError
+		if errors.As(err, &pe) {
+			return "", pe.Err
+		}
+		return "", err
+	}
+	if !sb.contains(dir) {
+		return "", errPermission
+	}
+	return filepath.Join(dir, path.Base(clean)), nil
+}
+
+// contains tells if the path on disk is the root or inside it.
+func (sb sandbox) contains(p string) bool {
+	return p == sb.root || strings.HasPrefix(p, sb.root+string(filepath.Separator))
+}
+
+// clientPath turns a path on disk back into what the client sees.
+func (sb sandbox) clientPath(p string) string {
+	rel, err := filepath.Rel(sb.root, p)
+	if err != nil {
+		return "/"
+	}
+	return path.Clean("/" + filepath.ToSlash(rel))
+}
@@ -0,0 +1,113 @@
+package sshd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testSandbox makes a root with a file, a directory and links in and out of it,
+// next to a directory outside the root.
+func testSandbox(t *testing.T) (sandbox, string) {
+	t.Helper()
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "dir"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "file"), filepath.Join(outside, "secret")} {
+		if err := os.WriteFile(f, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"in":        "file",
+		"dirlink":   "dir",
+		"out":       filepath.Join(outside, "secret"),
+		"outdir":    outside,
+		"dangling":  filepath.Join(outside, "new"),
+		"nowhere":   "missing",
+		"dir/up":    "../file",
+		"dir/upout": "../../outside/secret",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sandbox{root: root}, outside
+}
+
+func TestSandboxResolve(t *testing.T) {
+	sb, _ := testSandbox(t)
+	tests := []struct {
+		name     string
+		path     string
+		want     string
+		wantLink string
+		err      error
+		linkErr  error
+	}{
+		{name: "root", path: "/", want: "", wantLink: ""},
+		{name: "file", path: "/file", want: "file", wantLink: "file"},
+		{name: "relative", path: "dir/../file", want: "file", wantLink: "file"},
+		{name: "dot dot above root", path: "../../file", want: "file", wantLink: "file"},
+		{name: "new file", path: "/dir/new", want: "dir/new", wantLink: "dir/new"},
+		{name: "link inside", path: "/in", want: "file", wantLink: "in"},
+		{name: "link up inside", path: "/dir/up", want: "file", wantLink: "dir/up"},
+		{name: "through directory link", path: "/dirlink/new", want: "dir/new", wantLink: "dir/new"},
+		{name: "link outside", path: "/out", err: errPermission, wantLink: "out"},
+		{name: "link up outside", path: "/dir/upout", err: errPermission, wantLink: "dir/upout"},
+		{name: "dangling link outside", path: "/dangling", err: errPermission, wantLink: "dangling"},
+		{name: "dangling link inside", path: "/nowhere", err: errPermission, wantLink: "nowhere"},
+		{name: "through link outside", path: "/outdir/secret", err: errPermission, linkErr: errPermission},
+		{name: "create through link outside", path: "/outdir/new", err: errPermission, linkErr: errPermission},
+		{name: "missing directory", path: "/missing/new", err: os.ErrNotExist, linkErr: os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := func(what string, resolve func(string) (string, error), want string, wantErr error) {
+				got, err := resolve(tt.path)
+				if wantErr != nil {
+					if !errors.Is(err, wantErr) {
+						t.Errorf("%s(%q) = %q, %v, want error %v", what, tt.path, got, err, wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Errorf("%s(%q): unexpected error %v", what, tt.path, err)
+					return
+				}
+				if got != filepath.Join(sb.root, want) {
+					t.Errorf("%s(%q) = %q, want %q under the root", what, tt.path, got, want)
+				}
+			}
+			check("resolve", sb.resolve, tt.want, tt.err)
+			check("resolveLink", sb.resolveLink, tt.wantLink, tt.linkErr)
+		})
+	}
+}
+
+func TestSandboxRemoveLink(t *testing.T) {
+	sb, outside := testSandbox(t)
+	full, err := sb.resolveLink("/out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(full); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(sb.root, "out")); !os.IsNotExist(err) {
+		t.Errorf("the link is still there: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+		t.Errorf("removing the link touched where it led: %v", err)
+	}
+}
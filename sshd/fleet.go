@@ -0,0 +1,300 @@
+package sshd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	probeTimeout  = 2 * time.Second
+	probeAttempts = 4
+)
+
+// Services found behind pod forwards.
+const (
+	ServiceSSH  = "ssh"
+	ServiceHTTP = "http"
+)
+
+// FleetEntry is a pod the bastion knows about, connected or not.
+type FleetEntry struct {
+	PodInfo
+	Connected bool `json:"connected"`
+	// LastSeen is when the pod was last connected; now, if it is.
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// fleet is the directory of pods that have been connected, kept on disk so it
+// survives restarts of the bastion.
+type fleet struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*FleetEntry // by key id
+}
+
+// loadFleet reads the fleet directory from path. A missing file is an empty fleet.
+func loadFleet(path string) (*fleet, error) {
+	f := &fleet{path: path, entries: make(map[string]*FleetEntry)}
+	if path == "" {
+		return f, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading fleet: %w", err)
+	}
+	var entries []FleetEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing fleet %s: %w", path, err)
+	}
+	for i := range entries {
+		e := entries[i]
+		// Whoever was connected when we went down isn't anymore.
+		e.Connected = false
+		e.Connections = 0
+		e.Remote = nil
+		f.entries[e.KeyId] = &e
+	}
+	return f, nil
+}
+
+// update merges the live pods into the directory and writes it to disk.
+func (f *fleet) update(live []PodInfo) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now().UTC()
+	seen := make(map[string]bool)
+	for _, p := range live {
+		seen[p.KeyId] = true
+		f.entries[p.KeyId] = &FleetEntry{PodInfo: p, Connected: true, LastSeen: now}
+	}
+	for key, e := range f.entries {
+		if !seen[key] && e.Connected {
+			e.Connected = false
+			e.Connections = 0
+			e.Remote = nil
+			e.LastSeen = now
+		}
+	}
+	if f.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(f.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o700); err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// list returns the entries ordered by router id. Must be called with the lock held.
+func (f *fleet) list() []FleetEntry {
+	res := make([]FleetEntry, 0, len(f.entries))
+	for _, e := range f.entries {
+		res = append(res, *e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].RouterId != res[j].RouterId {
+			return res[i].RouterId < res[j].RouterId
+		}
+		return res[i].KeyId < res[j].KeyId
+	})
+	return res
+}
+
+// Fleet returns every pod the bastion knows about, connected or not, ordered by router id.
+func (app *Server) Fleet() []FleetEntry {
+	if app.fleet == nil {
+		return nil
+	}
+	app.fleet.mu.Lock()
+	defer app.fleet.mu.Unlock()
+	return app.fleet.list()
+}
+
+// fleetChanged records a change of the live pods in the fleet directory.
+func (a *Server) fleetChanged() {
+	if a.fleet == nil {
+		return
+	}
+	if err := a.fleet.update(a.Pods()); err != nil {
+		a.logger.Warnf("saving fleet: %s", err)
+	}
+}
+
+// podForward finds the bastion port where a connected pod has the service.
+func (a *Server) podForward(routerId int, service string) (PodInfo, int, bool) {
+	for _, p := range a.Pods() {
+		if p.RouterId != routerId {
+			continue
+		}
+		for _, f := range p.Forwards {
+			if f.Service == service {
+				return p, f.Port, true
+			}
+		}
+		return p, 0, false
+	}
+	return PodInfo{}, 0, false
+}
+
+// PodHTTPAddr returns the address on the bastion where the httpd of the pod is reachable.
+func (app *Server) PodHTTPAddr(routerId int) (string, error) {
+	pod, port, ok := app.podForward(routerId, ServiceHTTP)
+	if pod.KeyId == "" {
+		return "", fmt.Errorf("router %d is not connected", routerId)
+	}
+	if !ok {
+		return "", fmt.Errorf("router %d has no web tunnel", routerId)
+	}
+	return net.JoinHostPort(app.bastion.BindHost, strconv.Itoa(port)), nil
+}
+
+// probeForward finds out what the pod serves behind a forward: sshd greets first,
+// httpd answers a request. The answer is kept with the forward.
+func (a *Server) probeForward(pc *podConn, l *podListener, bindAddr string) {
+	service := ""
+	for _, try := range []func(io.ReadWriter) string{probeSSH, probeHTTP} {
+		service = a.probeWith(pc, bindAddr, l.port, try)
+		if service != "" {
+			break
+		}
+	}
+	if service == "" {
+		return
+	}
+	a.pods.mu.Lock()
+	l.service = service
+	a.pods.mu.Unlock()
+	a.logger.Infof("pod %s has %s on port %d", pc.keyId, service, l.port)
+	a.fleetChanged()
+}
+
+// probeWith opens a connection to the pod's forward and runs probe on it, giving up after probeTimeout.
+func (a *Server) probeWith(pc *podConn, bindAddr string, port int, probe func(io.ReadWriter) string) string {
+	payload := gossh.Marshal(&forwardedTCPIPData{
+		DestAddr:   bindAddr,
+		DestPort:   uint32(port),
+		OriginAddr: "127.0.0.1",
+		OriginPort: 1, // the pod's ssh client won't take port 0
+	})
+	// The pod only takes connections once it has the reply to its tcpip-forward,
+	// which may not have gone out yet.
+	var ch gossh.Channel
+	var reqs <-chan *gossh.Request
+	var err error
+	for try := 0; try < probeAttempts; try++ {
+		time.Sleep(probeTimeout / probeAttempts)
+		ch, reqs, err = pc.conn.OpenChannel("forwarded-tcpip", payload)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		a.logger.Debugf("probing port %d of pod %s: %s", port, pc.keyId, err)
+		return ""
+	}
+	go gossh.DiscardRequests(reqs)
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = ch.Close()
+	}()
+	return probe(ch)
+}
+
+func probeSSH(rw io.ReadWriter) string {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(rw, buf); err == nil && string(buf) == "SSH-" {
+		return ServiceSSH
+	}
+	return ""
+}
+
+func probeHTTP(rw io.ReadWriter) string {
+	if _, err := io.WriteString(rw, "HEAD / HTTP/1.0\r\n\r\n"); err != nil {
+		return ""
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(rw, buf); err == nil && string(buf) == "HTTP/" {
+		return ServiceHTTP
+	}
+	return ""
+}
+
+type podsCommand struct{ app *Server }
+
+func (podsCommand) Name() string  { return "pods" }
+func (podsCommand) Usage() string { return "pods [all]" }
+func (podsCommand) Help() string {
+	return "Lists the pods connected to this bastion, or all pods it knows about.\n" +
+		"Reach the sshd of a pod with ssh router-<id>@<bastion>."
+}
+
+func (c podsCommand) Parse(args []string) (Runner, error) {
+	all := false
+	if len(args) > 1 || (len(args) == 1 && args[0] != "all") {
+		return nil, fmt.Errorf("pods takes no arguments but 'all'")
+	}
+	if len(args) == 1 {
+		all = true
+	}
+	return func(_ context.Context, w io.Writer) error {
+		return c.app.handlePods(w, all)
+	}, nil
+}
+
+// handlePods lists the pods of the fleet.
+func (a *Server) handlePods(w io.Writer, all bool) error {
+	if a.bastion == nil {
+		return fmt.Errorf("this is not a bastion")
+	}
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "%-8s %-16s %-26s %-5s %-28s %s\n", "ROUTER", "KEY ID", "STATE", "CONNS", "FORWARDS", "VERSION")
+	shown := 0
+	for _, e := range a.Fleet() {
+		if !e.Connected && !all {
+			continue
+		}
+		state := "up since " + e.Since.Format(time.RFC3339)
+		if !e.Connected {
+			state = "seen " + e.LastSeen.Format(time.RFC3339)
+		}
+		forwards := make([]string, 0, len(e.Forwards))
+		for _, f := range e.Forwards {
+			if f.Service != "" {
+				forwards = append(forwards, fmt.Sprintf("%d/%s", f.Port, f.Service))
+			} else {
+				forwards = append(forwards, fmt.Sprint(f.Port))
+			}
+		}
+		fmt.Fprintf(&sb, "%-8d %-16s %-26s %-5d %-28s %s\n", e.RouterId, e.KeyId, state, e.Connections, strings.Join(forwards, ","), e.Version)
+		shown++
+	}
+	if shown == 0 {
+		sb.Reset()
+		sb.WriteString("no pods\n")
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
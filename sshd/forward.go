@@ -0,0 +1,238 @@
+package sshd
+
+import (
+	"context"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/perbu/sshpod/audit"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const forwardDialTimeout = 10 * time.Second
+
+// forwardRule allows forwarding to a block of addresses and a range of ports.
+type forwardRule struct {
+	block   *net.IPNet // nil means any address
+	minPort int
+	maxPort int
+}
+
+// parseForwardRule parses "10.0.0.0/8:22", "192.168.1.10:80-90", "*:443",
+// "[fd00::/8]:*" and the like. A plain address is a block of one.
+func parseForwardRule(s string) (forwardRule, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return forwardRule{}, fmt.Errorf("forward rule '%s' has no port, want address:port", s)
+	}
+	addr, ports := strings.Trim(s[:i], "[]"), s[i+1:]
+	rule := forwardRule{minPort: 1, maxPort: 65535}
+	if addr != "*" {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return forwardRule{}, fmt.Errorf("forward rule '%s': bad address", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			rule.block = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else {
+			_, block, err := net.ParseCIDR(addr)
+			if err != nil {
+				return forwardRule{}, fmt.Errorf("forward rule '%s': %w", s, err)
+			}
+			rule.block = block
+		}
+	}
+	if ports != "*" {
+		lo, hi, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			hi = lo
+		}
+		var err1, err2 error
+		rule.minPort, err1 = strconv.Atoi(lo)
+		rule.maxPort, err2 = strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || rule.minPort < 1 || rule.maxPort > 65535 || rule.minPort > rule.maxPort {
+			return forwardRule{}, fmt.Errorf("forward rule '%s': bad ports", s)
+		}
+	}
+	return rule, nil
+}
+
+func parseForwardRules(list []string) ([]forwardRule, error) {
+	rules := make([]forwardRule, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		r, err := parseForwardRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func (r forwardRule) allows(ip net.IP, port int) bool {
+	if port < r.minPort || port > r.maxPort {
+		return false
+	}
+	return r.block == nil || r.block.Contains(ip)
+}
+
+// SetForwarding allows clients to forward connections (ssh -L, ssh -J) to the
+// destinations in rules. With a policy, the roles of the user decide instead.
+// No rules turns forwarding off.
+func (app *Server) SetForwarding(rules []string) error {
+	parsed, err := parseForwardRules(rules)
+	if err != nil {
+		return err
+	}
+	app.forwardRules = parsed
+	return nil
+}
+
+// forwardRulesFor returns the forward rules that apply to the session's user.
+func (a *Server) forwardRulesFor(ctx ssh.Context) []forwardRule {
+	if sessionOptions(ctx).noPortForwarding {
+		return nil
+	}
+	if a.policy == nil {
+		return a.forwardRules
+	}
+	if !a.may(ctx, CapPortForwarding) {
+		return nil
+	}
+	var rules []forwardRule
+	for _, r := range a.policy.rolesOf(ctx) {
+		rules = append(rules, a.policy.forwardRules[r]...)
+	}
+	return rules
+}
+
+// mayForward tells if the session's user may forward to the address. Pods may
+// always reach their own ports on the bastion, which is how they test their tunnels.
+func (a *Server) mayForward(ctx ssh.Context, ip net.IP, port int) bool {
+	if a.podOwnsPort(ctx, ip, port) {
+		return true
+	}
+	for _, r := range a.forwardRulesFor(ctx) {
+		if r.allows(ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// directTCPIPData is the payload of a direct-tcpip channel open, RFC 4254 section 7.2.
+type directTCPIPData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// directTCPIPHandler connects a direct-tcpip channel to its destination, if the user may go there.
+func (a *Server) directTCPIPHandler(_ *ssh.Server, _ *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	d := directTCPIPData{}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		_ = newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+	dest := net.JoinHostPort(d.DestAddr, strconv.Itoa(int(d.DestPort)))
+	_, isPod := a.podCert(ctx)
+	if len(a.forwardRulesFor(ctx)) == 0 && !isPod {
+		a.audit(ctx, "forward", "refused %s: forwarding not allowed", dest)
+		_ = newChan.Reject(gossh.Prohibited, "port forwarding is not allowed")
+		return
+	}
+	// Resolve the name once and dial what was checked, so the answer can't change in between.
+	dialCtx, cancel := context.WithTimeout(ctx, forwardDialTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(dialCtx, "ip", d.DestAddr)
+	if err != nil || len(ips) == 0 {
+		a.logger.Warnf("forward to %s for %s: %v", dest, who(ctx), err)
+		_ = newChan.Reject(gossh.ConnectionFailed, "can't resolve "+d.DestAddr)
+		return
+	}
+	var ip net.IP
+	for _, candidate := range ips {
+		if a.mayForward(ctx, candidate, int(d.DestPort)) {
+			ip = candidate
+			break
+		}
+	}
+	if ip == nil {
+		a.audit(ctx, "forward", "refused %s (%s): not in the allowlist", dest, ips[0])
+		_ = newChan.Reject(gossh.Prohibited, "destination not allowed")
+		return
+	}
+	target := net.JoinHostPort(ip.String(), strconv.Itoa(int(d.DestPort)))
+	var dialer net.Dialer
+	dconn, err := dialer.DialContext(dialCtx, "tcp", target)
+	if err != nil {
+		a.logger.Warnf("forward to %s for %s: %s", dest, who(ctx), err)
+		_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	a.auditFields(ctx, "forward", audit.Fields{"state": "open", "dest": dest, "target": target},
+		"open %s (%s) from %s:%d", dest, target, d.OriginAddr, d.OriginPort)
+	go a.pipeForward(ctx, ch, dconn, dest)
+}
+
+// pipeForward copies between the channel and the connection until both directions
+// are done, and logs how much went each way.
+func (a *Server) pipeForward(ctx ssh.Context, ch gossh.Channel, conn net.Conn, dest string) {
+	started := time.Now()
+	var out, in int64
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(conn, ch)
+		atomic.AddInt64(&out, n)
+		if tc, ok := conn.(*net.TCPConn); ok {
+			_ = tc.CloseWrite()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(ch, conn)
+		atomic.AddInt64(&in, n)
+		_ = ch.CloseWrite()
+	}()
+	// Whatever ends first, the session or the copying, takes the other down.
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			ch.Close()
+			conn.Close()
+		case <-done:
+		}
+	}()
+	wg.Wait()
+	close(done)
+	ch.Close()
+	conn.Close()
+	sent, received := atomic.LoadInt64(&out), atomic.LoadInt64(&in)
+	fields := audit.Fields{"state": "closed", "dest": dest, "sent": strconv.FormatInt(sent, 10), "received": strconv.FormatInt(received, 10)}
+	a.auditFields(ctx, "forward", fields, "closed %s after %s, %d bytes sent, %d bytes received",
+		dest, time.Since(started).Round(time.Millisecond), sent, received)
+}
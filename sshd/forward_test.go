@@ -0,0 +1,144 @@
+package sshd
+
+import (
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+)
+
+func TestParseForwardRule(t *testing.T) {
+	type probe struct {
+		ip   string
+		port int
+		want bool
+	}
+	tests := []struct {
+		rule   string
+		err    bool
+		probes []probe
+	}{
+		{
+			rule: "10.0.0.0/8:22",
+			probes: []probe{
+				{"10.1.2.3", 22, true},
+				{"10.255.255.255", 22, true},
+				{"10.1.2.3", 23, false},
+				{"11.0.0.1", 22, false},
+				{"::ffff:10.1.2.3", 22, true},
+			},
+		},
+		{
+			rule: "192.168.1.10:80-90",
+			probes: []probe{
+				{"192.168.1.10", 80, true},
+				{"192.168.1.10", 90, true},
+				{"192.168.1.10", 79, false},
+				{"192.168.1.10", 91, false},
+				{"192.168.1.11", 80, false},
+			},
+		},
+		{
+			rule: "*:443",
+			probes: []probe{
+				{"1.2.3.4", 443, true},
+				{"2001:db8::1", 443, true},
+				{"1.2.3.4", 80, false},
+			},
+		},
+		{
+			rule: "[fd00::/8]:*",
+			probes: []probe{
+				{"fd12::1", 1, true},
+				{"fd12::1", 65535, true},
+				{"fe80::1", 22, false},
+				{"10.0.0.1", 22, false},
+			},
+		},
+		{
+			rule: "[2001:db8::1]:22",
+			probes: []probe{
+				{"2001:db8::1", 22, true},
+				{"2001:db8::2", 22, false},
+			},
+		},
+		{rule: "10.0.0.1", err: true},
+		{rule: "host.example.com:22", err: true},
+		{rule: "10.0.0.0/33:22", err: true},
+		{rule: "10.0.0.1:0", err: true},
+		{rule: "10.0.0.1:65536", err: true},
+		{rule: "10.0.0.1:90-80", err: true},
+		{rule: "10.0.0.1:ssh", err: true},
+		{rule: "10.0.0.1:", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			r, err := parseForwardRule(tt.rule)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("accepted '%s'", tt.rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			for _, p := range tt.probes {
+				if got := r.allows(net.ParseIP(p.ip), p.port); got != p.want {
+					t.Errorf("allows(%s, %d) = %v, want %v", p.ip, p.port, got, p.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMayForward(t *testing.T) {
+	rules, err := parseForwardRules([]string{"10.0.0.0/8:22", " ", "*:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &Policy{
+		Principals: map[string][]string{"ops": {"ops"}, "dev": {"dev"}, "viewer": {"viewer"}},
+		Roles: map[string]Role{
+			"ops":    {Capabilities: []Capability{CapPortForwarding}, Forward: []string{"10.0.0.0/8:*"}},
+			"dev":    {Capabilities: []Capability{CapPortForwarding}, Forward: []string{"192.168.0.0/16:8080"}},
+			"viewer": {Forward: []string{"*:*"}},
+		},
+	}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		policy     *Policy
+		principals []string
+		noForward  bool
+		ip         string
+		port       int
+		want       bool
+	}{
+		{name: "rule", ip: "10.1.1.1", port: 22, want: true},
+		{name: "other rule", ip: "8.8.8.8", port: 443, want: true},
+		{name: "no rule", ip: "10.1.1.1", port: 80},
+		{name: "no-port-forwarding", noForward: true, ip: "10.1.1.1", port: 22},
+		{name: "role", policy: policy, principals: []string{"ops"}, ip: "10.1.1.1", port: 80, want: true},
+		{name: "role, not the server's rules", policy: policy, principals: []string{"ops"}, ip: "8.8.8.8", port: 443},
+		{name: "other role", policy: policy, principals: []string{"dev"}, ip: "10.1.1.1", port: 80},
+		{name: "roles add up", policy: policy, principals: []string{"ops", "dev"}, ip: "192.168.1.1", port: 8080, want: true},
+		{name: "role without the capability", policy: policy, principals: []string{"viewer"}, ip: "10.1.1.1", port: 22},
+		{name: "no role", policy: policy, principals: []string{"nobody"}, ip: "10.1.1.1", port: 22},
+		{name: "role and no-port-forwarding", policy: policy, principals: []string{"ops"}, noForward: true, ip: "10.1.1.1", port: 22},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Server{forwardRules: rules, policy: tt.policy}
+			ctx := newTestContext("alice")
+			ctx.SetValue(ctxKeyCert, &gossh.Certificate{CertType: gossh.UserCert, KeyId: "alice", ValidPrincipals: tt.principals})
+			if tt.noForward {
+				ctx.SetValue(ctxKeyOptions, &keyOptions{noPortForwarding: true})
+			}
+			if got := a.mayForward(ctx, net.ParseIP(tt.ip), tt.port); got != tt.want {
+				t.Errorf("mayForward(%s, %d) = %v, want %v", tt.ip, tt.port, got, tt.want)
+			}
+		})
+	}
+}
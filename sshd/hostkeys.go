@@ -0,0 +1,628 @@
+package sshd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/perbu/sshpod/audit"
+	"github.com/perbu/sshpod/sshkeys"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hostKeysRequest tells the client about all our host keys.
+	hostKeysRequest = "hostkeys-00@openssh.com"
+	// hostKeysProveRequest is the client asking us to prove we hold the keys we announced.
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+
+	nextSuffix    = ".next"
+	retiredSuffix = ".retired"
+	certSuffix    = "-cert.pub"
+
+	// kexAlgorithmTTL is how long the signature algorithm of a handshake is kept
+	// for a connection that doesn't log in.
+	kexAlgorithmTTL = 10 * time.Minute
+)
+
+// hostKeyTypes are the kinds of host keys we can use, and the ssh key types they go by.
+var hostKeyTypes = map[string]string{
+	"ed25519": gossh.KeyAlgoED25519,
+	"ecdsa":   gossh.KeyAlgoECDSA256,
+	"rsa":     gossh.KeyAlgoRSA,
+}
+
+// HostKeys configures the host keys of the server.
+type HostKeys struct {
+	// Dir holds the keys as ssh_host_<type>_key. Missing ones are generated. A
+	// certificate for a key goes next to it, as ssh_host_<type>_key-cert.pub.
+	// Without a Dir the server shows clients the key it logs in to the bastion
+	// with, and host keys can't be rotated.
+	Dir string
+	// Types are the kinds of keys to use: ed25519, ecdsa and rsa.
+	Types []string
+}
+
+// hostKey is the key of one type, and the one that will take its place.
+type hostKey struct {
+	keyType   string
+	path      string
+	signer    ssh.Signer
+	cert      *gossh.Certificate
+	next      ssh.Signer
+	nextCert  *gossh.Certificate
+	nextSince time.Time
+}
+
+// hostKeySet holds the host keys. Keys are rotated in two steps: the next key is
+// announced to clients with hostkeys-00@openssh.com, so they learn it, and once
+// they have, it replaces the current one.
+type hostKeySet struct {
+	mu   sync.Mutex
+	keys []*hostKey
+
+	kexMu sync.Mutex
+	// kexAlgorithms holds the signature algorithm RSA host keys signed handshakes
+	// with, by exchange hash, until the connection logs in.
+	kexAlgorithms map[string]kexAlgorithm
+}
+
+type kexAlgorithm struct {
+	algorithm string
+	at        time.Time
+}
+
+// kexSigner is a host key as handshakes see it. It notes the signature algorithm
+// RSA keys sign with, which the client and we settled on: OpenSSH checks the
+// proofs of RSA host keys with it. The first thing a host key signs on a
+// connection is the exchange hash that becomes the session id.
+type kexSigner struct {
+	gossh.AlgorithmSigner
+	set *hostKeySet
+}
+
+func (s kexSigner) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	sig, err := s.AlgorithmSigner.Sign(rand, data)
+	s.note(data, sig, err)
+	return sig, err
+}
+
+func (s kexSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*gossh.Signature, error) {
+	sig, err := s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+	s.note(data, sig, err)
+	return sig, err
+}
+
+func (s kexSigner) note(data []byte, sig *gossh.Signature, err error) {
+	if err != nil || !isRSA(s.PublicKey()) {
+		return
+	}
+	set := s.set
+	set.kexMu.Lock()
+	defer set.kexMu.Unlock()
+	now := time.Now()
+	if len(set.kexAlgorithms) >= maxTracked {
+		for k, ka := range set.kexAlgorithms {
+			if now.Sub(ka.at) > kexAlgorithmTTL {
+				delete(set.kexAlgorithms, k)
+			}
+		}
+	}
+	set.kexAlgorithms[string(data)] = kexAlgorithm{algorithm: sig.Format, at: now}
+}
+
+// takeKexAlgorithm returns the algorithm the RSA host key signed the handshake of
+// the session with, if it was an RSA key, and forgets it.
+func (set *hostKeySet) takeKexAlgorithm(sessionID []byte) string {
+	set.kexMu.Lock()
+	defer set.kexMu.Unlock()
+	ka := set.kexAlgorithms[string(sessionID)]
+	delete(set.kexAlgorithms, string(sessionID))
+	return ka.algorithm
+}
+
+// currentSigner is the current key of a type, whichever that is, so the server
+// can keep it in its host keys across retiring. A handshake that spans a retire
+// may find the key changed under it and fail; the client connects again.
+type currentSigner struct {
+	set *hostKeySet
+	hk  *hostKey
+}
+
+func (s currentSigner) signer() gossh.AlgorithmSigner {
+	s.set.mu.Lock()
+	defer s.set.mu.Unlock()
+	return s.hk.signer.(gossh.AlgorithmSigner)
+}
+
+func (s currentSigner) PublicKey() gossh.PublicKey {
+	return s.signer().PublicKey()
+}
+
+func (s currentSigner) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	return s.signer().Sign(rand, data)
+}
+
+func (s currentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*gossh.Signature, error) {
+	return s.signer().SignWithAlgorithm(rand, data, algorithm)
+}
+
+// isRSA tells if the key, or the key of the certificate, is an RSA key.
+func isRSA(k gossh.PublicKey) bool {
+	return plainKey(k).Type() == gossh.KeyAlgoRSA
+}
+
+// plainKey returns the key of a certificate, or the key itself.
+func plainKey(k gossh.PublicKey) gossh.PublicKey {
+	if cert, ok := k.(*gossh.Certificate); ok {
+		return cert.Key
+	}
+	return k
+}
+
+// SetHostKeys gives the server host keys of its own, instead of the key it uses to
+// log in to the bastion. An empty dir keeps that key.
+func (app *Server) SetHostKeys(cfg HostKeys) error {
+	if cfg.Dir == "" {
+		app.logger.Infof("no host key dir, using the login key as host key")
+		return nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return fmt.Errorf("host key dir: %w", err)
+	}
+	set := &hostKeySet{kexAlgorithms: make(map[string]kexAlgorithm)}
+	var signers []ssh.Signer
+	for _, t := range cfg.Types {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if _, ok := hostKeyTypes[t]; !ok {
+			return fmt.Errorf("unknown host key type %s, use ed25519, ecdsa or rsa", t)
+		}
+		hk, err := app.loadHostKey(cfg.Dir, t)
+		if err != nil {
+			return err
+		}
+		if _, ok := hk.signer.(gossh.AlgorithmSigner); !ok {
+			return fmt.Errorf("host key %s can't sign with a chosen algorithm", hk.path)
+		}
+		set.keys = append(set.keys, hk)
+		signers = append(signers, kexSigner{AlgorithmSigner: currentSigner{set: set, hk: hk}, set: set})
+	}
+	if len(set.keys) == 0 {
+		return fmt.Errorf("no host key types given")
+	}
+	app.server.HostSigners = signers
+	app.hostKeys = set
+	return nil
+}
+
+// loadHostKey reads the key of type t and its certificate, making the key if it isn't there.
+func (a *Server) loadHostKey(dir, t string) (*hostKey, error) {
+	hk := &hostKey{keyType: t, path: filepath.Join(dir, "ssh_host_"+t+"_key")}
+	signer, err := sshkeys.GetPrivateKeyFile(hk.path)
+	if errors.Is(err, os.ErrNotExist) {
+		signer, err = sshkeys.GenerateKeyFile(hk.path, t)
+		if err == nil {
+			a.logger.Infof("generated %s host key %s", t, hk.path)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("host key: %w", err)
+	}
+	if signer.PublicKey().Type() != hostKeyTypes[t] {
+		return nil, fmt.Errorf("host key %s is %s, not %s", hk.path, signer.PublicKey().Type(), t)
+	}
+	hk.signer = signer
+	if hk.cert, err = loadHostCert(hk.path, signer); err != nil {
+		return nil, err
+	}
+	next, err := sshkeys.GetPrivateKeyFile(hk.path + nextSuffix)
+	switch {
+	case err == nil:
+		hk.next = next
+		if info, err := os.Stat(hk.path + nextSuffix); err == nil {
+			hk.nextSince = info.ModTime()
+		}
+		if hk.nextCert, err = loadHostCert(hk.path+nextSuffix, next); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("next host key: %w", err)
+	}
+	a.logger.Infof("host key %s %s%s", t, gossh.FingerprintSHA256(signer.PublicKey()), describeHostCert(hk.cert))
+	if hk.next != nil {
+		a.logger.Infof("next host key %s %s%s", t, gossh.FingerprintSHA256(hk.next.PublicKey()), describeHostCert(hk.nextCert))
+	}
+	return hk, nil
+}
+
+// loadHostCert reads the certificate of the key at path, if there is one.
+func loadHostCert(path string, signer ssh.Signer) (*gossh.Certificate, error) {
+	data, err := os.ReadFile(path + certSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("host certificate: %w", err)
+	}
+	pub, _, _, _, err := gossh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("host certificate %s: %w", path+certSuffix, err)
+	}
+	cert, ok := pub.(*gossh.Certificate)
+	if !ok || cert.CertType != gossh.HostCert {
+		return nil, fmt.Errorf("%s is not a host certificate", path+certSuffix)
+	}
+	if !ssh.KeysEqual(cert.Key, signer.PublicKey()) {
+		return nil, fmt.Errorf("host certificate %s is for another key", path+certSuffix)
+	}
+	return cert, nil
+}
+
+func describeHostCert(cert *gossh.Certificate) string {
+	if cert == nil {
+		return ""
+	}
+	return fmt.Sprintf(", certificate %s serial %d", cert.KeyId, cert.Serial)
+}
+
+// certSigners returns the certificates of the current keys, as the handshakes of
+// new connections offer them next to the plain keys.
+func (set *hostKeySet) certSigners() []gossh.Signer {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	var res []gossh.Signer
+	for _, hk := range set.keys {
+		if hk.cert == nil {
+			continue
+		}
+		s, err := gossh.NewCertSigner(hk.cert, hk.signer)
+		if err != nil {
+			continue
+		}
+		if as, ok := s.(gossh.AlgorithmSigner); ok {
+			s = kexSigner{AlgorithmSigner: as, set: set}
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// refreshNextCert picks up a certificate issued for the next key after it was made.
+func (hk *hostKey) refreshNextCert() error {
+	if hk.next == nil || hk.nextCert != nil {
+		return nil
+	}
+	var err error
+	hk.nextCert, err = loadHostCert(hk.path+nextSuffix, hk.next)
+	return err
+}
+
+// announced returns the keys clients should know about, the next ones included.
+func (set *hostKeySet) announced() []gossh.PublicKey {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	var res []gossh.PublicKey
+	for _, hk := range set.keys {
+		res = append(res, hk.signer.PublicKey())
+		if hk.next != nil {
+			res = append(res, hk.next.PublicKey())
+		}
+	}
+	return res
+}
+
+// HostPublicKeys returns the host keys clients may meet, the next ones included.
+func (app *Server) HostPublicKeys() []gossh.PublicKey {
+	if app.hostKeys == nil {
+		return []gossh.PublicKey{app.signer.PublicKey()}
+	}
+	return app.hostKeys.announced()
+}
+
+// hostKeysChanged tells the bastion about the host keys again.
+func (a *Server) hostKeysChanged() {
+	if a.monitor != nil {
+		go a.monitor.AnnounceHostKeys()
+	}
+}
+
+// find returns the signer of the announced key with the given wire format.
+func (set *hostKeySet) find(blob []byte) ssh.Signer {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	for _, hk := range set.keys {
+		for _, s := range []ssh.Signer{hk.signer, hk.next} {
+			if s != nil && string(s.PublicKey().Marshal()) == string(blob) {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// announcing makes the channel handler announce our host keys on the first channel
+// of a connection. Clients only take them after they have logged in.
+func (a *Server) announcing(h ssh.ChannelHandler) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		a.announceHostKeys(ctx, conn)
+		h(srv, conn, newChan, ctx)
+	}
+}
+
+// announceHostKeys sends the host keys to the client, once per connection.
+func (a *Server) announceHostKeys(ctx ssh.Context, conn *gossh.ServerConn) {
+	st, ok := ctx.Value(ctxKeyConnState).(*connState)
+	if a.hostKeys == nil || !ok {
+		return
+	}
+	st.mu.Lock()
+	done := st.announced || st.pod
+	st.announced = true
+	st.mu.Unlock()
+	if done {
+		return
+	}
+	var payload []byte
+	for _, k := range a.hostKeys.announced() {
+		payload = append(payload, gossh.Marshal(struct{ Key []byte }{k.Marshal()})...)
+	}
+	if _, _, err := conn.SendRequest(hostKeysRequest, false, payload); err != nil {
+		a.logger.Debugf("announcing host keys to %s: %s", who(ctx), err)
+	}
+}
+
+// hostKeysProveHandler signs each of the keys the client asks about, to show we
+// hold them. RSA keys sign with the algorithm of the handshake if that was made
+// with an RSA key, and with rsa-sha2-512 otherwise.
+func (a *Server) hostKeysProveHandler(ctx ssh.Context, _ *ssh.Server, req *gossh.Request) (bool, []byte) {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	st, hasState := ctx.Value(ctxKeyConnState).(*connState)
+	if a.hostKeys == nil || !ok || !hasState {
+		return false, nil
+	}
+	st.mu.Lock()
+	rsaAlgorithm := st.kexAlgorithm
+	st.mu.Unlock()
+	if rsaAlgorithm == "" {
+		rsaAlgorithm = gossh.KeyAlgoRSASHA512
+	}
+	blobs, err := parseStrings(req.Payload)
+	if err != nil {
+		a.logger.Debugf("host key proof for %s: %s", who(ctx), err)
+		return false, nil
+	}
+	var resp []byte
+	for _, blob := range blobs {
+		signer := a.hostKeys.find(blob)
+		if signer == nil {
+			a.logger.Debugf("host key proof for %s: asked about a key we don't have", who(ctx))
+			return false, nil
+		}
+		data := gossh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{hostKeysProveRequest, conn.SessionID(), blob})
+		var sig *gossh.Signature
+		if as, ok := signer.(gossh.AlgorithmSigner); ok && signer.PublicKey().Type() == gossh.KeyAlgoRSA {
+			sig, err = as.SignWithAlgorithm(rand.Reader, data, rsaAlgorithm)
+		} else {
+			sig, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			a.logger.Warnf("host key proof for %s: %s", who(ctx), err)
+			return false, nil
+		}
+		resp = append(resp, gossh.Marshal(struct{ Sig []byte }{gossh.Marshal(sig)})...)
+	}
+	return true, resp
+}
+
+// parseStrings splits a payload of ssh strings.
+func parseStrings(b []byte) ([][]byte, error) {
+	var res [][]byte
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("short payload")
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint32(len(b)-4) < n {
+			return nil, errors.New("short payload")
+		}
+		res = append(res, b[4:4+n])
+		b = b[4+n:]
+	}
+	return res, nil
+}
+
+// rotateHostKey makes the next key of type t. It is announced from now on, and
+// takes over when the current one is retired.
+func (a *Server) rotateHostKey(t string) (*hostKey, error) {
+	hk, err := a.hostKeyOf(t)
+	if err != nil {
+		return nil, err
+	}
+	set := a.hostKeys
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if hk.next != nil {
+		return nil, fmt.Errorf("there is a next %s key already, retire the current one first", t)
+	}
+	next, err := sshkeys.GenerateKeyFile(hk.path+nextSuffix, t)
+	if err != nil {
+		return nil, err
+	}
+	hk.next, hk.nextCert, hk.nextSince = next, nil, time.Now()
+	a.writeAudit(audit.Record{
+		Event:   "hostkey",
+		Fields:  audit.Fields{"action": "rotate", "type": t, "next": gossh.FingerprintSHA256(next.PublicKey())},
+		Message: fmt.Sprintf("announcing the next %s host key", t),
+	})
+	a.hostKeysChanged()
+	return hk, nil
+}
+
+// retireHostKey puts the next key of type t in place of the current one. If the
+// current key has a certificate, the next needs one too.
+func (a *Server) retireHostKey(t string) (*hostKey, error) {
+	hk, err := a.hostKeyOf(t)
+	if err != nil {
+		return nil, err
+	}
+	set := a.hostKeys
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if hk.next == nil {
+		return nil, fmt.Errorf("there is no next %s key, rotate first", t)
+	}
+	if err := hk.refreshNextCert(); err != nil {
+		return nil, err
+	}
+	if hk.cert != nil && hk.nextCert == nil {
+		return nil, fmt.Errorf("the current %s key has a certificate and the next has none; sign %s first",
+			t, hk.path+nextSuffix+".pub")
+	}
+	old := hk.signer
+	if err := retireHostKeyFiles(hk.path); err != nil {
+		return nil, err
+	}
+	hk.signer, hk.cert = hk.next, hk.nextCert
+	hk.next, hk.nextCert, hk.nextSince = nil, nil, time.Time{}
+	a.writeAudit(audit.Record{
+		Event: "hostkey",
+		Fields: audit.Fields{"action": "retire", "type": t, "retired": gossh.FingerprintSHA256(old.PublicKey()),
+			"current": gossh.FingerprintSHA256(hk.signer.PublicKey())},
+		Message: fmt.Sprintf("retired the %s host key", t),
+	})
+	a.hostKeysChanged()
+	return hk, nil
+}
+
+// retireHostKeyFiles moves the files of the key at path to .retired and those of
+// the next key in their place. If that fails half way, the files are put back as
+// they were, so they keep matching the keys in use.
+func retireHostKeyFiles(path string) error {
+	type move struct{ from, to string }
+	var done []move
+	for _, suffix := range []string{"", ".pub", certSuffix} {
+		for _, m := range []move{
+			{path + suffix, path + retiredSuffix + suffix},
+			{path + nextSuffix + suffix, path + suffix},
+		} {
+			err := os.Rename(m.from, m.to)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				for i := len(done) - 1; i >= 0; i-- {
+					_ = os.Rename(done[i].to, done[i].from)
+				}
+				return fmt.Errorf("retiring host key: %w", err)
+			}
+			done = append(done, m)
+		}
+	}
+	return nil
+}
+
+func (a *Server) hostKeyOf(t string) (*hostKey, error) {
+	if a.hostKeys == nil {
+		return nil, fmt.Errorf("no host keys of our own, set a host key dir")
+	}
+	for _, hk := range a.hostKeys.keys {
+		if hk.keyType == t {
+			return hk, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s host key", t)
+}
+
+type hostKeysCommand struct{ app *Server }
+
+func (hostKeysCommand) Name() string  { return "hostkeys" }
+func (hostKeysCommand) Usage() string { return "hostkeys [rotate|retire <type>]" }
+func (hostKeysCommand) Help() string {
+	return "Shows the host keys, or rotates one.\n" +
+		"rotate makes the next key of a type and announces it to clients as they log in.\n" +
+		"Once they have learnt it, retire puts it in place of the current key."
+}
+
+func (c hostKeysCommand) Parse(args []string) (Runner, error) {
+	switch {
+	case len(args) == 0:
+		return func(_ context.Context, w io.Writer) error {
+			return c.app.handleHostKeys(w)
+		}, nil
+	case len(args) == 2 && (args[0] == "rotate" || args[0] == "retire"):
+		if _, ok := hostKeyTypes[args[1]]; !ok {
+			return nil, fmt.Errorf("unknown host key type %s, use ed25519, ecdsa or rsa", args[1])
+		}
+		return func(_ context.Context, w io.Writer) error {
+			if args[0] == "retire" {
+				hk, err := c.app.retireHostKey(args[1])
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintf(w, "the %s host key is now %s\n", hk.keyType, gossh.FingerprintSHA256(hk.signer.PublicKey()))
+				return err
+			}
+			hk, err := c.app.rotateHostKey(args[1])
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "the next %s host key is %s, announced from now on.\n"+
+				"Sign %s if clients check host certificates, and retire the current key once clients have learnt it.\n",
+				hk.keyType, gossh.FingerprintSHA256(hk.next.PublicKey()), hk.path+nextSuffix+".pub")
+			return err
+		}, nil
+	}
+	return nil, fmt.Errorf("hostkeys takes no arguments, or rotate or retire and a key type")
+}
+
+// handleHostKeys lists the host keys.
+func (a *Server) handleHostKeys(w io.Writer) error {
+	if a.hostKeys == nil {
+		_, err := fmt.Fprintf(w, "using the login key as host key: %s\n", gossh.FingerprintSHA256(a.signer.PublicKey()))
+		return err
+	}
+	set := a.hostKeys
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "%-8s %-8s %-20s %-51s %s\n", "TYPE", "STATE", "ANNOUNCED", "FINGERPRINT", "CERTIFICATE")
+	for _, hk := range set.keys {
+		fmt.Fprintf(&sb, "%-8s %-8s %-20s %-51s %s\n", hk.keyType, "current", "-", gossh.FingerprintSHA256(hk.signer.PublicKey()), certSummary(hk.cert))
+		if hk.next == nil {
+			continue
+		}
+		if err := hk.refreshNextCert(); err != nil {
+			a.logger.Warnf("%s", err)
+		}
+		fmt.Fprintf(&sb, "%-8s %-8s %-20s %-51s %s\n", hk.keyType, "next", hk.nextSince.UTC().Format(time.RFC3339),
+			gossh.FingerprintSHA256(hk.next.PublicKey()), certSummary(hk.nextCert))
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func certSummary(cert *gossh.Certificate) string {
+	if cert == nil {
+		return "-"
+	}
+	until := "forever"
+	if cert.ValidBefore != gossh.CertTimeInfinity {
+		until = time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s serial %d until %s", cert.KeyId, cert.Serial, until)
+}
@@ -0,0 +1,98 @@
+package sshd
+
+import (
+	"context"
+	"github.com/gliderlabs/ssh"
+	"io"
+	"sync"
+)
+
+const keyCtrlC = 3
+
+// interrupter cancels the command running in a session. Commands are interrupted by
+// Ctrl-C on the terminal, by a signal request from the client or when the session closes.
+type interrupter struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// start returns the context a command runs with. done must be called when the command is finished.
+func (i *interrupter) start(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	i.mu.Lock()
+	i.cancel = cancel
+	i.mu.Unlock()
+	return ctx, func() {
+		i.mu.Lock()
+		i.cancel = nil
+		i.mu.Unlock()
+		cancel()
+	}
+}
+
+// running reports if a command is running.
+func (i *interrupter) running() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.cancel != nil
+}
+
+// interrupt cancels the running command, if there is one.
+func (i *interrupter) interrupt() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.cancel == nil {
+		return false
+	}
+	i.cancel()
+	return true
+}
+
+// watchSignals interrupts the running command whenever the client sends a signal.
+func (i *interrupter) watchSignals(s ssh.Session, logger interface{ Debugf(string, ...interface{}) }) {
+	sigCh := make(chan ssh.Signal, 1)
+	s.Signals(sigCh)
+	go func() {
+		for {
+			select {
+			case <-s.Context().Done():
+				return
+			case sig := <-sigCh:
+				if i.interrupt() {
+					logger.Debugf("command interrupted by signal %s", sig)
+				}
+			}
+		}
+	}()
+}
+
+// pumpInput copies the input of the session to w, which is read by the terminal.
+// While a command runs the input is only checked for Ctrl-C, which interrupts
+// the command; anything else typed at that time is dropped. If w is nil, input is
+// only used for interrupting. When the input ends, w is closed with the read error.
+func (i *interrupter) pumpInput(r io.Reader, w *io.PipeWriter) {
+	buf := make([]byte, 256)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if i.running() {
+				for _, b := range buf[:n] {
+					if b == keyCtrlC {
+						i.interrupt()
+						break
+					}
+				}
+			} else if w != nil {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+		}
+		if err != nil {
+			if w != nil {
+				_ = w.CloseWithError(err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package sshd
+
+import (
+	"context"
+	"fmt"
+	"github.com/perbu/sshpod/sshmonitor"
+	"io"
+	"strconv"
+)
+
+type limitCommand struct{ app *Server }
+
+func (limitCommand) Name() string  { return "limit" }
+func (limitCommand) Usage() string { return "limit [port|tunnel] [rate]" }
+func (limitCommand) Help() string {
+	return `Shows or sets the bandwidth limits of the tunnel.
+"limit tunnel 1m" limits the whole tunnel, "limit 2222 256k" a single forward. A rate of 0 removes the limit.
+A limit counts the traffic in both directions together.`
+}
+
+func (c limitCommand) Parse(args []string) (Runner, error) {
+	if len(args) == 1 || len(args) > 2 {
+		return nil, fmt.Errorf("limit takes no arguments, or a target and a rate")
+	}
+	return func(_ context.Context, w io.Writer) error {
+		return c.app.handleLimit(w, args)
+	}, nil
+}
+
+// handleLimit shows or sets the rate limits on the tunnel.
+// "limit" shows the limits, "limit tunnel 1m" limits the whole tunnel and
+// "limit 2222 256k" limits a single forward. A rate of 0 removes the limit.
+func (a *Server) handleLimit(w io.Writer, args []string) error {
+	if a.monitor == nil {
+		return fmt.Errorf("no tunnel monitor configured")
+	}
+	if len(args) == 2 {
+		port := 0
+		if args[0] != "tunnel" {
+			var err error
+			port, err = strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("limit: bad port '%s'", args[0])
+			}
+		}
+		rate, err := sshmonitor.ParseRate(args[1])
+		if err != nil {
+			return err
+		}
+		err = a.monitor.SetRateLimit(port, rate)
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range a.monitor.RateLimits() {
+		name := "tunnel"
+		if r.Port != 0 {
+			name = strconv.Itoa(r.Port)
+		}
+		limit := "unlimited"
+		if r.Limit > 0 {
+			limit = fmt.Sprintf("%d B/s", r.Limit)
+		}
+		throttled := ""
+		if r.Throttled {
+			throttled = "throttled"
+		}
+		fmt.Fprintf(w, "%-6s limit %-14s rate %10.0f B/s %s\n", name, limit, r.Rate, throttled)
+	}
+	return nil
+}
@@ -3,27 +3,60 @@ package sshd
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	log "github.com/celerway/chainsaw"
 	"github.com/gliderlabs/ssh"
+	"github.com/perbu/sshpod/audit"
+	"github.com/perbu/sshpod/sshmonitor"
 	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
 	"io"
 	"net"
-	"strconv"
 	"strings"
+	"time"
 )
 
+const chonkChunk = 32 * 1024
+
 type Server struct {
 	server   *ssh.Server
+	signer   ssh.Signer
 	pubKey   ssh.PublicKey
 	routerId int
 	logger   log.Logger
 	listener net.Listener
 	port     int
 	check    gossh.CertChecker
+	monitor  *sshmonitor.Monitor
+	commands *registry
+	history  *cmdHistory
+
+	fileTransfer *FileTransfer
+	authKeys     *authorizedKeys
+	policy       *Policy
+	revoked      *revocationList
+	forwardRules []forwardRule
+	bastion      *Bastion
+	pods         *podRegistry
+	fleet        *fleet
+	recordings   *recordings
+	auditLog     *audit.Log
+	limits       Limits
+	conns        connCounts
+	bans         *banList
+	hostKeys     *hostKeySet
 }
 
+type contextKey struct{ name string }
+
+var (
+	// ctxKeyCert holds the certificate the user logged in with, if any.
+	ctxKeyCert = &contextKey{"cert"}
+	// ctxKeyOptions holds the authorized_keys options of the key the user logged in with.
+	ctxKeyOptions = &contextKey{"options"}
+)
+
 // New creates a new sshd server.
 // Params:
 // - signer - the private key
@@ -40,26 +73,51 @@ func New(signer ssh.Signer, key ssh.PublicKey, routerId, port int, logger log.Lo
 	logger.Infof("sshd allocated listening socket on %v (requested %v) ", actualPort, port)
 
 	app := &Server{
+		signer:   signer,
 		pubKey:   key,
 		routerId: routerId,
 		logger:   logger,
 		port:     actualPort,
 		listener: listener,
+		commands: newRegistry(),
+		history:  &cmdHistory{size: defaultHistorySize},
+		pods:     &podRegistry{conns: make(map[string]*podConn)},
+		conns:    connCounts{bySource: make(map[string]int), byUser: make(map[string]int)},
+		bans:     newBanList(),
 	}
+	app.registerBuiltins()
 	app.check = gossh.CertChecker{
-		IsUserAuthority: app.userAuthorityChecker,
+		IsUserAuthority:          app.userAuthorityChecker,
+		IsRevoked:                app.isRevoked,
+		SupportedCriticalOptions: []string{optForceCommand, optSourceAddress},
 	}
 
 	app.server = &ssh.Server{
 		PublicKeyHandler:         app.myPubKeyHandler,
 		ConnectionFailedCallback: app.connectionFailedCallback,
+		ConnCallback:             app.connCallback,
+		ServerConfigCallback:     app.serverConfig,
 		Handler:                  app.sshHandler,
+		PtyCallback:              app.ptyCallback,
 		HostSigners:              []ssh.Signer{signer},
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session":      app.announcing(ssh.DefaultSessionHandler),
+			"direct-tcpip": app.announcing(app.directTCPIPHandler),
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":            app.tcpipForwardHandler,
+			"cancel-tcpip-forward":     app.tcpipForwardHandler,
+			hostKeysProveRequest:       app.hostKeysProveHandler,
+			sshmonitor.HostKeysRequest: app.podHostKeysHandler,
+		},
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": app.sftpHandler,
+		},
 	}
 	return app, nil
 }
 
-func (app Server) Run(ctx context.Context) error {
+func (app *Server) Run(ctx context.Context) error {
 	app.logger.Infof("Starting Ssh server for ID %d on: :%d", app.routerId, app.port)
 
 	go func() {
@@ -73,19 +131,68 @@ func (app Server) Run(ctx context.Context) error {
 	return nil
 }
 
-func (app Server) Port() int {
+func (app *Server) Port() int {
 	return app.port
 }
 
-func (a Server) sshHandler(s ssh.Session) {
+// SetMonitor makes the tunnel monitor available to the tunnel commands.
+func (app *Server) SetMonitor(m *sshmonitor.Monitor) {
+	app.monitor = m
+}
+
+func (a *Server) sshHandler(s ssh.Session) {
 	defer s.Close()
+	if _, isPod := a.podCert(s.Context()); !isPod {
+		if recordable(s) {
+			var done func()
+			s, done = a.startRecording(s)
+			defer done()
+		}
+		defer a.auditSession(s)()
+	}
+	defer a.trackSession(s)()
+	if forced := a.forcedCommand(s.Context()); forced != "" {
+		a.execHandler(s, forced)
+		return
+	}
+	if cert, ok := a.podCert(s.Context()); ok {
+		a.podSession(s, cert)
+		return
+	}
+	if routerId, ok := a.routedPod(s.Context()); ok {
+		a.routeToPod(s, routerId)
+		return
+	}
 	if s.RawCommand() != "" {
-		io.WriteString(s, "raw commands are not supported")
+		a.execHandler(s, s.RawCommand())
 		return
 	}
+	a.logger.Infof("interactive session for %s, roles %v", who(s.Context()), a.sessionRoles(s.Context()))
 	io.WriteString(s, fmt.Sprintf("Welcome to my own ssh daemon, %s\n", s.User()))
 
-	term := terminal.NewTerminal(s, fmt.Sprintf("%s (id: %d)> ", s.User(), a.routerId))
+	intr := &interrupter{}
+	intr.watchSignals(s, a.logger)
+	pr, pw := io.Pipe()
+	go intr.pumpInput(s, pw)
+	history, err := a.history.load(historyOwner(s.Context()))
+	if err != nil {
+		a.logger.Warnf("loading history for %s: %s", s.User(), err)
+	}
+	out := &switchWriter{w: s}
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{seedReader(history, pr), out}, fmt.Sprintf("%s (id: %d)> ", s.User(), a.routerId))
+	// Replay the history through the terminal so the arrow keys can reach it.
+	for range history {
+		if _, err := term.ReadLine(); err != nil {
+			break
+		}
+	}
+	out.enable()
+	term.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		return a.complete(s.Context(), line, pos, key)
+	}
 	pty, winCh, isPty := s.Pty()
 	if isPty {
 		fmt.Println("PTY term", pty.Term)
@@ -115,46 +222,139 @@ func (a Server) sshHandler(s ssh.Session) {
 		if line == "quit" {
 			break
 		}
-		if line == "" {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err := a.history.add(historyOwner(s.Context()), strings.TrimSpace(line)); err != nil {
+			a.logger.Warnf("saving history for %s: %s", s.User(), err)
+		}
+		ctx, done := intr.start(s.Context())
+		err = a.dispatch(ctx, s, strings.Fields(line))
+		done()
+		if s.Context().Err() != nil {
+			break
+		}
+		if errors.Is(err, context.Canceled) {
+			_, _ = io.WriteString(s, "^C interrupted\n")
 			continue
 		}
-		output, err := handleTerminalInput(line)
 		if err != nil {
-			a.logger.Error("Error handling terminal input: %s", err)
-			output = "Error handling terminal input: " + err.Error() + "\n"
+			a.logger.Errorf("Error handling terminal input: %s", err)
+			_, _ = io.WriteString(s, "Error handling terminal input: "+err.Error()+"\n")
 		}
-		io.WriteString(s, output)
 	}
 }
 
-func handleTerminalInput(line string) (string, error) {
-	ss := strings.SplitN(line, " ", 2)
-	switch ss[0] {
-	case "help":
-		return "commands available: help, chonk <n>, echo <string>\n", nil
-	case "chonk":
-		if len(ss) < 2 {
-			return "", fmt.Errorf("chonk requires a size argument")
-		}
-		chonkSize, _ := strconv.Atoi(ss[1])
-		return handleChonker(chonkSize)
-	case "echo":
-		return fmt.Sprintf("%s\n", line), nil
-	default:
-		return fmt.Sprintf("no idea what you want\n"), nil
+// execHandler runs a non-interactive command. Output goes to stdout, errors to stderr,
+// and the exit status tells the client how it went.
+func (a *Server) execHandler(s ssh.Session, command string) {
+	args := s.Command()
+	if command != s.RawCommand() {
+		args = strings.Fields(command)
+	}
+	if len(args) > 0 && args[0] == "scp" {
+		a.scpHandler(s, args[1:])
+		return
+	}
+	intr := &interrupter{}
+	intr.watchSignals(s, a.logger)
+	ctx, done := intr.start(s.Context())
+	if _, _, isPty := s.Pty(); isPty {
+		// With a pty Ctrl-C comes in as input rather than killing the client.
+		go intr.pumpInput(s, nil)
+	}
+	err := a.dispatch(ctx, s, args)
+	done()
+	code := exitCode(err)
+	if err != nil {
+		_, _ = fmt.Fprintf(s.Stderr(), "%s\n", err)
+	}
+	if command != s.RawCommand() {
+		a.logger.Infof("exec by %s: forced %q instead of %q, exit status %d", who(s.Context()), command, s.RawCommand(), code)
+	} else {
+		a.logger.Infof("exec by %s: %q, exit status %d", who(s.Context()), command, code)
+	}
+	err = s.Exit(code)
+	if err != nil {
+		a.logger.Debugf("sending exit status: %s", err)
 	}
 }
 
-func (a Server) checkPubKey(sshctx ssh.Context, key ssh.PublicKey) bool {
-	result := ssh.KeysEqual(key, a.pubKey)
-	a.logger.Debugf("checkPubKey result: %v", result)
-	return result
+// authDecision is what the key handler made of a key the client offered. It only
+// applies to the connection once the client has proven it holds the key.
+type authDecision struct {
+	cert    *gossh.Certificate
+	options *keyOptions
+}
+
+func (a *Server) checkPubKey(sshctx ssh.Context, key ssh.PublicKey) (authDecision, bool) {
+	if a.isKeyRevoked(key) {
+		return authDecision{}, false
+	}
+	// Going on to a pod takes a certificate for the user the bastion logs in there as.
+	if _, ok := a.routedPod(sshctx); ok {
+		a.logger.Debugf("checkPubKey: plain keys can't log in as %s", sshctx.User())
+		return authDecision{}, false
+	}
+	if ssh.KeysEqual(key, a.pubKey) {
+		a.logger.Debug("checkPubKey: the configured key")
+		return authDecision{}, true
+	}
+	for _, ak := range a.authorizedKeysFor(key, false) {
+		if err := ak.options.allows(sshctx.RemoteAddr(), time.Now()); err != nil {
+			a.logger.Debugf("checkPubKey disallowing authorized key %s: %s", ak.comment, err)
+			continue
+		}
+		a.logger.Debugf("checkPubKey allowing authorized key %s", ak.comment)
+		options := ak.options
+		return authDecision{options: &options}, true
+	}
+	a.logger.Debug("checkPubKey: no matching key")
+	return authDecision{}, false
 }
 
-func (a Server) checkCert(sshctx ssh.Context, cert *gossh.Certificate) bool {
+func (a *Server) checkCert(sshctx ssh.Context, cert *gossh.Certificate) (authDecision, bool) {
 	a.logger.Debugf("checkCert with type %s", cert.Type())
-	wctx := &gContextWrapper{sshctx}
-	_, err := a.check.Authenticate(wctx, cert)
+	if cert.CertType != gossh.UserCert {
+		a.logger.Debugf("checkCert disallowing cert: %s, not a user cert", cert.KeyId)
+		return authDecision{}, false
+	}
+	// The CA given to New has no options, the authorized_keys ones may.
+	if ssh.KeysEqual(cert.SignatureKey, a.pubKey) {
+		if a.checkCertWith(sshctx, cert, a.loginPrincipal(sshctx), nil) {
+			return authDecision{cert: cert}, true
+		}
+		return authDecision{}, false
+	}
+	for _, ca := range a.authorizedKeysFor(cert.SignatureKey, true) {
+		if err := ca.options.allows(sshctx.RemoteAddr(), time.Now()); err != nil {
+			a.logger.Debugf("checkCert skipping authority %s for %s: %s", ca.comment, cert.KeyId, err)
+			continue
+		}
+		principal := a.loginPrincipal(sshctx)
+		if len(ca.options.principals) > 0 {
+			// CheckCert takes a cert without principals for any of them, which is
+			// not what principals= means.
+			if principal = certPrincipalIn(cert, ca.options.principals); principal == "" {
+				a.logger.Debugf("checkCert skipping authority %s for %s: no principal in %v", ca.comment, cert.KeyId, ca.options.principals)
+				continue
+			}
+		}
+		options := ca.options
+		if a.checkCertWith(sshctx, cert, principal, &options) {
+			return authDecision{cert: cert, options: &options}, true
+		}
+	}
+	a.logger.Debugf("checkCert disallowing cert: %s, no authority accepts it", cert.KeyId)
+	return authDecision{}, false
+}
+
+// checkCertWith checks the cert for principal and the options of its authority.
+func (a *Server) checkCertWith(sshctx ssh.Context, cert *gossh.Certificate, principal string, options *keyOptions) bool {
+	err := a.check.CheckCert(principal, cert)
+	if err == nil {
+		err = checkCriticalOptions(cert, sshctx.RemoteAddr(), options)
+	}
 	if err != nil {
 		a.logger.Debugf("checkCert disallowing cert: %s, type %s, err: %s", cert.KeyId, cert.Type(), err)
 		return false
@@ -163,34 +363,120 @@ func (a Server) checkCert(sshctx ssh.Context, cert *gossh.Certificate) bool {
 	return true
 }
 
-func (a Server) myPubKeyHandler(sshctx ssh.Context, key ssh.PublicKey) bool {
+// certPrincipalIn returns the first principal of the cert that is in allowed, or "" if none is.
+func certPrincipalIn(cert *gossh.Certificate, allowed []string) string {
+	for _, p := range cert.ValidPrincipals {
+		for _, ok := range allowed {
+			if p == ok {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// forcedCommand returns the command the session must run instead of what the user asked for, if any.
+// It comes from the force-command option of the certificate or the command option in authorized_keys.
+func (a *Server) forcedCommand(ctx ssh.Context) string {
+	if cert, ok := ctx.Value(ctxKeyCert).(*gossh.Certificate); ok {
+		if forced, ok := cert.CriticalOptions[optForceCommand]; ok {
+			return forced
+		}
+	}
+	return sessionOptions(ctx).command
+}
+
+// myPubKeyHandler decides on a key the client offers. Clients may offer keys
+// without proving they hold them, so the decision is only kept aside under the
+// fingerprint of the key; bindAuth applies it once the key has logged in.
+func (a *Server) myPubKeyHandler(sshctx ssh.Context, key ssh.PublicKey) bool {
 	a.logger.Debugf("myPubKeyHandler with type: %s (gotype: %T)", key.Type(), key)
+	st, ok := sshctx.Value(ctxKeyConnState).(*connState)
+	if !ok {
+		return false
+	}
+	fingerprint := gossh.FingerprintSHA256(key)
+	st.mu.Lock()
+	delete(st.pending, fingerprint)
+	st.mu.Unlock()
+	var decision authDecision
 	cert, ok := key.(*gossh.Certificate)
 	if !ok {
 		a.logger.Debug("myPubKeyHandler: not a cert")
-		return a.checkPubKey(sshctx, key)
+		decision, ok = a.checkPubKey(sshctx, key)
 	} else {
 		a.logger.Debug("myPubKeyHandler: is a cert")
-		return a.checkCert(sshctx, cert)
+		decision, ok = a.checkCert(sshctx, cert)
+	}
+	if ok && !a.roomForUser(sshctx, decision) {
+		ok = false
+	}
+	if !ok {
+		a.auditAuth(sshctx, key, "rejected")
+	} else {
+		a.auditAuth(sshctx, key, "offered")
+		st.mu.Lock()
+		st.pending[fingerprint] = decision
+		st.mu.Unlock()
 	}
+	return ok
 }
 
-func handleChonker(size int) (string, error) {
-	buf := make([]byte, size+1)
-	for i := 0; i < size; i++ {
-		buf[i] = 'a'
+// bindAuth applies the decision on the key the client logged in with to the
+// connection, and forgets the decisions on the other keys it offered.
+func (a *Server) bindAuth(ctx ssh.Context, st *connState) bool {
+	key, ok := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
+	if !ok {
+		return false
+	}
+	st.mu.Lock()
+	decision, ok := st.pending[gossh.FingerprintSHA256(key)]
+	st.pending = nil
+	st.mu.Unlock()
+	if !ok {
+		return false
 	}
-	buf[size] = '\n'
-	return string(buf), nil
+	if decision.cert != nil {
+		ctx.SetValue(ctxKeyCert, decision.cert)
+	}
+	if decision.options != nil {
+		ctx.SetValue(ctxKeyOptions, decision.options)
+	}
+	a.auditAuth(ctx, key, "accepted")
+	return true
+}
+
+// handleChonker writes size bytes of 'a' and a newline, a chunk at a time,
+// so large sizes don't need large buffers and can be interrupted.
+func handleChonker(ctx context.Context, w io.Writer, size int) error {
+	chunk := bytes.Repeat([]byte{'a'}, chonkChunk)
+	for size > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := size
+		if n > chonkChunk {
+			n = chonkChunk
+		}
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return err
+		}
+		size -= n
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
 }
 
-func (a Server) userAuthorityChecker(signedWith gossh.PublicKey) bool {
+func (a *Server) userAuthorityChecker(signedWith gossh.PublicKey) bool {
 	// Gets a binary rep of the pub part of our private key.
 	a.logger.Debug("Checking user authority")
 	caPubKey := a.pubKey.Marshal()
 	if bytes.Equal(signedWith.Marshal(), caPubKey) {
 		a.logger.Debug("User authority check passed")
 		return true
+	} else if len(a.authorizedKeysFor(signedWith, true)) > 0 {
+		a.logger.Debug("User authority check passed (authorized keys)")
+		return true
 	} else {
 		a.logger.Debug("User authority check failed")
 		return false
@@ -198,6 +484,12 @@ func (a Server) userAuthorityChecker(signedWith gossh.PublicKey) bool {
 
 }
 
-func (app Server) connectionFailedCallback(conn net.Conn, err error) {
+func (app *Server) connectionFailedCallback(conn net.Conn, err error) {
 	app.logger.Warn("Connection failed: %s", err)
+	app.writeAudit(audit.Record{
+		Event:   "connection",
+		Remote:  conn.RemoteAddr().String(),
+		Fields:  audit.Fields{"result": "failed"},
+		Message: err.Error(),
+	})
 }
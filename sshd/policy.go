@@ -0,0 +1,178 @@
+package sshd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	gossh "golang.org/x/crypto/ssh"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Capability is something a role may do besides running commands.
+type Capability string
+
+const (
+	CapFileRead       Capability = "file-read"
+	CapFileWrite      Capability = "file-write"
+	CapPortForwarding Capability = "port-forwarding"
+	// CapRoute lets the user go on to the sshd of pods through the bastion.
+	CapRoute Capability = "route"
+)
+
+// Role is a set of commands and capabilities.
+type Role struct {
+	// Commands the role may run. "*" means all of them.
+	Commands     []string     `json:"commands"`
+	Capabilities []Capability `json:"capabilities"`
+	// Forward lists where the role may forward connections to, like "10.0.0.0/8:22"
+	// or "*:443". It needs the port-forwarding capability too.
+	Forward []string `json:"forward"`
+}
+
+// Policy decides what users may do, based on the roles they have. Roles come from
+// a certificate extension and from the user's principals. Without a policy, everyone
+// may do everything, except forwarding, which is up to SetForwarding, and going on
+// to pods, which no one may.
+type Policy struct {
+	// RoleExtension is the certificate extension holding a comma separated list of
+	// roles, like sshpod-role@example.com=operator. Empty turns this off.
+	RoleExtension string `json:"roleExtension"`
+	// Principals gives roles to certificate principals, and to plain keys with those
+	// principals in authorized_keys. Other plain keys get the Default roles.
+	Principals map[string][]string `json:"principals"`
+	// Default are the roles of users who get none in any other way.
+	Default []string        `json:"default"`
+	Roles   map[string]Role `json:"roles"`
+
+	forwardRules map[string][]forwardRule
+}
+
+// LoadPolicy reads a policy from a JSON file.
+func LoadPolicy(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading policy: %w", err)
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("parsing policy %s: %w", filename, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", filename, err)
+	}
+	return p, nil
+}
+
+func (p *Policy) validate() error {
+	p.forwardRules = make(map[string][]forwardRule)
+	for name, role := range p.Roles {
+		rules, err := parseForwardRules(role.Forward)
+		if err != nil {
+			return fmt.Errorf("role %s: %w", name, err)
+		}
+		p.forwardRules[name] = rules
+		for _, c := range role.Capabilities {
+			switch c {
+			case CapFileRead, CapFileWrite, CapPortForwarding, CapRoute:
+			default:
+				return fmt.Errorf("role %s: unknown capability %s", name, c)
+			}
+		}
+	}
+	check := func(roles []string, where string) error {
+		for _, r := range roles {
+			if _, ok := p.Roles[r]; !ok {
+				return fmt.Errorf("%s: unknown role %s", where, r)
+			}
+		}
+		return nil
+	}
+	for principal, roles := range p.Principals {
+		if err := check(roles, "principal "+principal); err != nil {
+			return err
+		}
+	}
+	return check(p.Default, "default")
+}
+
+// SetPolicy limits what users may do. nil lets everyone do everything.
+func (app *Server) SetPolicy(p *Policy) error {
+	if p != nil {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("policy: %w", err)
+		}
+	}
+	app.policy = p
+	return nil
+}
+
+// rolesOf returns the roles of the session's user, sorted. Roles in the certificate
+// extension that the policy doesn't know are ignored.
+func (p *Policy) rolesOf(ctx context.Context) []string {
+	set := make(map[string]bool)
+	if cert, ok := ctx.Value(ctxKeyCert).(*gossh.Certificate); ok && p.RoleExtension != "" {
+		for _, r := range strings.Split(cert.Extensions[p.RoleExtension], ",") {
+			if _, ok := p.Roles[strings.TrimSpace(r)]; ok {
+				set[strings.TrimSpace(r)] = true
+			}
+		}
+	}
+	for _, principal := range principals(ctx) {
+		for _, r := range p.Principals[principal] {
+			set[r] = true
+		}
+	}
+	if len(set) == 0 {
+		for _, r := range p.Default {
+			set[r] = true
+		}
+	}
+	roles := make([]string, 0, len(set))
+	for r := range set {
+		roles = append(roles, r)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// mayRun tells if the session's user may run the named command.
+func (a *Server) mayRun(ctx context.Context, name string) bool {
+	p := a.policy
+	if p == nil {
+		return true
+	}
+	for _, r := range p.rolesOf(ctx) {
+		for _, c := range p.Roles[r].Commands {
+			if c == "*" || c == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// may tells if the session's user has a capability.
+func (a *Server) may(ctx context.Context, capability Capability) bool {
+	p := a.policy
+	if p == nil {
+		return true
+	}
+	for _, r := range p.rolesOf(ctx) {
+		for _, c := range p.Roles[r].Capabilities {
+			if c == capability {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sessionRoles returns the roles of the session's user, for showing them.
+func (a *Server) sessionRoles(ctx context.Context) []string {
+	if a.policy == nil {
+		return nil
+	}
+	return a.policy.rolesOf(ctx)
+}
@@ -0,0 +1,348 @@
+package sshd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/perbu/sshpod/asciicast"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	recordingExt  = ".cast"
+	recordingMeta = ".json"
+)
+
+// recordingName is what the files of recordings are called, for checking names from the outside.
+var recordingName = regexp.MustCompile(`^[A-Za-z0-9._-]+\.cast$`)
+
+// unsafeUserChars are replaced when a user name goes into the name of a recording.
+var unsafeUserChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// RecordingInfo describes a recorded session.
+type RecordingInfo struct {
+	Name    string    `json:"name"`
+	User    string    `json:"user"`
+	KeyId   string    `json:"keyId,omitempty"`
+	Serial  uint64    `json:"serial,omitempty"`
+	Remote  string    `json:"remote"`
+	Command string    `json:"command,omitempty"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Active  bool      `json:"active"`
+	Bytes   int64     `json:"bytes"`
+}
+
+// recordings keeps the recorded sessions in a directory, within the retention limits.
+type recordings struct {
+	mu       sync.Mutex
+	dir      string
+	maxAge   time.Duration
+	maxBytes int64
+	active   map[string]bool
+	seq      uint64
+}
+
+// SetRecording records every terminal and command session into asciicast v2 files
+// in dir. Recordings older than maxAge go away, and so do the oldest ones when
+// together they take more than maxBytes. Zero means no limit. An empty dir turns
+// recording off.
+func (app *Server) SetRecording(dir string, maxAge time.Duration, maxBytes int64) error {
+	if dir == "" {
+		app.recordings = nil
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("recording dir: %w", err)
+	}
+	app.recordings = &recordings{dir: dir, maxAge: maxAge, maxBytes: maxBytes, active: make(map[string]bool)}
+	app.pruneRecordings()
+	app.logger.Infof("recording sessions in %s", dir)
+	return nil
+}
+
+// Recordings returns the recorded sessions, newest first.
+func (app *Server) Recordings() ([]RecordingInfo, error) {
+	r := app.recordings
+	if r == nil {
+		return nil, fmt.Errorf("recording is off")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.list()
+}
+
+// RecordingFile returns the path of the named recording.
+func (app *Server) RecordingFile(name string) (string, error) {
+	r := app.recordings
+	if r == nil {
+		return "", fmt.Errorf("recording is off")
+	}
+	if !recordingName.MatchString(name) {
+		return "", fmt.Errorf("no recording %s", name)
+	}
+	path := filepath.Join(r.dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("no recording %s", name)
+	}
+	return path, nil
+}
+
+// list reads the metadata of the recordings. Must be called with the lock held.
+func (r *recordings) list() ([]RecordingInfo, error) {
+	metas, err := filepath.Glob(filepath.Join(r.dir, "*"+recordingExt+recordingMeta))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]RecordingInfo, 0, len(metas))
+	for _, meta := range metas {
+		data, err := os.ReadFile(meta)
+		if err != nil {
+			continue
+		}
+		var info RecordingInfo
+		if err := json.Unmarshal(data, &info); err != nil || !recordingName.MatchString(info.Name) {
+			continue
+		}
+		cast, err := os.Stat(filepath.Join(r.dir, info.Name))
+		if err != nil {
+			continue
+		}
+		info.Bytes = cast.Size()
+		if info.Active && !r.active[info.Name] {
+			// We went down in the middle of it.
+			info.Active = false
+			info.End = cast.ModTime()
+		}
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Start.After(res[j].Start) })
+	return res, nil
+}
+
+// pruneRecordings removes the recordings that are past the retention limits.
+func (app *Server) pruneRecordings() {
+	r := app.recordings
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list, err := r.list()
+	if err != nil {
+		app.logger.Warnf("listing recordings: %s", err)
+		return
+	}
+	var total int64
+	full := false
+	for _, info := range list {
+		if info.Active {
+			total += info.Bytes
+			continue
+		}
+		tooOld := r.maxAge > 0 && time.Since(info.Start) > r.maxAge
+		// Once the newer recordings have used up the room, all older ones go.
+		full = full || (r.maxBytes > 0 && total+info.Bytes > r.maxBytes)
+		if !tooOld && !full {
+			total += info.Bytes
+			continue
+		}
+		path := filepath.Join(r.dir, info.Name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			app.logger.Warnf("removing recording: %s", err)
+			continue
+		}
+		_ = os.Remove(path + recordingMeta)
+		app.logger.Infof("removed recording %s of %s from %s", info.Name, info.User, info.Start.Format(time.RFC3339))
+	}
+}
+
+// sessionRecorder writes one session to its recording.
+type sessionRecorder struct {
+	mu     sync.Mutex
+	app    *Server
+	file   *os.File
+	cast   *asciicast.Writer
+	info   RecordingInfo
+	failed bool
+}
+
+// startRecording starts recording the session, if recording is on. It returns the
+// session to use in its place and a function that ends the recording.
+func (a *Server) startRecording(s ssh.Session) (ssh.Session, func()) {
+	r := a.recordings
+	if r == nil {
+		return s, func() {}
+	}
+	ctx := s.Context()
+	start := time.Now().UTC()
+	pty, winCh, isPty := s.Pty()
+	width, height := 80, 24
+	if isPty && pty.Window.Width > 0 && pty.Window.Height > 0 {
+		width, height = pty.Window.Width, pty.Window.Height
+	}
+	user := unsafeUserChars.ReplaceAllString(s.User(), "_")
+	name := fmt.Sprintf("%s-%s-%.8s-%d%s", start.Format("20060102T150405Z"), user, ctx.SessionID(),
+		atomic.AddUint64(&r.seq, 1), recordingExt)
+	info := RecordingInfo{
+		Name:    name,
+		User:    s.User(),
+		Remote:  s.RemoteAddr().String(),
+		Command: s.RawCommand(),
+		Start:   start,
+		Active:  true,
+	}
+	if cert, ok := SessionCert(ctx); ok {
+		info.KeyId, info.Serial = cert.KeyId, cert.Serial
+	}
+	f, err := os.OpenFile(filepath.Join(r.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		a.logger.Errorf("recording session of %s: %s", who(ctx), err)
+		return s, func() {}
+	}
+	env := map[string]string{"SHELL": "sshpod"}
+	if isPty {
+		env["TERM"] = pty.Term
+	}
+	cast, err := asciicast.NewWriter(f, asciicast.Header{
+		Width:   width,
+		Height:  height,
+		Command: info.Command,
+		Title:   fmt.Sprintf("%s on sshpod %d", s.User(), a.routerId),
+		Env:     env,
+		User:    info.User,
+		KeyId:   info.KeyId,
+		Remote:  info.Remote,
+	}, start)
+	if err != nil {
+		a.logger.Errorf("recording session of %s: %s", who(ctx), err)
+		_ = f.Close()
+		return s, func() {}
+	}
+	rec := &sessionRecorder{app: a, file: f, cast: cast, info: info}
+	r.mu.Lock()
+	r.active[name] = true
+	r.mu.Unlock()
+	rec.writeMeta()
+
+	rs := &recordedSession{Session: s, rec: rec, pty: pty, isPty: isPty}
+	if isPty {
+		// Resizes go to the recording on their way to whoever handles them.
+		ch := make(chan ssh.Window, 1)
+		rs.winCh = ch
+		go func() {
+			defer close(ch)
+			for win := range winCh {
+				rec.record(func() error { return rec.cast.Resize(win.Width, win.Height) })
+				ch <- win
+			}
+		}()
+	}
+	return rs, rec.finish
+}
+
+// record runs write on the recording. After the first error the recording stops.
+func (rec *sessionRecorder) record(write func() error) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.failed || rec.cast == nil {
+		return
+	}
+	if err := write(); err != nil {
+		rec.failed = true
+		rec.app.logger.Errorf("recording %s stopped: %s", rec.info.Name, err)
+	}
+}
+
+// writeMeta writes the metadata next to the recording.
+func (rec *sessionRecorder) writeMeta() {
+	data, err := json.MarshalIndent(rec.info, "", "  ")
+	if err == nil {
+		err = os.WriteFile(rec.file.Name()+recordingMeta, data, 0o600)
+	}
+	if err != nil {
+		rec.app.logger.Warnf("writing metadata of recording %s: %s", rec.info.Name, err)
+	}
+}
+
+// finish ends the recording and applies the retention limits.
+func (rec *sessionRecorder) finish() {
+	rec.mu.Lock()
+	if rec.cast == nil {
+		rec.mu.Unlock()
+		return
+	}
+	rec.info.Bytes = rec.cast.Written()
+	rec.cast = nil
+	if err := rec.file.Close(); err != nil {
+		rec.app.logger.Warnf("closing recording %s: %s", rec.info.Name, err)
+	}
+	rec.info.End = time.Now().UTC()
+	rec.info.Active = false
+	rec.writeMeta()
+	rec.mu.Unlock()
+
+	r := rec.app.recordings
+	r.mu.Lock()
+	delete(r.active, rec.info.Name)
+	r.mu.Unlock()
+	rec.app.pruneRecordings()
+}
+
+// recordedSession is a session whose input, output and resizes are recorded.
+type recordedSession struct {
+	ssh.Session
+	rec   *sessionRecorder
+	pty   ssh.Pty
+	winCh <-chan ssh.Window
+	isPty bool
+}
+
+func (rs *recordedSession) Read(p []byte) (int, error) {
+	n, err := rs.Session.Read(p)
+	if n > 0 {
+		rs.rec.record(func() error { return rs.rec.cast.Input(p[:n]) })
+	}
+	return n, err
+}
+
+func (rs *recordedSession) Write(p []byte) (int, error) {
+	n, err := rs.Session.Write(p)
+	if n > 0 {
+		rs.rec.record(func() error { return rs.rec.cast.Output(p[:n]) })
+	}
+	return n, err
+}
+
+func (rs *recordedSession) Stderr() io.ReadWriter {
+	return recordedStderr{ReadWriter: rs.Session.Stderr(), rec: rs.rec}
+}
+
+func (rs *recordedSession) Pty() (ssh.Pty, <-chan ssh.Window, bool) {
+	return rs.pty, rs.winCh, rs.isPty
+}
+
+// recordedStderr records what goes to stderr as output; the terminal shows it alike.
+type recordedStderr struct {
+	io.ReadWriter
+	rec *sessionRecorder
+}
+
+func (rs recordedStderr) Write(p []byte) (int, error) {
+	n, err := rs.ReadWriter.Write(p)
+	if n > 0 {
+		rs.rec.record(func() error { return rs.rec.cast.Output(p[:n]) })
+	}
+	return n, err
+}
+
+// recordable tells if the session should be recorded. File transfers are left out,
+// they are audited instead.
+func recordable(s ssh.Session) bool {
+	args := s.Command()
+	return len(args) == 0 || args[0] != "scp"
+}
@@ -0,0 +1,403 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	gossh "golang.org/x/crypto/ssh"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// krlMagic starts an OpenSSH key revocation list.
+const krlMagic = "SSHKRL\n\x00"
+
+// KRL section types, see PROTOCOL.krl in OpenSSH.
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+	krlSectionExtension         = 255
+
+	krlCertSerialList   = 0x20
+	krlCertSerialRange  = 0x21
+	krlCertSerialBitmap = 0x22
+	krlCertKeyId        = 0x23
+	krlCertExtension    = 0x39
+)
+
+// serialRange is an inclusive range of revoked certificate serials.
+type serialRange struct{ min, max uint64 }
+
+// certRevocations are the certificates revoked for one CA. An empty ca means any CA.
+type certRevocations struct {
+	ca      []byte
+	serials []serialRange
+	keyIds  map[string]bool
+}
+
+// revocations is what a revocation list revokes.
+type revocations struct {
+	keys    map[string]bool // public key blobs
+	sha1    map[string]bool
+	sha256  map[string]bool
+	certs   []certRevocations
+	entries int
+}
+
+// revocationList is a revocation file, read again when it changes. It is either
+// an OpenSSH KRL or a text file with one entry a line: a public key, a key
+// fingerprint (SHA256:...), serial:<n> or id:<key id>.
+type revocationList struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	revoked *revocations
+	logger  interface{ Warnf(string, ...interface{}) }
+}
+
+// SetRevocationList makes sshd refuse the keys and certificates in the file, which
+// is read again whenever it changes.
+func (app *Server) SetRevocationList(filename string) error {
+	if filename == "" {
+		app.revoked = nil
+		return nil
+	}
+	rl := &revocationList{path: filename, logger: app.logger}
+	if err := rl.reload(); err != nil {
+		return err
+	}
+	app.revoked = rl
+	app.logger.Infof("loaded %d revocations from %s", rl.revoked.entries, filename)
+	return nil
+}
+
+// reload reads the file if it has changed. Must be called with the lock held.
+func (rl *revocationList) reload() error {
+	info, err := os.Stat(rl.path)
+	if err != nil {
+		return fmt.Errorf("revocation list: %w", err)
+	}
+	if rl.revoked != nil && info.ModTime().Equal(rl.modTime) && info.Size() == rl.size {
+		return nil
+	}
+	data, err := os.ReadFile(rl.path)
+	if err != nil {
+		return fmt.Errorf("revocation list: %w", err)
+	}
+	var revoked *revocations
+	if bytes.HasPrefix(data, []byte(krlMagic)) {
+		revoked, err = parseKRL(data)
+	} else {
+		revoked, err = parseRevocationText(data)
+	}
+	if err != nil {
+		return fmt.Errorf("revocation list %s: %w", rl.path, err)
+	}
+	rl.revoked = revoked
+	rl.modTime = info.ModTime()
+	rl.size = info.Size()
+	return nil
+}
+
+// current returns the revocations, reading the file again if it has changed. If it
+// can't be read, the revocations read earlier stay in force.
+func (rl *revocationList) current() *revocations {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if err := rl.reload(); err != nil {
+		rl.logger.Warnf("%s, keeping the revocations loaded earlier", err)
+	}
+	return rl.revoked
+}
+
+func newRevocations() *revocations {
+	return &revocations{
+		keys:   make(map[string]bool),
+		sha1:   make(map[string]bool),
+		sha256: make(map[string]bool),
+	}
+}
+
+// keyRevoked tells if a plain key is revoked.
+func (r *revocations) keyRevoked(key gossh.PublicKey) bool {
+	blob := key.Marshal()
+	s1 := sha1.Sum(blob)
+	s256 := sha256.Sum256(blob)
+	return r.keys[string(blob)] || r.sha1[string(s1[:])] || r.sha256[string(s256[:])]
+}
+
+// certRevoked tells if a certificate is revoked, by serial, key id, its key or the key of its CA.
+func (r *revocations) certRevoked(cert *gossh.Certificate) bool {
+	if r.keyRevoked(cert.Key) || r.keyRevoked(cert.SignatureKey) {
+		return true
+	}
+	ca := cert.SignatureKey.Marshal()
+	for _, cr := range r.certs {
+		if len(cr.ca) > 0 && !bytes.Equal(cr.ca, ca) {
+			continue
+		}
+		if cr.keyIds[cert.KeyId] {
+			return true
+		}
+		for _, sr := range cr.serials {
+			if cert.Serial >= sr.min && cert.Serial <= sr.max {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseRevocationText parses the simple text format.
+func parseRevocationText(data []byte) (*revocations, error) {
+	r := newRevocations()
+	anyCA := certRevocations{keyIds: make(map[string]bool)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 16*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "serial:"):
+			serial, err := strconv.ParseUint(strings.TrimSpace(line[len("serial:"):]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad serial", n)
+			}
+			anyCA.serials = append(anyCA.serials, serialRange{serial, serial})
+		case strings.HasPrefix(line, "id:"):
+			anyCA.keyIds[strings.TrimSpace(line[len("id:"):])] = true
+		case strings.HasPrefix(line, "SHA256:"):
+			fp, err := decodeFingerprint(line[len("SHA256:"):])
+			if err != nil || len(fp) != sha256.Size {
+				return nil, fmt.Errorf("line %d: bad fingerprint", n)
+			}
+			r.sha256[string(fp)] = true
+		default:
+			key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			r.keys[string(key.Marshal())] = true
+		}
+		r.entries++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	r.certs = append(r.certs, anyCA)
+	return r, nil
+}
+
+// decodeFingerprint decodes the unpadded base64 of ssh-keygen -l.
+func decodeFingerprint(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(s), "="))
+}
+
+// krlReader reads the wire encoding used in KRLs.
+type krlReader struct {
+	data []byte
+	err  error
+}
+
+var errKRLShort = errors.New("truncated KRL")
+
+// errKRLUnsupported is a KRL that holds something we don't know, which might
+// revoke keys we would then let in.
+var errKRLUnsupported = errors.New("unsupported KRL")
+
+func (k *krlReader) byte() byte {
+	if k.err != nil || len(k.data) < 1 {
+		k.err = errKRLShort
+		return 0
+	}
+	b := k.data[0]
+	k.data = k.data[1:]
+	return b
+}
+
+func (k *krlReader) uint32() uint32 {
+	if k.err != nil || len(k.data) < 4 {
+		k.err = errKRLShort
+		return 0
+	}
+	v := binary.BigEndian.Uint32(k.data)
+	k.data = k.data[4:]
+	return v
+}
+
+func (k *krlReader) uint64() uint64 {
+	if k.err != nil || len(k.data) < 8 {
+		k.err = errKRLShort
+		return 0
+	}
+	v := binary.BigEndian.Uint64(k.data)
+	k.data = k.data[8:]
+	return v
+}
+
+func (k *krlReader) string() []byte {
+	n := k.uint32()
+	if k.err != nil || uint64(len(k.data)) < uint64(n) {
+		k.err = errKRLShort
+		return nil
+	}
+	s := k.data[:n]
+	k.data = k.data[n:]
+	return s
+}
+
+func (k *krlReader) empty() bool {
+	return k.err != nil || len(k.data) == 0
+}
+
+// parseKRL parses an OpenSSH key revocation list. The signature, if there is
+// one, is not checked; the file is trusted like the rest of the configuration.
+func parseKRL(data []byte) (*revocations, error) {
+	r := newRevocations()
+	k := &krlReader{data: data[len(krlMagic):]}
+	if v := k.uint32(); k.err == nil && v != 1 {
+		return nil, fmt.Errorf("unsupported KRL format version %d", v)
+	}
+	k.uint64() // krl version
+	k.uint64() // generated date
+	k.uint64() // flags
+	k.string() // reserved
+	k.string() // comment
+	for !k.empty() {
+		sectionType := k.byte()
+		section := &krlReader{data: k.string()}
+		if k.err != nil {
+			break
+		}
+		switch sectionType {
+		case krlSectionCertificates:
+			cr, err := parseKRLCerts(section)
+			if err != nil {
+				return nil, err
+			}
+			r.certs = append(r.certs, cr)
+			r.entries += len(cr.serials) + len(cr.keyIds)
+		case krlSectionExplicitKey, krlSectionFingerprintSHA1, krlSectionFingerprintSHA256:
+			set := r.keys
+			if sectionType == krlSectionFingerprintSHA1 {
+				set = r.sha1
+			} else if sectionType == krlSectionFingerprintSHA256 {
+				set = r.sha256
+			}
+			for !section.empty() {
+				set[string(section.string())] = true
+				r.entries++
+			}
+			if section.err != nil {
+				return nil, section.err
+			}
+		case krlSectionSignature:
+			return r, k.err
+		case krlSectionExtension:
+			if err := skipKRLExtension(section); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%w: section type %d", errKRLUnsupported, sectionType)
+		}
+	}
+	return r, k.err
+}
+
+// skipKRLExtension skips an extension, unless it is marked critical: like
+// OpenSSH, those we don't know make the KRL unusable.
+func skipKRLExtension(k *krlReader) error {
+	name := k.string()
+	critical := k.byte() != 0
+	k.string() // contents
+	if k.err != nil {
+		return k.err
+	}
+	if critical {
+		return fmt.Errorf("%w: critical extension %q", errKRLUnsupported, name)
+	}
+	return nil
+}
+
+func parseKRLCerts(k *krlReader) (certRevocations, error) {
+	cr := certRevocations{keyIds: make(map[string]bool)}
+	cr.ca = k.string()
+	k.string() // reserved
+	for !k.empty() {
+		subType := k.byte()
+		sub := &krlReader{data: k.string()}
+		if k.err != nil {
+			break
+		}
+		switch subType {
+		case krlCertSerialList:
+			for !sub.empty() {
+				s := sub.uint64()
+				cr.serials = append(cr.serials, serialRange{s, s})
+			}
+		case krlCertSerialRange:
+			cr.serials = append(cr.serials, serialRange{sub.uint64(), sub.uint64()})
+		case krlCertSerialBitmap:
+			offset := sub.uint64()
+			bitmap := new(big.Int).SetBytes(sub.string())
+			for i := 0; i < bitmap.BitLen(); i++ {
+				if bitmap.Bit(i) == 1 {
+					cr.serials = append(cr.serials, serialRange{offset + uint64(i), offset + uint64(i)})
+				}
+			}
+		case krlCertKeyId:
+			for !sub.empty() {
+				cr.keyIds[string(sub.string())] = true
+			}
+		case krlCertExtension:
+			if err := skipKRLExtension(sub); err != nil {
+				return cr, err
+			}
+		default:
+			return cr, fmt.Errorf("%w: certificate section type %#x", errKRLUnsupported, subType)
+		}
+		if sub.err != nil {
+			return cr, sub.err
+		}
+	}
+	return cr, k.err
+}
+
+// isRevoked is the CertChecker's IsRevoked.
+func (a *Server) isRevoked(cert *gossh.Certificate) bool {
+	if a.revoked == nil {
+		return false
+	}
+	if a.revoked.current().certRevoked(cert) {
+		a.logger.Warnf("refusing revoked certificate %s serial %d", cert.KeyId, cert.Serial)
+		return true
+	}
+	return false
+}
+
+// isKeyRevoked tells if a plain public key is revoked.
+func (a *Server) isKeyRevoked(key gossh.PublicKey) bool {
+	if a.revoked == nil {
+		return false
+	}
+	if a.revoked.current().keyRevoked(key) {
+		a.logger.Warnf("refusing revoked key %s", gossh.FingerprintSHA256(key))
+		return true
+	}
+	return false
+}
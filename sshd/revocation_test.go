@@ -0,0 +1,200 @@
+package sshd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// krlString encodes b as an SSH string.
+func krlString(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+func krlUint64s(vs ...uint64) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint64(b, v)
+	}
+	return b
+}
+
+// testKRL builds a KRL with one certificates section holding the sub sections,
+// which are pairs of type and contents.
+func testKRL(ca []byte, subs ...interface{}) []byte {
+	var section []byte
+	section = append(section, krlString(ca)...)
+	section = append(section, krlString(nil)...) // reserved
+	for i := 0; i < len(subs); i += 2 {
+		section = append(section, byte(subs[i].(int)))
+		section = append(section, krlString(subs[i+1].([]byte))...)
+	}
+	b := []byte(krlMagic)
+	b = binary.BigEndian.AppendUint32(b, 1) // format version
+	b = append(b, krlUint64s(7, 1700000000, 0)...)
+	b = append(b, krlString(nil)...)               // reserved
+	b = append(b, krlString([]byte("comment"))...) // comment
+	b = append(b, krlSectionCertificates)
+	return append(b, krlString(section)...)
+}
+
+// withSection adds a section of the type to the KRL.
+func withSection(krl []byte, sectionType byte, contents []byte) []byte {
+	krl = append(krl, sectionType)
+	return append(krl, krlString(contents)...)
+}
+
+// krlExtension encodes an extension.
+func krlExtension(name string, critical bool) []byte {
+	b := krlString([]byte(name))
+	if critical {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	return append(b, krlString([]byte("contents"))...)
+}
+
+func TestParseKRL(t *testing.T) {
+	ca := []byte("ca key blob")
+	tests := []struct {
+		name    string
+		data    []byte
+		serials []serialRange
+		keyIds  []string
+		err     error
+	}{
+		{
+			name:    "serial list",
+			data:    testKRL(ca, krlCertSerialList, krlUint64s(3, 9)),
+			serials: []serialRange{{3, 3}, {9, 9}},
+		},
+		{
+			name:    "serial range",
+			data:    testKRL(ca, krlCertSerialRange, krlUint64s(10, 20)),
+			serials: []serialRange{{10, 20}},
+		},
+		{
+			name:    "several ranges",
+			data:    testKRL(ca, krlCertSerialRange, krlUint64s(1, 2), krlCertSerialRange, krlUint64s(5, 1<<40)),
+			serials: []serialRange{{1, 2}, {5, 1 << 40}},
+		},
+		{
+			name:    "bitmap",
+			data:    testKRL(ca, krlCertSerialBitmap, append(krlUint64s(100), krlString([]byte{0x02, 0x01})...)),
+			serials: []serialRange{{100, 100}, {109, 109}},
+		},
+		{
+			name:    "bitmap with leading zero",
+			data:    testKRL(ca, krlCertSerialBitmap, append(krlUint64s(0), krlString([]byte{0x00, 0x80})...)),
+			serials: []serialRange{{7, 7}},
+		},
+		{
+			name:   "key ids",
+			data:   testKRL(ca, krlCertKeyId, append(krlString([]byte("alice")), krlString([]byte("bob"))...)),
+			keyIds: []string{"alice", "bob"},
+		},
+		{
+			name: "unknown sub section",
+			data: testKRL(ca, 0x7f, []byte("whatever")),
+			err:  errKRLUnsupported,
+		},
+		{
+			name:    "certificate extension",
+			data:    testKRL(ca, krlCertExtension, krlExtension("later@example.com", false), krlCertSerialList, krlUint64s(3)),
+			serials: []serialRange{{3, 3}},
+		},
+		{
+			name: "critical certificate extension",
+			data: testKRL(ca, krlCertExtension, krlExtension("later@example.com", true), krlCertSerialList, krlUint64s(3)),
+			err:  errKRLUnsupported,
+		},
+		{
+			name:    "extension",
+			data:    withSection(testKRL(ca, krlCertSerialList, krlUint64s(3)), krlSectionExtension, krlExtension("later@example.com", false)),
+			serials: []serialRange{{3, 3}},
+		},
+		{
+			name: "critical extension",
+			data: withSection(testKRL(ca, krlCertSerialList, krlUint64s(3)), krlSectionExtension, krlExtension("later@example.com", true)),
+			err:  errKRLUnsupported,
+		},
+		{
+			name: "unknown section",
+			data: withSection(testKRL(ca, krlCertSerialList, krlUint64s(3)), 6, []byte("whatever")),
+			err:  errKRLUnsupported,
+		},
+		{
+			name: "truncated extension",
+			data: withSection(testKRL(ca), krlSectionExtension, krlString([]byte("later@example.com"))),
+			err:  errKRLShort,
+		},
+		{
+			name: "truncated range",
+			data: testKRL(ca, krlCertSerialRange, krlUint64s(10)),
+			err:  errKRLShort,
+		},
+		{
+			name: "truncated serial list",
+			data: testKRL(ca, krlCertSerialList, krlUint64s(3)[:5]),
+			err:  errKRLShort,
+		},
+		{
+			name: "truncated bitmap",
+			data: testKRL(ca, krlCertSerialBitmap, append(krlUint64s(100), 0, 0, 0, 9, 1)),
+			err:  errKRLShort,
+		},
+		{
+			name: "truncated section",
+			data: testKRL(ca, krlCertSerialRange, krlUint64s(10, 20))[:60],
+			err:  errKRLShort,
+		},
+		{
+			name: "truncated header",
+			data: testKRL(ca)[:len(krlMagic)+10],
+			err:  errKRLShort,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseKRL(tt.data)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(r.certs) != 1 {
+				t.Fatalf("got %d certificate sections, want 1", len(r.certs))
+			}
+			cr := r.certs[0]
+			if !bytes.Equal(cr.ca, ca) {
+				t.Errorf("ca is %q, want %q", cr.ca, ca)
+			}
+			if !reflect.DeepEqual(cr.serials, tt.serials) {
+				t.Errorf("serials are %v, want %v", cr.serials, tt.serials)
+			}
+			if len(cr.keyIds) != len(tt.keyIds) {
+				t.Errorf("key ids are %v, want %v", cr.keyIds, tt.keyIds)
+			}
+			for _, id := range tt.keyIds {
+				if !cr.keyIds[id] {
+					t.Errorf("key id %s is missing", id)
+				}
+			}
+		})
+	}
+}
+
+func TestParseKRLVersion(t *testing.T) {
+	data := testKRL(nil)
+	binary.BigEndian.PutUint32(data[len(krlMagic):], 2)
+	if _, err := parseKRL(data); err == nil {
+		t.Fatal("accepted an unknown format version")
+	}
+}
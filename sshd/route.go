@@ -0,0 +1,237 @@
+package sshd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// routeCertLifetime is how long the certificates users go on to pods with are valid.
+const routeCertLifetime = 5 * time.Minute
+
+// routeUserPattern matches the login names that take the user on to a pod, like router-42.
+var routeUserPattern = regexp.MustCompile(`^router-(\d+)$`)
+
+// routedPod tells if the session's user logged in as router-<id> to reach a pod through the bastion.
+func (a *Server) routedPod(ctx context.Context) (int, bool) {
+	if a.bastion == nil {
+		return 0, false
+	}
+	m := routeUserPattern.FindStringSubmatch(sessionUser(ctx))
+	if m == nil {
+		return 0, false
+	}
+	routerId, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, false
+	}
+	return routerId, true
+}
+
+// loginPrincipal is the principal the user's certificate must be valid for. Users
+// going on to a pod need a certificate for the user the bastion logs in there as.
+func (a *Server) loginPrincipal(ctx ssh.Context) string {
+	if _, ok := a.routedPod(ctx); ok {
+		return a.bastion.RouteUser
+	}
+	return ctx.User()
+}
+
+// mayRoute tells if the session's user may go on to pods. Without a policy no one may.
+func (a *Server) mayRoute(ctx context.Context) bool {
+	return a.policy != nil && a.may(ctx, CapRoute)
+}
+
+// routeSigner makes a key and a short-lived certificate for the session's user to
+// log in to a pod with. It is signed by Bastion.RouteCA and keeps the key id,
+// serial, principals, extensions and critical options of the user's certificate,
+// so the pod sees the user and not the bastion. source-address was checked here
+// and is left out: on the pod the connection comes out of the tunnel.
+func (a *Server) routeSigner(ctx context.Context) (gossh.Signer, error) {
+	if a.bastion.RouteCA == nil {
+		return nil, fmt.Errorf("the bastion has no route CA to vouch for you on pods")
+	}
+	userCert, ok := ctx.Value(ctxKeyCert).(*gossh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("only certificates can go on to pods")
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	validBefore := uint64(now.Add(routeCertLifetime).Unix())
+	if userCert.ValidBefore < validBefore {
+		validBefore = userCert.ValidBefore
+	}
+	options := make(map[string]string, len(userCert.CriticalOptions))
+	for k, v := range userCert.CriticalOptions {
+		if k != optSourceAddress {
+			options[k] = v
+		}
+	}
+	extensions := make(map[string]string, len(userCert.Extensions))
+	for k, v := range userCert.Extensions {
+		extensions[k] = v
+	}
+	cert := &gossh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          userCert.Serial,
+		CertType:        gossh.UserCert,
+		KeyId:           userCert.KeyId,
+		ValidPrincipals: append([]string(nil), userCert.ValidPrincipals...),
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     validBefore,
+		Permissions:     gossh.Permissions{CriticalOptions: options, Extensions: extensions},
+	}
+	if err := cert.SignCert(rand.Reader, a.bastion.RouteCA); err != nil {
+		return nil, fmt.Errorf("signing route certificate: %w", err)
+	}
+	return gossh.NewCertSigner(cert, signer)
+}
+
+// dialPod logs in to the sshd of the pod, through the pod's tunnel, as
+// Bastion.RouteUser with a certificate made for the session's user.
+func (a *Server) dialPod(ctx context.Context, routerId int) (*gossh.Client, PodInfo, int, error) {
+	pod, port, ok := a.podForward(routerId, ServiceSSH)
+	if pod.KeyId == "" {
+		return nil, pod, 0, fmt.Errorf("router %d is not connected", routerId)
+	}
+	if !ok {
+		return nil, pod, 0, fmt.Errorf("router %d has no sshd tunnel", routerId)
+	}
+	signer, err := a.routeSigner(ctx)
+	if err != nil {
+		return nil, pod, 0, err
+	}
+	addr := net.JoinHostPort(a.bastion.BindHost, strconv.Itoa(port))
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            a.bastion.RouteUser,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: a.podHostKeyCallback(pod.KeyId),
+		Timeout:         forwardDialTimeout,
+	})
+	if err != nil {
+		return nil, pod, port, fmt.Errorf("can't reach router %d: %w", routerId, err)
+	}
+	return client, pod, port, nil
+}
+
+// podHostKeyCallback accepts the host keys the pod told us about on its tunnel,
+// or, if it told us none, the key it logged in to the tunnel with.
+func (a *Server) podHostKeyCallback(keyId string) gossh.HostKeyCallback {
+	return func(_ string, _ net.Addr, key gossh.PublicKey) error {
+		key = plainKey(key)
+		for _, k := range a.podHostKeys(keyId) {
+			if ssh.KeysEqual(plainKey(k), key) {
+				return nil
+			}
+		}
+		return fmt.Errorf("pod %s has host key %s, which it has not told us about", keyId, gossh.FingerprintSHA256(key))
+	}
+}
+
+// routeToPod proxies the session to the sshd of the pod, if the user's roles allow it.
+func (a *Server) routeToPod(s ssh.Session, routerId int) {
+	ctx := s.Context()
+	fail := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		a.audit(ctx, "route", "router %d: %s", routerId, msg)
+		_, _ = fmt.Fprintf(s.Stderr(), "%s\r\n", msg)
+		_ = s.Exit(ExitFailure)
+	}
+	if !a.mayRoute(ctx) {
+		fail("not allowed to go on to pods")
+		return
+	}
+	client, pod, port, err := a.dialPod(ctx, routerId)
+	if err != nil {
+		fail("%s", err)
+		return
+	}
+	defer client.Close()
+	go func() {
+		<-ctx.Done()
+		_ = client.Close()
+	}()
+	sess, err := client.NewSession()
+	if err != nil {
+		fail("router %d: %s", routerId, err)
+		return
+	}
+	defer sess.Close()
+	a.audit(ctx, "route", "to pod %s (router %d) via port %d", pod.KeyId, routerId, port)
+
+	for _, kv := range s.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			_ = sess.Setenv(k, v) // the pod may well refuse, like sshd does
+		}
+	}
+	if pty, winCh, isPty := s.Pty(); isPty {
+		if err := sess.RequestPty(pty.Term, pty.Window.Height, pty.Window.Width, gossh.TerminalModes{}); err != nil {
+			fail("router %d: %s", routerId, err)
+			return
+		}
+		go func() {
+			for win := range winCh {
+				_ = sess.WindowChange(win.Height, win.Width)
+			}
+		}()
+	}
+	signals := make(chan ssh.Signal, 1)
+	s.Signals(signals)
+	go func() {
+		for sig := range signals {
+			_ = sess.Signal(gossh.Signal(sig))
+		}
+	}()
+	sess.Stdout = s
+	sess.Stderr = s.Stderr()
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		fail("router %d: %s", routerId, err)
+		return
+	}
+	go func() {
+		_, _ = io.Copy(stdin, s)
+		_ = stdin.Close()
+	}()
+
+	switch {
+	case s.Subsystem() != "":
+		err = sess.RequestSubsystem(s.Subsystem())
+	case s.RawCommand() != "":
+		err = sess.Start(s.RawCommand())
+	default:
+		err = sess.Shell()
+	}
+	if err != nil {
+		fail("router %d: %s", routerId, err)
+		return
+	}
+	status := ExitOK
+	err = sess.Wait()
+	var exitErr *gossh.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		status = exitErr.ExitStatus()
+	case err != nil:
+		status = ExitFailure
+	}
+	a.audit(ctx, "route", "left pod %s (router %d), exit status %d", pod.KeyId, routerId, status)
+	_ = s.Exit(status)
+}
@@ -0,0 +1,233 @@
+package sshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSigner(t *testing.T) gossh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestRoutedPod(t *testing.T) {
+	tests := []struct {
+		user      string
+		noBastion bool
+		want      int
+		ok        bool
+		principal string
+	}{
+		{user: "router-42", want: 42, ok: true, principal: "route"},
+		{user: "router-0", want: 0, ok: true, principal: "route"},
+		{user: "router-42", noBastion: true, principal: "router-42"},
+		{user: "router-", principal: "router-"},
+		{user: "router-4x", principal: "router-4x"},
+		{user: "xrouter-42", principal: "xrouter-42"},
+		{user: "router-42 ", principal: "router-42 "},
+		{user: "router-99999999999999999999", principal: "router-99999999999999999999"},
+		{user: "alice", principal: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			a := &Server{bastion: &Bastion{RouteUser: "route"}}
+			if tt.noBastion {
+				a.bastion = nil
+			}
+			ctx := newTestContext(tt.user)
+			got, ok := a.routedPod(ctx)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("routedPod = %d, %v, want %d, %v", got, ok, tt.want, tt.ok)
+			}
+			if p := a.loginPrincipal(ctx); p != tt.principal {
+				t.Errorf("loginPrincipal = %q, want %q", p, tt.principal)
+			}
+		})
+	}
+}
+
+func TestMayRoute(t *testing.T) {
+	policy := &Policy{
+		Principals: map[string][]string{"ops": {"ops"}, "dev": {"dev"}},
+		Roles: map[string]Role{
+			"ops": {Capabilities: []Capability{CapRoute}},
+			"dev": {Capabilities: []Capability{CapPortForwarding}},
+		},
+	}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		policy     *Policy
+		principals []string
+		want       bool
+	}{
+		{name: "no policy", principals: []string{"ops"}},
+		{name: "role with route", policy: policy, principals: []string{"ops"}, want: true},
+		{name: "role without route", policy: policy, principals: []string{"dev"}},
+		{name: "one of the roles", policy: policy, principals: []string{"dev", "ops"}, want: true},
+		{name: "no role", policy: policy, principals: []string{"nobody"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Server{bastion: &Bastion{RouteUser: "route"}, policy: tt.policy}
+			ctx := newTestContext("router-42")
+			ctx.SetValue(ctxKeyCert, &gossh.Certificate{CertType: gossh.UserCert, KeyId: "alice", ValidPrincipals: tt.principals})
+			if got := a.mayRoute(ctx); got != tt.want {
+				t.Errorf("mayRoute = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteSigner(t *testing.T) {
+	ca := testSigner(t)
+	now := time.Now()
+	soon := uint64(now.Add(time.Minute).Unix())
+	tests := []struct {
+		name    string
+		noCA    bool
+		cert    *gossh.Certificate
+		err     string
+		options map[string]string
+		// before is the latest ValidBefore to expect, and not much earlier.
+		before uint64
+	}{
+		{
+			name: "long-lived certificate",
+			cert: &gossh.Certificate{
+				KeyId:           "alice",
+				Serial:          7,
+				ValidPrincipals: []string{"route", "ops"},
+				ValidBefore:     gossh.CertTimeInfinity,
+				Permissions: gossh.Permissions{
+					CriticalOptions: map[string]string{optSourceAddress: "192.0.2.0/24", "force-command": "uptime"},
+					Extensions:      map[string]string{"permit-pty": ""},
+				},
+			},
+			options: map[string]string{"force-command": "uptime"},
+			before:  uint64(now.Add(routeCertLifetime).Unix()),
+		},
+		{
+			name: "certificate about to expire",
+			cert: &gossh.Certificate{
+				KeyId:           "bob",
+				Serial:          8,
+				ValidPrincipals: []string{"route"},
+				ValidBefore:     soon,
+			},
+			options: map[string]string{},
+			before:  soon,
+		},
+		{name: "no route CA", noCA: true, cert: &gossh.Certificate{KeyId: "alice"}, err: "no route CA"},
+		{name: "plain key", err: "only certificates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Server{bastion: &Bastion{RouteUser: "route", RouteCA: ca}}
+			if tt.noCA {
+				a.bastion.RouteCA = nil
+			}
+			ctx := newTestContext("router-42")
+			if tt.cert != nil {
+				tt.cert.CertType = gossh.UserCert
+				tt.cert.Key = testSigner(t).PublicKey()
+				ctx.SetValue(ctxKeyCert, tt.cert)
+			}
+			signer, err := a.routeSigner(ctx)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			cert, ok := signer.PublicKey().(*gossh.Certificate)
+			if !ok {
+				t.Fatalf("got a %s, want a certificate", signer.PublicKey().Type())
+			}
+			checker := gossh.CertChecker{
+				IsUserAuthority:          func(auth gossh.PublicKey) bool { return ssh.KeysEqual(auth, ca.PublicKey()) },
+				SupportedCriticalOptions: []string{"force-command"},
+			}
+			if err := checker.CheckCert("route", cert); err != nil {
+				t.Errorf("the pod would refuse it: %v", err)
+			}
+			if cert.KeyId != tt.cert.KeyId || cert.Serial != tt.cert.Serial {
+				t.Errorf("got key id %q serial %d, want %q %d", cert.KeyId, cert.Serial, tt.cert.KeyId, tt.cert.Serial)
+			}
+			if !reflect.DeepEqual(cert.ValidPrincipals, tt.cert.ValidPrincipals) {
+				t.Errorf("got principals %v, want %v", cert.ValidPrincipals, tt.cert.ValidPrincipals)
+			}
+			if !reflect.DeepEqual(cert.CriticalOptions, tt.options) {
+				t.Errorf("got critical options %v, want %v", cert.CriticalOptions, tt.options)
+			}
+			if len(tt.cert.Extensions) > 0 && !reflect.DeepEqual(cert.Extensions, tt.cert.Extensions) {
+				t.Errorf("got extensions %v, want %v", cert.Extensions, tt.cert.Extensions)
+			}
+			if cert.ValidBefore > tt.before || cert.ValidBefore+5 < tt.before {
+				t.Errorf("valid before %d, want %d", cert.ValidBefore, tt.before)
+			}
+			if ssh.KeysEqual(cert.Key, tt.cert.Key) {
+				t.Errorf("the user's key went on to the pod")
+			}
+		})
+	}
+}
+
+func TestPodHostKeyCallback(t *testing.T) {
+	announced, login, other := testSigner(t), testSigner(t), testSigner(t)
+	cert := &gossh.Certificate{Key: announced.PublicKey(), CertType: gossh.HostCert, KeyId: "pod-43"}
+	if err := cert.SignCert(rand.Reader, other); err != nil {
+		t.Fatal(err)
+	}
+	a := &Server{pods: &podRegistry{conns: map[string]*podConn{
+		"s1": {keyId: "pod-42", key: login.PublicKey(), hostKeys: []gossh.PublicKey{announced.PublicKey()}},
+		"s2": {keyId: "pod-42", key: other.PublicKey()},
+		"s3": {keyId: "pod-43", key: login.PublicKey()},
+	}}}
+	tests := []struct {
+		name  string
+		keyId string
+		key   gossh.PublicKey
+		ok    bool
+	}{
+		{name: "announced", keyId: "pod-42", key: announced.PublicKey(), ok: true},
+		{name: "login key when others were announced", keyId: "pod-42", key: login.PublicKey()},
+		{name: "login key of another connection", keyId: "pod-42", key: other.PublicKey()},
+		{name: "login key when none were announced", keyId: "pod-43", key: login.PublicKey(), ok: true},
+		{name: "certificate of a login key", keyId: "pod-43", key: &gossh.Certificate{Key: login.PublicKey()}, ok: true},
+		{name: "certificate of an announced key", keyId: "pod-42", key: cert, ok: true},
+		{name: "key of another pod", keyId: "pod-43", key: announced.PublicKey()},
+		{name: "pod not connected", keyId: "pod-44", key: login.PublicKey()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.podHostKeyCallback(tt.keyId)("localhost:2222", &net.TCPAddr{}, tt.key)
+			if tt.ok && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("accepted the key")
+			}
+		})
+	}
+}
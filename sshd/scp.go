@@ -0,0 +1,450 @@
+package sshd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNotDir = errors.New("not a directory")
+
+// scp speaks the old rcp based protocol that scp uses when it runs "scp -t" (sink,
+// the client uploads) or "scp -f" (source, the client downloads) on the server.
+// Files are confined to the file transfer directory, just like with sftp.
+type scp struct {
+	app       *Server
+	ctx       ssh.Context
+	sb        sandbox
+	access    Access
+	r         *bufio.Reader
+	w         io.Writer
+	recursive bool
+	preserve  bool
+	targetDir bool
+	errors    int
+}
+
+// scpHandler serves an scp exec request. args are the arguments after "scp".
+func (a *Server) scpHandler(s ssh.Session, args []string) {
+	code := a.runScp(s, args)
+	a.logger.Infof("scp by %s: %q, exit status %d", who(s.Context()), s.RawCommand(), code)
+	if err := s.Exit(code); err != nil {
+		a.logger.Debugf("sending exit status: %s", err)
+	}
+}
+
+func (a *Server) runScp(s ssh.Session, args []string) int {
+	access := a.fileAccess(s.Context())
+	if access == AccessNone {
+		a.logger.Warnf("scp refused for %s", who(s.Context()))
+		_, _ = fmt.Fprintln(s.Stderr(), "file transfer is not available")
+		return ExitFailure
+	}
+	t := &scp{
+		app:    a,
+		ctx:    s.Context(),
+		sb:     sandbox{root: a.fileTransfer.Root},
+		access: access,
+		r:      bufio.NewReader(s),
+		w:      s,
+	}
+	var sink, source bool
+	var paths []string
+	for i, arg := range args {
+		if arg == "--" {
+			paths = append(paths, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			paths = append(paths, arg)
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				sink = true
+			case 'f':
+				source = true
+			case 'r':
+				t.recursive = true
+			case 'p':
+				t.preserve = true
+			case 'd':
+				// The client sends several files, the target must be a directory.
+				t.targetDir = true
+			case 'v':
+			default:
+				_, _ = fmt.Fprintf(s.Stderr(), "scp: unsupported option -%c\n", flag)
+				return ExitUsage
+			}
+		}
+	}
+	if sink == source || len(paths) == 0 || (sink && len(paths) != 1) {
+		_, _ = fmt.Fprintln(s.Stderr(), "usage: scp -t|-f [-r] [-p] path")
+		return ExitUsage
+	}
+	var err error
+	if sink {
+		err = t.sink(paths[0])
+	} else {
+		err = t.source(paths)
+	}
+	if err != nil {
+		a.logger.Warnf("scp for %s: %s", s.User(), err)
+		_ = t.fatal(err)
+		return ExitFailure
+	}
+	if t.errors > 0 {
+		return ExitFailure
+	}
+	return ExitOK
+}
+
+// ack tells the other side to go on.
+func (t *scp) ack() error {
+	_, err := t.w.Write([]byte{0})
+	return err
+}
+
+// warn reports an error the transfer survives. Paths on disk are kept from the client.
+func (t *scp) warn(err error) error {
+	t.errors++
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		err = errors.New(strings.Replace(err.Error(), pe.Error(), pe.Err.Error(), 1))
+	}
+	_, werr := fmt.Fprintf(t.w, "\x01scp: %s\n", err)
+	return werr
+}
+
+// fatal reports an error that ends the transfer.
+func (t *scp) fatal(err error) error {
+	_, werr := fmt.Fprintf(t.w, "\x02scp: %s\n", err)
+	return werr
+}
+
+// readAck waits for the other side to acknowledge.
+func (t *scp) readAck() error {
+	b, err := t.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := t.r.ReadString('\n')
+	return fmt.Errorf("remote: %s", strings.TrimSpace(msg))
+}
+
+// resolve maps a client path onto disk, hiding what the error was if it tried to escape.
+func (t *scp) resolve(p string) (string, error) {
+	full, err := t.sb.resolve(p)
+	if errors.Is(err, errPermission) {
+		return "", fmt.Errorf("%s: %w", p, errPermission)
+	}
+	return full, err
+}
+
+// sink receives files from the client into target.
+func (t *scp) sink(target string) error {
+	if t.access < AccessReadWrite {
+		return errPermission
+	}
+	full, err := t.resolve(target)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(full)
+	targetIsDir := err == nil && info.IsDir()
+	if t.targetDir && !targetIsDir {
+		if err == nil {
+			err = errNotDir
+		}
+		// Like OpenSSH, refuse the whole transfer before it starts.
+		return t.warn(fmt.Errorf("%s: %w", target, err))
+	}
+	if err := t.ack(); err != nil {
+		return err
+	}
+	var dirs []string
+	// received counts the entries for the target itself, a file can only take one.
+	received := 0
+	var times []time.Time
+	for {
+		line, err := t.r.ReadString('\n')
+		if err == io.EOF && line == "" && len(dirs) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fmt.Errorf("protocol error: empty line")
+		}
+		switch line[0] {
+		case 1:
+			// The client couldn't read one of its files.
+			t.app.logger.Warnf("scp from %s: %s", t.ctx.User(), line[1:])
+			t.errors++
+			continue
+		case 2:
+			return fmt.Errorf("remote: %s", line[1:])
+		case 'T':
+			var mtime, mus, atime, aus int64
+			if _, err := fmt.Sscanf(line, "T%d %d %d %d", &mtime, &mus, &atime, &aus); err != nil {
+				return fmt.Errorf("protocol error: bad times '%s'", line)
+			}
+			times = []time.Time{time.Unix(atime, 0), time.Unix(mtime, 0)}
+			if err := t.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'E':
+			if len(dirs) == 0 {
+				return fmt.Errorf("protocol error: unexpected end of directory")
+			}
+			dirs = dirs[:len(dirs)-1]
+			if err := t.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'C', 'D':
+		default:
+			return fmt.Errorf("protocol error: unknown message '%s'", line)
+		}
+
+		mode, size, name, err := parseScpEntry(line)
+		if err != nil {
+			return err
+		}
+		dest := full
+		if len(dirs) > 0 {
+			dest = filepath.Join(dirs[len(dirs)-1], name)
+		} else if targetIsDir {
+			dest = filepath.Join(full, name)
+		} else {
+			received++
+			if received > 1 {
+				// A second entry would overwrite the first, refusing it makes the client skip it.
+				if err := t.warn(fmt.Errorf("%s: %w", target, errNotDir)); err != nil {
+					return err
+				}
+				if line[0] == 'D' {
+					return fmt.Errorf("%s: %w", target, errNotDir)
+				}
+				times = nil
+				continue
+			}
+		}
+		// The name may be an existing link leading out of the sandbox.
+		dest, err = t.resolve(t.sb.clientPath(dest))
+		if err != nil {
+			if err := t.warn(err); err != nil {
+				return err
+			}
+			if line[0] == 'D' {
+				// Its contents would follow, the client can't recover from this.
+				return fmt.Errorf("%s: %w", name, errPermission)
+			}
+			times = nil
+			continue
+		}
+		if line[0] == 'D' {
+			if !t.recursive {
+				return fmt.Errorf("received directory %s without -r", name)
+			}
+			if err := os.Mkdir(dest, mode|0o700); err != nil && !os.IsExist(err) {
+				return err
+			}
+			if info, err := os.Stat(dest); err != nil || !info.IsDir() {
+				return fmt.Errorf("%s: not a directory", t.sb.clientPath(dest))
+			}
+			if times != nil {
+				_ = os.Chtimes(dest, times[0], times[1])
+				times = nil
+			}
+			dirs = append(dirs, dest)
+			if err := t.ack(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := t.receive(dest, mode, size, times); err != nil {
+			return err
+		}
+		times = nil
+	}
+}
+
+// receive reads one file of size bytes from the client into dest.
+func (t *scp) receive(dest string, mode os.FileMode, size int64, times []time.Time) error {
+	fh, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		// Refusing the file before the data makes the client skip it.
+		return t.warn(fmt.Errorf("%s: %w", t.sb.clientPath(dest), err))
+	}
+	if err := t.ack(); err != nil {
+		fh.Close()
+		return err
+	}
+	n, err := io.CopyN(fh, t.r, size)
+	cerr := fh.Close()
+	t.app.auditFields(t.ctx, "scp", transferFields("upload", t.sb.clientPath(dest), n), "upload %s (%d bytes)", t.sb.clientPath(dest), n)
+	if err != nil {
+		return err
+	}
+	if err := t.readAck(); err != nil {
+		return err
+	}
+	if cerr != nil {
+		return t.warn(fmt.Errorf("%s: %w", t.sb.clientPath(dest), cerr))
+	}
+	if times != nil {
+		_ = os.Chtimes(dest, times[0], times[1])
+	}
+	return t.ack()
+}
+
+// parseScpEntry parses a "C0644 12 name" or "D0755 0 name" line.
+func parseScpEntry(line string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(line[1:], " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("protocol error: bad entry '%s'", line)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("protocol error: bad mode in '%s'", line)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("protocol error: bad size in '%s'", line)
+	}
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return 0, 0, "", fmt.Errorf("protocol error: bad file name '%s'", name)
+	}
+	return os.FileMode(mode).Perm(), size, name, nil
+}
+
+// source sends the files matching paths to the client.
+func (t *scp) source(paths []string) error {
+	if err := t.readAck(); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		matches := []string{p}
+		if strings.ContainsAny(p, "*?[") {
+			// There is no shell on our side to expand the wildcards.
+			full, err := t.resolve(path.Dir(path.Clean("/" + p)))
+			if err == nil {
+				matches, err = filepath.Glob(filepath.Join(full, path.Base(p)))
+			}
+			if err != nil || len(matches) == 0 {
+				if err := t.warn(fmt.Errorf("%s: no match", p)); err != nil {
+					return err
+				}
+				continue
+			}
+			for i := range matches {
+				matches[i] = t.sb.clientPath(matches[i])
+			}
+		}
+		for _, m := range matches {
+			full, err := t.resolve(m)
+			if err == nil {
+				err = t.send(full, path.Base(m))
+			} else {
+				err = t.warn(err)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// send sends a file or, when recursive, a directory, as name.
+func (t *scp) send(full, name string) error {
+	info, err := os.Stat(full)
+	if err != nil {
+		return t.warn(fmt.Errorf("%s: %w", t.sb.clientPath(full), err))
+	}
+	if info.IsDir() && !t.recursive {
+		return t.warn(fmt.Errorf("%s: is a directory", t.sb.clientPath(full)))
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return t.warn(fmt.Errorf("%s: not a regular file", t.sb.clientPath(full)))
+	}
+	if t.preserve {
+		if _, err := fmt.Fprintf(t.w, "T%d 0 %d 0\n", info.ModTime().Unix(), info.ModTime().Unix()); err != nil {
+			return err
+		}
+		if err := t.readAck(); err != nil {
+			return err
+		}
+	}
+	if info.IsDir() {
+		return t.sendDir(full, name, info)
+	}
+	fh, err := os.Open(full)
+	if err != nil {
+		return t.warn(fmt.Errorf("%s: %w", t.sb.clientPath(full), err))
+	}
+	defer fh.Close()
+	if _, err := fmt.Fprintf(t.w, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), name); err != nil {
+		return err
+	}
+	if err := t.readAck(); err != nil {
+		return err
+	}
+	n, err := io.CopyN(t.w, fh, info.Size())
+	t.app.auditFields(t.ctx, "scp", transferFields("download", t.sb.clientPath(full), n), "download %s (%d bytes)", t.sb.clientPath(full), n)
+	if err != nil {
+		// The size was promised, so the stream can't be fixed up.
+		return err
+	}
+	if err := t.ack(); err != nil {
+		return err
+	}
+	return t.readAck()
+}
+
+func (t *scp) sendDir(full, name string, info os.FileInfo) error {
+	if _, err := fmt.Fprintf(t.w, "D%04o 0 %s\n", info.Mode().Perm(), name); err != nil {
+		return err
+	}
+	if err := t.readAck(); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(full)
+	if err != nil {
+		if err := t.warn(fmt.Errorf("%s: %w", t.sb.clientPath(full), err)); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		child, err := t.resolve(t.sb.clientPath(filepath.Join(full, e.Name())))
+		if err == nil {
+			err = t.send(child, e.Name())
+		} else {
+			err = t.warn(err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(t.w, "E\n"); err != nil {
+		return err
+	}
+	return t.readAck()
+}
@@ -0,0 +1,350 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	log "github.com/celerway/chainsaw"
+	"github.com/gliderlabs/ssh"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testContext is an ssh.Context for a session that was never made.
+type testContext struct {
+	context.Context
+	sync.Mutex
+	values map[interface{}]interface{}
+}
+
+func newTestContext(user string) *testContext {
+	ctx := &testContext{Context: context.Background(), values: make(map[interface{}]interface{})}
+	ctx.SetValue(ssh.ContextKeyUser, user)
+	return ctx
+}
+
+func (c *testContext) Value(key interface{}) interface{} {
+	if v, ok := c.values[key]; ok {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+func (c *testContext) SetValue(key, value interface{}) { c.values[key] = value }
+func (c *testContext) User() string                    { return c.values[ssh.ContextKeyUser].(string) }
+func (c *testContext) SessionID() string               { return "test" }
+func (c *testContext) ClientVersion() string           { return "SSH-2.0-test" }
+func (c *testContext) ServerVersion() string           { return "SSH-2.0-test" }
+func (c *testContext) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+}
+func (c *testContext) LocalAddr() net.Addr           { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 22} }
+func (c *testContext) Permissions() *ssh.Permissions { return &ssh.Permissions{} }
+
+// testScp sets up an scp transfer into the sandbox of testSandbox, reading input
+// from the client.
+func testScp(t *testing.T, input string) (*scp, *bytes.Buffer, sandbox, string) {
+	t.Helper()
+	sb, outside := testSandbox(t)
+	out := &bytes.Buffer{}
+	return &scp{
+		app:    &Server{logger: log.MakeLogger("test")},
+		ctx:    newTestContext("alice"),
+		sb:     sb,
+		access: AccessReadWrite,
+		r:      bufio.NewReader(strings.NewReader(input)),
+		w:      out,
+	}, out, sb, outside
+}
+
+func TestParseScpEntry(t *testing.T) {
+	tests := []struct {
+		line string
+		mode os.FileMode
+		size int64
+		name string
+		err  string
+	}{
+		{line: "C0644 12 notes.txt", mode: 0o644, size: 12, name: "notes.txt"},
+		{line: "D0755 0 dir", mode: 0o755, name: "dir"},
+		{line: "C0644 1 two words", mode: 0o644, size: 1, name: "two words"},
+		{line: "C4755 1 setuid", mode: 0o755, size: 1, name: "setuid"},
+		{line: "C0644 12", err: "bad entry"},
+		{line: "C0x44 1 a", err: "bad mode"},
+		{line: "C0648 1 a", err: "bad mode"},
+		{line: "C0644 -1 a", err: "bad size"},
+		{line: "C0644 1k a", err: "bad size"},
+		{line: "C0644 1 ", err: "bad file name"},
+		{line: "C0644 1 .", err: "bad file name"},
+		{line: "C0644 1 ..", err: "bad file name"},
+		{line: "C0644 1 ../etc/passwd", err: "bad file name"},
+		{line: "C0644 1 a/b", err: "bad file name"},
+		{line: "C0644 1 a\x00b", err: "bad file name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			mode, size, name, err := parseScpEntry(tt.line)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if mode != tt.mode || size != tt.size || name != tt.name {
+				t.Errorf("got %o %d %q, want %o %d %q", mode, size, name, tt.mode, tt.size, tt.name)
+			}
+		})
+	}
+}
+
+func TestScpSink(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		targetDir bool
+		recursive bool
+		input     string
+		// files are the contents expected under the root afterwards.
+		files  map[string]string
+		out    string
+		err    string
+		errors int
+	}{
+		{
+			name:   "file into directory",
+			target: "/",
+			input:  "C0644 5 a.txt\nhello\x00",
+			files:  map[string]string{"a.txt": "hello"},
+			out:    "\x00\x00\x00",
+		},
+		{
+			name:   "file to a new name",
+			target: "/dir/b.txt",
+			input:  "C0644 5 a.txt\nhello\x00",
+			files:  map[string]string{"dir/b.txt": "hello"},
+			out:    "\x00\x00\x00",
+		},
+		{
+			name:   "over a file",
+			target: "/file",
+			input:  "C0644 3 a.txt\nnew\x00",
+			files:  map[string]string{"file": "new"},
+			out:    "\x00\x00\x00",
+		},
+		{
+			name:   "two files to one",
+			target: "/dir/b.txt",
+			input:  "C0644 5 a.txt\nhello\x00C0644 5 c.txt\n",
+			files:  map[string]string{"dir/b.txt": "hello"},
+			out:    "\x00\x00\x00\x01scp: /dir/b.txt: not a directory\n",
+			errors: 1,
+		},
+		{
+			name:      "several files to a missing directory",
+			target:    "/missing",
+			targetDir: true,
+			input:     "C0644 5 a.txt\nhello\x00",
+			out:       "\x01scp: /missing: no such file or directory\n",
+			errors:    1,
+		},
+		{
+			name:      "several files to a file",
+			target:    "/file",
+			targetDir: true,
+			input:     "C0644 5 a.txt\nhello\x00",
+			out:       "\x01scp: /file: not a directory\n",
+			errors:    1,
+		},
+		{
+			name:      "directory",
+			target:    "/",
+			recursive: true,
+			input:     "D0755 0 new\nC0644 2 x\nhi\x00E\n",
+			files:     map[string]string{"new/x": "hi"},
+			out:       "\x00\x00\x00\x00\x00",
+		},
+		{
+			name:   "directory without -r",
+			target: "/",
+			input:  "D0755 0 new\n",
+			out:    "\x00",
+			err:    "received directory new without -r",
+		},
+		{
+			name:   "times",
+			target: "/",
+			input:  "T1600000000 0 1600000000 0\nC0644 2 t\nhi\x00",
+			files:  map[string]string{"t": "hi"},
+			out:    "\x00\x00\x00\x00",
+		},
+		{
+			name:   "through a link out of the root",
+			target: "/",
+			input:  "C0644 2 out\n",
+			out:    "\x00\x01scp: /out: permission denied\n",
+			errors: 1,
+		},
+		{
+			name:   "to a link out of the root",
+			target: "/out",
+			input:  "C0644 2 a.txt\nhi\x00",
+			err:    "permission denied",
+		},
+		{
+			name:   "into a directory link out of the root",
+			target: "/outdir",
+			input:  "C0644 2 a.txt\nhi\x00",
+			err:    "permission denied",
+		},
+		{
+			name:   "climbing out",
+			target: "/",
+			input:  "C0644 2 ../a.txt\nhi\x00",
+			out:    "\x00",
+			err:    "bad file name",
+		},
+		{
+			name:   "end without directory",
+			target: "/",
+			input:  "E\n",
+			out:    "\x00",
+			err:    "unexpected end of directory",
+		},
+		{
+			name:   "unknown message",
+			target: "/",
+			input:  "X\n",
+			out:    "\x00",
+			err:    "unknown message",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, out, sb, outside := testScp(t, tt.input)
+			s.targetDir, s.recursive = tt.targetDir, tt.recursive
+			err := s.sink(tt.target)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if out.String() != tt.out {
+				t.Errorf("sent %q, want %q", out.String(), tt.out)
+			}
+			if s.errors != tt.errors {
+				t.Errorf("counted %d errors, want %d", s.errors, tt.errors)
+			}
+			for name, want := range tt.files {
+				got, err := os.ReadFile(filepath.Join(sb.root, name))
+				if err != nil || string(got) != want {
+					t.Errorf("%s holds %q (%v), want %q", name, got, err, want)
+				}
+			}
+			entries, err := os.ReadDir(outside)
+			if err != nil || len(entries) != 1 {
+				t.Errorf("the directory outside the root changed: %v %v", entries, err)
+			}
+		})
+	}
+}
+
+func TestScpSinkTimes(t *testing.T) {
+	s, _, sb, _ := testScp(t, "T1600000000 0 1600000000 0\nC0644 2 t\nhi\x00")
+	if err := s.sink("/"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(sb.root, "t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("modified %s, want %s", info.ModTime(), time.Unix(1600000000, 0))
+	}
+}
+
+func TestScpSource(t *testing.T) {
+	tests := []struct {
+		name      string
+		paths     []string
+		recursive bool
+		// input are the acknowledgements of the client.
+		input  string
+		out    string
+		errors int
+	}{
+		{
+			name:  "file",
+			paths: []string{"/file"},
+			input: "\x00\x00\x00",
+			out:   "C0644 0 file\n\x00",
+		},
+		{
+			name:  "link inside",
+			paths: []string{"/in"},
+			input: "\x00\x00\x00",
+			out:   "C0644 0 in\n\x00",
+		},
+		{
+			name:   "missing",
+			paths:  []string{"/nope"},
+			input:  "\x00",
+			out:    "\x01scp: /nope: no such file or directory\n",
+			errors: 1,
+		},
+		{
+			name:   "link outside",
+			paths:  []string{"/out"},
+			input:  "\x00",
+			out:    "\x01scp: /out: permission denied\n",
+			errors: 1,
+		},
+		{
+			name:   "wildcard through a link outside",
+			paths:  []string{"/outdir/*"},
+			input:  "\x00",
+			out:    "\x01scp: /outdir/*: no match\n",
+			errors: 1,
+		},
+		{
+			name:   "directory without -r",
+			paths:  []string{"/dir"},
+			input:  "\x00",
+			out:    "\x01scp: /dir: is a directory\n",
+			errors: 1,
+		},
+		{
+			name:      "directory",
+			paths:     []string{"/dir"},
+			recursive: true,
+			// The link in it leading out of the root is refused.
+			input:  "\x00\x00\x00\x00\x00",
+			out:    "D0755 0 dir\nC0644 0 up\n\x00\x01scp: /dir/upout: permission denied\nE\n",
+			errors: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, out, _, _ := testScp(t, tt.input)
+			s.recursive = tt.recursive
+			if err := s.source(tt.paths); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if out.String() != tt.out {
+				t.Errorf("sent %q, want %q", out.String(), tt.out)
+			}
+			if s.errors != tt.errors {
+				t.Errorf("counted %d errors, want %d", s.errors, tt.errors)
+			}
+		})
+	}
+}
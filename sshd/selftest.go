@@ -0,0 +1,48 @@
+package sshd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+type selfTestCommand struct{ app *Server }
+
+func (selfTestCommand) Name() string  { return "selftest" }
+func (selfTestCommand) Usage() string { return "selftest" }
+func (selfTestCommand) Help() string {
+	return "Shows the result of the tunnel self-test, which checks the tunnel end to end via the bastion."
+}
+
+func (c selfTestCommand) Parse(args []string) (Runner, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("selftest takes no arguments")
+	}
+	return func(_ context.Context, w io.Writer) error {
+		return c.app.handleSelfTest(w)
+	}, nil
+}
+
+// handleSelfTest shows the result of the tunnel self-test.
+func (a *Server) handleSelfTest(w io.Writer) error {
+	if a.monitor == nil {
+		return fmt.Errorf("no tunnel monitor configured")
+	}
+	st := a.monitor.SelfTest()
+	if !st.Enabled {
+		_, err := io.WriteString(w, "self-test disabled\n")
+		return err
+	}
+	if st.LastRun.IsZero() {
+		_, err := fmt.Fprintf(w, "self-test of port %d has not run yet\n", st.Port)
+		return err
+	}
+	result := "ok"
+	if !st.LastOK {
+		result = "FAILED: " + st.Error
+	}
+	_, err := fmt.Fprintf(w, "self-test of port %d at %s: %s (%.1f ms)\npassed %d, failed %d, %d failures in a row\n",
+		st.Port, st.LastRun.Format(time.RFC3339), result, st.Latency, st.Passed, st.Failed, st.Failures)
+	return err
+}
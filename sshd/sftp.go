@@ -0,0 +1,284 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sftpHandler serves the sftp subsystem, confined to the file transfer directory.
+func (a *Server) sftpHandler(s ssh.Session) {
+	defer s.Close()
+	if forced := a.forcedCommand(s.Context()); forced != "" {
+		// Like OpenSSH, a forced command replaces the subsystem too.
+		a.execHandler(s, forced)
+		return
+	}
+	if routerId, ok := a.routedPod(s.Context()); ok {
+		a.routeToPod(s, routerId)
+		return
+	}
+	access := a.fileAccess(s.Context())
+	if access == AccessNone {
+		a.logger.Warnf("sftp refused for %s", who(s.Context()))
+		_, _ = fmt.Fprintln(s.Stderr(), "file transfer is not available")
+		_ = s.Exit(ExitFailure)
+		return
+	}
+	files := &sftpFiles{
+		app:    a,
+		ctx:    s.Context(),
+		sb:     sandbox{root: a.fileTransfer.Root},
+		access: access,
+	}
+	a.audit(s.Context(), "sftp", "session started (%s)", access)
+	server := sftp.NewRequestServer(s, sftp.Handlers{
+		FileGet:  files,
+		FilePut:  files,
+		FileCmd:  files,
+		FileList: files,
+	})
+	err := server.Serve()
+	if err != nil && !errors.Is(err, io.EOF) {
+		a.logger.Warnf("sftp session for %s: %s", s.User(), err)
+	}
+	_ = server.Close()
+	a.audit(s.Context(), "sftp", "session ended")
+}
+
+// sftpFiles implements the sftp request handlers on top of a sandbox.
+type sftpFiles struct {
+	app    *Server
+	ctx    ssh.Context
+	sb     sandbox
+	access Access
+}
+
+// resolve checks that the user has the access needed and maps the path onto disk.
+func (f *sftpFiles) resolve(p string, need Access) (string, error) {
+	return f.check(f.sb.resolve, p, need)
+}
+
+// resolveLink is resolve for requests that act on a link rather than where it leads.
+func (f *sftpFiles) resolveLink(p string, need Access) (string, error) {
+	return f.check(f.sb.resolveLink, p, need)
+}
+
+func (f *sftpFiles) check(resolve func(string) (string, error), p string, need Access) (string, error) {
+	if f.access < need {
+		return "", sftp.ErrSSHFxPermissionDenied
+	}
+	full, err := resolve(p)
+	if errors.Is(err, errPermission) {
+		return "", sftp.ErrSSHFxPermissionDenied
+	}
+	return full, err
+}
+
+func (f *sftpFiles) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	full, err := f.resolve(r.Filepath, AccessRead)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(full)
+	if err != nil {
+		return nil, err
+	}
+	return f.track(fh, "download"), nil
+}
+
+func (f *sftpFiles) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	full, err := f.resolve(r.Filepath, AccessReadWrite)
+	if err != nil {
+		return nil, err
+	}
+	flags := os.O_WRONLY
+	pf := r.Pflags()
+	if pf.Read {
+		flags = os.O_RDWR
+	}
+	if pf.Creat {
+		flags |= os.O_CREATE
+	}
+	if pf.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pf.Excl {
+		flags |= os.O_EXCL
+	}
+	// O_APPEND is left out, the client sends offsets with every write anyway.
+	fh, err := os.OpenFile(full, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return f.track(fh, "upload"), nil
+}
+
+func (f *sftpFiles) Filecmd(r *sftp.Request) error {
+	resolve := f.resolve
+	if r.Method == "Rename" || r.Method == "Remove" || r.Method == "Rmdir" {
+		resolve = f.resolveLink
+	}
+	full, err := resolve(r.Filepath, AccessReadWrite)
+	if err != nil {
+		return err
+	}
+	switch r.Method {
+	case "Setstat":
+		err = f.setstat(full, r)
+	case "Rename":
+		var target string
+		target, err = f.resolveLink(r.Target, AccessReadWrite)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(full, target)
+		if err == nil {
+			f.app.audit(f.ctx, "sftp", "rename %s to %s", r.Filepath, r.Target)
+		}
+	case "Rmdir", "Remove":
+		var info os.FileInfo
+		info, err = os.Lstat(full)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() != (r.Method == "Rmdir") {
+			return sftp.ErrSSHFxFailure
+		}
+		err = os.Remove(full)
+		if err == nil {
+			f.app.audit(f.ctx, "sftp", "remove %s", r.Filepath)
+		}
+	case "Mkdir":
+		err = os.Mkdir(full, 0o755)
+		if err == nil {
+			f.app.audit(f.ctx, "sftp", "mkdir %s", r.Filepath)
+		}
+	case "Link", "Symlink":
+		// Links could point out of the directory, so they aren't allowed.
+		return sftp.ErrSSHFxPermissionDenied
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return err
+}
+
+func (f *sftpFiles) setstat(full string, r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.Size {
+		if err := os.Truncate(full, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(full, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(full, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			return err
+		}
+	}
+	// Ownership is left alone, the pod runs as a single user.
+	return nil
+}
+
+func (f *sftpFiles) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	full, err := f.resolve(r.Filepath, AccessRead)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(full)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			infos = append(infos, info)
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		info, err := os.Stat(full)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	case "Readlink":
+		// The path has been resolved already, so the link target is where it led.
+		return listerAt{namedInfo{name: f.sb.clientPath(full)}}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// track wraps a file so the transfer is audited with its size when the client closes it.
+func (f *sftpFiles) track(fh *os.File, direction string) *trackedFile {
+	return &trackedFile{
+		File: fh,
+		done: func(n int64) {
+			path := f.sb.clientPath(fh.Name())
+			f.app.auditFields(f.ctx, "sftp", transferFields(direction, path, n), "%s %s (%d bytes)", direction, path, n)
+		},
+	}
+}
+
+// trackedFile counts the bytes read from and written to a file.
+type trackedFile struct {
+	n int64 // first, for 64-bit alignment of the atomic operations
+	*os.File
+	once sync.Once
+	done func(n int64)
+}
+
+func (t *trackedFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := t.File.ReadAt(p, off)
+	atomic.AddInt64(&t.n, int64(n))
+	return n, err
+}
+
+func (t *trackedFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := t.File.WriteAt(p, off)
+	atomic.AddInt64(&t.n, int64(n))
+	return n, err
+}
+
+func (t *trackedFile) Close() error {
+	err := t.File.Close()
+	t.once.Do(func() { t.done(atomic.LoadInt64(&t.n)) })
+	return err
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(dst []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(dst, l[offset:])
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// namedInfo is a bare FileInfo carrying only a name, which is all Readlink returns.
+type namedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (n namedInfo) Name() string { return n.name }
@@ -0,0 +1,69 @@
+package sshd
+
+import (
+	"context"
+	"fmt"
+	"github.com/perbu/sshpod/sshmonitor"
+	"io"
+	"strconv"
+	"time"
+)
+
+type tunnelCommand struct{ app *Server }
+
+func (tunnelCommand) Name() string  { return "tunnel" }
+func (tunnelCommand) Usage() string { return "tunnel [n]" }
+func (tunnelCommand) Help() string {
+	return "Shows the tunnel state, uptime and the last n (default 20) connection attempts."
+}
+
+func (c tunnelCommand) Parse(args []string) (Runner, error) {
+	n := 20
+	if len(args) > 1 {
+		return nil, fmt.Errorf("tunnel takes at most one argument")
+	}
+	if len(args) == 1 {
+		var err error
+		n, err = strconv.Atoi(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("tunnel: bad count '%s'", args[0])
+		}
+	}
+	return func(_ context.Context, w io.Writer) error {
+		return c.app.handleTunnel(w, n)
+	}, nil
+}
+
+// handleTunnel formats the tunnel status and the last n connection attempts.
+func (a *Server) handleTunnel(w io.Writer, n int) error {
+	if a.monitor == nil {
+		return fmt.Errorf("no tunnel monitor configured")
+	}
+	st := a.monitor.Status()
+	if st.Connected {
+		fmt.Fprintf(w, "tunnel to %s up since %s\n", st.Bastion, st.Since.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(w, "tunnel down (%d attempts so far)\n", st.Attempts)
+	}
+	for _, window := range sshmonitor.UptimeWindows {
+		name := sshmonitor.WindowName(window)
+		fmt.Fprintf(w, "uptime %4s: %6.2f%%\n", name, st.Uptime[name]*100)
+	}
+	for _, c := range a.monitor.Connections() {
+		state := "down"
+		if c.Connected {
+			state = "up since " + c.Since.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "connection %d (%s, forwards %v): %s\n", c.Index, c.Class, c.Forwards, state)
+	}
+	attempts := a.monitor.History()
+	if n >= 0 && len(attempts) > n {
+		attempts = attempts[len(attempts)-n:]
+	}
+	for _, att := range attempts {
+		fmt.Fprintf(w, "%s conn %d %-20s %-9s connected %-10s %s\n",
+			att.Started.Format(time.RFC3339), att.Conn, att.Bastion, att.Phase,
+			time.Duration(att.Connected*float64(time.Second)).Round(time.Second), att.Error)
+	}
+	return nil
+}
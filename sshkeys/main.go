@@ -1,6 +1,14 @@
 package sshkeys
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
@@ -9,6 +17,9 @@ import (
 	"os"
 )
 
+// rsaBits is the size of the RSA keys GenerateKeyFile makes.
+const rsaBits = 3072
+
 // GetPrivateKey reads a private key from a file and returns a ssh.Signer
 func GetPrivateKey(fh io.Reader) (ssh.Signer, error) {
 	pemBytes, err := ioutil.ReadAll(fh)
@@ -110,3 +121,40 @@ func unmarshalCert(fh io.Reader) (*ssh.Certificate, error) {
 	}
 	return cert, nil
 }
+
+// GenerateKeyFile makes a new private key of keyType (ed25519, ecdsa or rsa) and
+// writes it to name, in PKCS#8 PEM, and its public key to name.pub.
+func GenerateKeyFile(name, keyType string) (ssh.Signer, error) {
+	var key crypto.Signer
+	var err error
+	switch keyType {
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, rsaBits)
+	default:
+		return nil, fmt.Errorf("unknown key type %s", keyType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("generating %s key: %w", keyType, err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling %s key: %w", keyType, err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create signer from private key: %w", err)
+	}
+	err = os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(name+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
@@ -0,0 +1,25 @@
+package sshmonitor
+
+import (
+	"fmt"
+	"github.com/perbu/sshpod/audit"
+)
+
+// SetAuditLog records the tunnel going up and down in the audit log.
+func (m *Monitor) SetAuditLog(l *audit.Log) {
+	m.auditLog = l
+}
+
+// audit records a change in the state of the tunnel.
+func (m *Monitor) audit(event string, fields audit.Fields, format string, args ...interface{}) {
+	err := m.auditLog.Write(audit.Record{
+		Source:  "monitor",
+		Event:   event,
+		Remote:  m.target,
+		Fields:  fields,
+		Message: fmt.Sprintf(format, args...),
+	})
+	if err != nil {
+		m.logger.Errorf("writing audit log: %s", err)
+	}
+}
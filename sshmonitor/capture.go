@@ -0,0 +1,294 @@
+package sshmonitor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/perbu/sshpod/pcapng"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCaptureBytes    = 10 << 20
+	DefaultCaptureDuration = 5 * time.Minute
+	maxCaptureBytes        = 200 << 20
+	maxCaptureDuration     = time.Hour
+	// capturesKept is how many finished captures we remember.
+	capturesKept = 20
+)
+
+// CaptureInfo describes a capture of the traffic through a forward.
+type CaptureInfo struct {
+	Port        int       `json:"port"`
+	File        string    `json:"file"`
+	Started     time.Time `json:"started"`
+	Ended       time.Time `json:"ended"`
+	Active      bool      `json:"active"`
+	Reason      string    `json:"reason,omitempty"`
+	Streams     int       `json:"streams"`
+	Bytes       int64     `json:"bytes"`
+	MaxBytes    int64     `json:"maxBytes"`
+	MaxDuration float64   `json:"maxDurationSeconds"`
+}
+
+// capture writes the streams of a single forward into a pcapng file.
+type capture struct {
+	mu    sync.Mutex
+	info  CaptureInfo
+	fh    *os.File
+	w     *pcapng.Writer
+	timer *time.Timer
+}
+
+// captureSet keeps track of the active and recently finished captures.
+type captureSet struct {
+	mu       sync.Mutex
+	dir      string
+	active   map[int]*capture
+	finished []*capture
+}
+
+func newCaptureSet() *captureSet {
+	return &captureSet{
+		active: make(map[int]*capture),
+	}
+}
+
+// SetCaptureDir sets where capture files are written. Captures are refused until this is set.
+func (m *Monitor) SetCaptureDir(dir string) {
+	m.captures.mu.Lock()
+	defer m.captures.mu.Unlock()
+	m.captures.dir = dir
+}
+
+// StartCapture starts capturing new streams through the forward of the local port.
+// The capture stops when it has written maxBytes or after maxDuration, whichever comes first.
+// Zero values give the defaults.
+func (m *Monitor) StartCapture(port int, maxBytes int64, maxDuration time.Duration) (CaptureInfo, error) {
+	if !m.hasPort(port) {
+		return CaptureInfo{}, fmt.Errorf("no forward for port %d", port)
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultCaptureBytes
+	}
+	if maxBytes > maxCaptureBytes {
+		maxBytes = maxCaptureBytes
+	}
+	if maxDuration <= 0 {
+		maxDuration = DefaultCaptureDuration
+	}
+	if maxDuration > maxCaptureDuration {
+		maxDuration = maxCaptureDuration
+	}
+	cs := m.captures
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.dir == "" {
+		return CaptureInfo{}, errors.New("capture directory not configured")
+	}
+	if _, ok := cs.active[port]; ok {
+		return CaptureInfo{}, fmt.Errorf("capture already running on port %d", port)
+	}
+	err := os.MkdirAll(cs.dir, 0o700)
+	if err != nil {
+		return CaptureInfo{}, fmt.Errorf("creating capture dir: %w", err)
+	}
+	now := time.Now()
+	name := fmt.Sprintf("fwd-%d-%s.pcapng", port, now.UTC().Format("20060102T150405Z"))
+	fh, err := os.OpenFile(filepath.Join(cs.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return CaptureInfo{}, fmt.Errorf("creating capture file: %w", err)
+	}
+	w, err := pcapng.NewWriter(fh)
+	if err != nil {
+		_ = fh.Close()
+		return CaptureInfo{}, fmt.Errorf("writing capture header: %w", err)
+	}
+	c := &capture{
+		info: CaptureInfo{
+			Port:        port,
+			File:        name,
+			Started:     now,
+			Active:      true,
+			MaxBytes:    maxBytes,
+			MaxDuration: maxDuration.Seconds(),
+		},
+		fh: fh,
+		w:  w,
+	}
+	cs.active[port] = c
+	c.timer = time.AfterFunc(maxDuration, func() {
+		m.captures.stop(c, "duration limit reached")
+	})
+	m.logger.Infof("capture of port %d started, writing to %s", port, name)
+	return c.info, nil
+}
+
+// StopCapture stops the active capture on the port.
+func (m *Monitor) StopCapture(port int) (CaptureInfo, error) {
+	m.captures.mu.Lock()
+	c, ok := m.captures.active[port]
+	m.captures.mu.Unlock()
+	if !ok {
+		return CaptureInfo{}, fmt.Errorf("no capture running on port %d", port)
+	}
+	m.captures.stop(c, "stopped")
+	m.logger.Infof("capture of port %d stopped", port)
+	return c.snapshot(), nil
+}
+
+// Captures lists active and recently finished captures.
+func (m *Monitor) Captures() []CaptureInfo {
+	cs := m.captures
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	res := make([]CaptureInfo, 0, len(cs.active)+len(cs.finished))
+	for _, c := range cs.finished {
+		res = append(res, c.snapshot())
+	}
+	for _, c := range cs.active {
+		res = append(res, c.snapshot())
+	}
+	return res
+}
+
+// CaptureFile returns the path of a known capture file. Only files listed by Captures
+// can be looked up, so the name can't be used to reach outside the capture directory.
+func (m *Monitor) CaptureFile(name string) (string, error) {
+	cs := m.captures
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, c := range cs.finished {
+		if c.info.File == name {
+			return filepath.Join(cs.dir, name), nil
+		}
+	}
+	for _, c := range cs.active {
+		if c.info.File == name {
+			return filepath.Join(cs.dir, name), nil
+		}
+	}
+	return "", fmt.Errorf("no capture named %s", name)
+}
+
+// stop ends the capture and moves it to the finished list.
+func (cs *captureSet) stop(c *capture, reason string) {
+	c.mu.Lock()
+	if !c.info.Active {
+		c.mu.Unlock()
+		return
+	}
+	c.info.Active = false
+	c.info.Ended = time.Now()
+	c.info.Reason = reason
+	c.timer.Stop()
+	_ = c.fh.Close()
+	c.mu.Unlock()
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.active[c.info.Port] == c {
+		delete(cs.active, c.info.Port)
+	}
+	cs.finished = append(cs.finished, c)
+	if len(cs.finished) > capturesKept {
+		cs.finished = cs.finished[len(cs.finished)-capturesKept:]
+	}
+}
+
+func (c *capture) snapshot() CaptureInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// stream returns a capture stream for a new connection through the port, or nil
+// if the port isn't being captured.
+func (cs *captureSet) stream(port int, src, dst net.Addr) *captureStream {
+	cs.mu.Lock()
+	c, ok := cs.active[port]
+	cs.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	if !c.info.Active {
+		c.mu.Unlock()
+		return nil
+	}
+	s, err := c.w.NewStream(tcpAddr(src), tcpAddr(dst))
+	if err != nil {
+		c.mu.Unlock()
+		cs.stop(c, "write error: "+err.Error())
+		return nil
+	}
+	c.info.Streams++
+	c.info.Bytes = c.w.Written()
+	c.mu.Unlock()
+	return &captureStream{set: cs, c: c, s: s}
+}
+
+// tcpAddr turns addr into a *net.TCPAddr, using the unspecified address if it isn't one.
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	if a, ok := addr.(*net.TCPAddr); ok && a.IP != nil {
+		return a
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// captureStream records one forwarded connection into a capture.
+type captureStream struct {
+	set *captureSet
+	c   *capture
+	s   *pcapng.Stream
+}
+
+// writer returns an io.Writer that records data sent in the given direction.
+// It never fails, so it is safe to use in an io.MultiWriter next to the real connection.
+func (cs *captureStream) writer(dir pcapng.Direction) io.Writer {
+	return captureWriter{cs: cs, dir: dir}
+}
+
+func (cs *captureStream) record(dir pcapng.Direction, p []byte) {
+	c := cs.c
+	c.mu.Lock()
+	if !c.info.Active {
+		c.mu.Unlock()
+		return
+	}
+	err := cs.s.Write(dir, p)
+	c.info.Bytes = c.w.Written()
+	full := c.info.Bytes >= c.info.MaxBytes
+	c.mu.Unlock()
+	switch {
+	case err != nil:
+		cs.set.stop(c, "write error: "+err.Error())
+	case full:
+		cs.set.stop(c, "size limit reached")
+	}
+}
+
+func (cs *captureStream) close() {
+	c := cs.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.info.Active {
+		return
+	}
+	_ = cs.s.Close()
+	c.info.Bytes = c.w.Written()
+}
+
+type captureWriter struct {
+	cs  *captureStream
+	dir pcapng.Direction
+}
+
+func (w captureWriter) Write(p []byte) (int, error) {
+	w.cs.record(w.dir, p)
+	return len(p), nil
+}
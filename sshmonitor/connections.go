@@ -0,0 +1,141 @@
+package sshmonitor
+
+import (
+	"fmt"
+	gossh "golang.org/x/crypto/ssh"
+	"sort"
+	"time"
+)
+
+// Class says what kind of traffic a forward carries. Forwards of different classes
+// can be put on separate SSH connections, so bulk transfers don't hold up interactive sessions.
+type Class string
+
+const (
+	ClassInteractive Class = "interactive"
+	ClassBulk        Class = "bulk"
+)
+
+// ParseClass parses a forward class.
+func ParseClass(s string) (Class, error) {
+	switch c := Class(s); c {
+	case ClassInteractive, ClassBulk:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown forward class '%s'", s)
+	}
+}
+
+// conn is one of the SSH connections to the bastion and the forwards it carries.
+type conn struct {
+	index int
+	class Class
+	ports []int
+	// client is the connection while it is up, guarded by the monitor's mu.
+	client *gossh.Client
+}
+
+// carries reports if the forward for the local port goes over this connection.
+func (c *conn) carries(port int) bool {
+	for _, p := range c.ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnStatus is the state of one of the SSH connections.
+type ConnStatus struct {
+	Index     int                `json:"index"`
+	Class     Class              `json:"class"`
+	Forwards  []int              `json:"forwards"`
+	Connected bool               `json:"connected"`
+	Since     time.Time          `json:"since"`
+	Uptime    map[string]float64 `json:"uptime"`
+}
+
+// SetForwardClass sets the class of the forward for the local port. Forwards are
+// interactive unless told otherwise. Must be called before Run.
+func (m *Monitor) SetForwardClass(port int, class Class) error {
+	if !m.hasPort(port) {
+		return fmt.Errorf("no forward for port %d", port)
+	}
+	m.classes[port] = class
+	return nil
+}
+
+// SetConnections sets the number of parallel SSH connections. With a single connection
+// everything shares it. With more, the first connection carries the interactive forwards
+// and the bulk forwards are spread over the rest. Must be called before Run.
+func (m *Monitor) SetConnections(n int) error {
+	if n < 1 {
+		return fmt.Errorf("need at least one connection, got %d", n)
+	}
+	m.numConns = n
+	return nil
+}
+
+// assign distributes the forwards over the connections.
+func (m *Monitor) assign() []*conn {
+	if m.numConns <= 1 {
+		return []*conn{{index: 0, class: ClassInteractive, ports: m.ports}}
+	}
+	conns := make([]*conn, m.numConns)
+	conns[0] = &conn{index: 0, class: ClassInteractive}
+	for i := 1; i < m.numConns; i++ {
+		conns[i] = &conn{index: i, class: ClassBulk}
+	}
+	bulk := 0
+	for _, p := range m.ports {
+		if m.classes[p] == ClassBulk {
+			c := conns[1+bulk%(m.numConns-1)]
+			c.ports = append(c.ports, p)
+			bulk++
+		} else {
+			conns[0].ports = append(conns[0].ports, p)
+		}
+	}
+	// Connections without forwards are not worth keeping up.
+	res := make([]*conn, 0, len(conns))
+	for _, c := range conns {
+		if len(c.ports) > 0 {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// Connections returns the state of each SSH connection.
+func (m *Monitor) Connections() []ConnStatus {
+	m.mu.Lock()
+	conns := m.conns
+	m.mu.Unlock()
+	res := make([]ConnStatus, 0, len(conns))
+	for _, c := range conns {
+		st := ConnStatus{
+			Index:    c.index,
+			Class:    c.class,
+			Forwards: append([]int(nil), c.ports...),
+			Uptime:   make(map[string]float64, len(UptimeWindows)),
+		}
+		sort.Ints(st.Forwards)
+		st.Connected, st.Since = m.history.connected(c.index)
+		for _, w := range UptimeWindows {
+			st.Uptime[WindowName(w)] = m.history.uptime(w, []int{c.index})
+		}
+		res = append(res, st)
+	}
+	return res
+}
+
+// connIndexes returns the indexes of the connections currently in use.
+func (m *Monitor) connIndexes() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]int, len(m.conns))
+	for i, c := range m.conns {
+		res[i] = c.index
+	}
+	return res
+}
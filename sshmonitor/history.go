@@ -0,0 +1,324 @@
+package sshmonitor
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// historySize is the number of attempts kept in memory for each connection, so
+// a connection that keeps failing doesn't push out what the others did.
+const historySize = 200
+
+// Phase is how far a connection attempt got before it ended.
+type Phase string
+
+const (
+	PhaseDial      Phase = "dial"
+	PhaseSession   Phase = "session"
+	PhaseShell     Phase = "shell"
+	PhaseForward   Phase = "forward"
+	PhaseConnected Phase = "connected"
+)
+
+// UptimeWindows are the sliding windows reported by Status.
+var UptimeWindows = []time.Duration{
+	time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// WindowName gives a short name for an uptime window, like "1h" or "7d".
+func WindowName(d time.Duration) string {
+	day := 24 * time.Hour
+	switch {
+	case d%day == 0:
+		return fmt.Sprintf("%dd", d/day)
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	default:
+		return d.String()
+	}
+}
+
+// Attempt is a single connection attempt against a bastion.
+type Attempt struct {
+	Started     time.Time `json:"started"`
+	Conn        int       `json:"conn"`
+	Bastion     string    `json:"bastion"`
+	Phase       Phase     `json:"phase"`
+	Error       string    `json:"error,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Ended       time.Time `json:"ended"`
+	// Connected is the time spent in PhaseConnected, in seconds.
+	Connected float64 `json:"connectedSeconds"`
+}
+
+// connectedDuration returns how long the attempt was (or has been) connected as of now.
+func (a Attempt) connectedDuration(now time.Time) time.Duration {
+	if a.ConnectedAt.IsZero() {
+		return 0
+	}
+	end := a.Ended
+	if end.IsZero() {
+		end = now
+	}
+	return end.Sub(a.ConnectedAt)
+}
+
+// Status is a summary of the tunnel state. The tunnel counts as connected when
+// all of its SSH connections are.
+type Status struct {
+	Connected bool               `json:"connected"`
+	Bastion   string             `json:"bastion"`
+	Since     time.Time          `json:"since"`
+	Attempts  int                `json:"attempts"`
+	Uptime    map[string]float64 `json:"uptime"`
+}
+
+// history keeps a bounded ring of attempts for each connection.
+type history struct {
+	mu      sync.Mutex
+	started time.Time
+	conns   map[int]*connHistory
+	size    int
+	total   int
+	last    *Attempt
+}
+
+// connHistory are the attempts of one connection, oldest first.
+type connHistory struct {
+	attempts []*Attempt
+	dropped  bool
+}
+
+func newHistory(size int) *history {
+	return &history{
+		started: time.Now(),
+		conns:   make(map[int]*connHistory),
+		size:    size,
+	}
+}
+
+// begin records the start of a new attempt and returns it.
+func (h *history) begin(bastion string, conn int) *Attempt {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	a := &Attempt{
+		Started: time.Now(),
+		Conn:    conn,
+		Bastion: bastion,
+		Phase:   PhaseDial,
+	}
+	ch := h.conns[conn]
+	if ch == nil {
+		ch = &connHistory{attempts: make([]*Attempt, 0, h.size)}
+		h.conns[conn] = ch
+	}
+	if len(ch.attempts) == h.size {
+		copy(ch.attempts, ch.attempts[1:])
+		ch.attempts = ch.attempts[:len(ch.attempts)-1]
+		ch.dropped = true
+	}
+	ch.attempts = append(ch.attempts, a)
+	h.total++
+	h.last = a
+	return a
+}
+
+// advance moves the attempt to the given phase.
+func (h *history) advance(a *Attempt, phase Phase) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	a.Phase = phase
+	if phase == PhaseConnected {
+		a.ConnectedAt = time.Now()
+	}
+}
+
+// fail records an error on the attempt. The first error wins.
+func (h *history) fail(a *Attempt, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if a.Error == "" {
+		a.Error = err.Error()
+	}
+}
+
+// end marks the attempt as finished.
+func (h *history) end(a *Attempt) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	a.Ended = time.Now()
+	a.Connected = a.connectedDuration(a.Ended).Seconds()
+}
+
+// snapshot returns a copy of the attempts of all connections, oldest first.
+func (h *history) snapshot() []Attempt {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	var res []Attempt
+	for _, ch := range h.conns {
+		for _, a := range ch.attempts {
+			c := *a
+			c.Connected = a.connectedDuration(now).Seconds()
+			res = append(res, c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Started.Equal(res[j].Started) {
+			return res[i].Started.Before(res[j].Started)
+		}
+		return res[i].Conn < res[j].Conn
+	})
+	return res
+}
+
+// interval is a period where a connection was up.
+type interval struct {
+	from, to time.Time
+}
+
+// uptime returns the fraction of the window that all the given connections were up.
+// The window is clipped to the part we have observed, that is, since
+// the monitor started or since the oldest attempt still in the history of
+// each connection.
+func (h *history) uptime(window time.Duration, conns []int) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	from := now.Add(-window)
+	observed := h.started
+	for _, c := range conns {
+		if ch := h.conns[c]; ch != nil && ch.dropped && ch.attempts[0].Started.After(observed) {
+			observed = ch.attempts[0].Started
+		}
+	}
+	if from.Before(observed) {
+		from = observed
+	}
+	span := now.Sub(from)
+	if span <= 0 || len(conns) == 0 {
+		return 0
+	}
+	up := h.intervals(conns[0], from, now)
+	for _, c := range conns[1:] {
+		up = intersect(up, h.intervals(c, from, now))
+	}
+	var total time.Duration
+	for _, iv := range up {
+		total += iv.to.Sub(iv.from)
+	}
+	return float64(total) / float64(span)
+}
+
+// intervals returns when the connection was up between from and now, oldest first.
+// Must be called with the lock held.
+func (h *history) intervals(conn int, from, now time.Time) []interval {
+	ch := h.conns[conn]
+	if ch == nil {
+		return nil
+	}
+	var res []interval
+	for _, a := range ch.attempts {
+		if a.ConnectedAt.IsZero() {
+			continue
+		}
+		start, end := a.ConnectedAt, a.Ended
+		if end.IsZero() {
+			end = now
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(start) {
+			res = append(res, interval{from: start, to: end})
+		}
+	}
+	return res
+}
+
+// intersect returns the periods covered by both a and b. Both must be sorted and non-overlapping.
+func intersect(a, b []interval) []interval {
+	var res []interval
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		from, to := a[i].from, a[i].to
+		if b[j].from.After(from) {
+			from = b[j].from
+		}
+		if b[j].to.Before(to) {
+			to = b[j].to
+		}
+		if to.After(from) {
+			res = append(res, interval{from: from, to: to})
+		}
+		if a[i].to.Before(b[j].to) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return res
+}
+
+// connected reports if the connection is up, and since when.
+func (h *history) connected(conn int) (bool, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := h.conns[conn]
+	if ch == nil || len(ch.attempts) == 0 {
+		return false, time.Time{}
+	}
+	a := ch.attempts[len(ch.attempts)-1]
+	if a.Phase == PhaseConnected && a.Ended.IsZero() {
+		return true, a.ConnectedAt
+	}
+	return false, time.Time{}
+}
+
+// status summarises the history of the given connections.
+func (h *history) status(conns []int) Status {
+	st := Status{
+		Uptime:    make(map[string]float64, len(UptimeWindows)),
+		Connected: len(conns) > 0,
+	}
+	for _, w := range UptimeWindows {
+		st.Uptime[WindowName(w)] = h.uptime(w, conns)
+	}
+	for _, c := range conns {
+		up, since := h.connected(c)
+		if !up {
+			st.Connected = false
+			st.Since = time.Time{}
+			break
+		}
+		if since.After(st.Since) {
+			st.Since = since
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st.Attempts = h.total
+	if h.last != nil {
+		st.Bastion = h.last.Bastion
+	}
+	return st
+}
+
+// History returns the recorded connection attempts, oldest first.
+func (m *Monitor) History() []Attempt {
+	return m.history.snapshot()
+}
+
+// Uptime returns the fraction (0-1) of the given window the tunnel has been up.
+func (m *Monitor) Uptime(window time.Duration) float64 {
+	return m.history.uptime(window, m.connIndexes())
+}
+
+// Status returns a summary of the tunnel state and uptime over UptimeWindows.
+func (m *Monitor) Status() Status {
+	return m.history.status(m.connIndexes())
+}
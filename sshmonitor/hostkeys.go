@@ -0,0 +1,50 @@
+package sshmonitor
+
+import (
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// HostKeysRequest tells the bastion the host keys of the sshd behind the tunnel, so
+// it can check them when it takes users there.
+const HostKeysRequest = "hostkeys@sshpod"
+
+// SetHostKeys gives the monitor the host keys of the sshd behind the tunnel. They
+// are sent to the bastion on each connection. Must be called before Run.
+func (m *Monitor) SetHostKeys(keys func() []gossh.PublicKey) {
+	m.hostKeys = keys
+}
+
+// AnnounceHostKeys sends the host keys again on the connections that are up, after
+// they have changed.
+func (m *Monitor) AnnounceHostKeys() {
+	m.mu.Lock()
+	var clients []*gossh.Client
+	for _, c := range m.conns {
+		if c.client != nil {
+			clients = append(clients, c.client)
+		}
+	}
+	m.mu.Unlock()
+	for _, client := range clients {
+		m.sendHostKeys(client)
+	}
+}
+
+// sendHostKeys tells the bastion about the host keys. Bastions that don't know
+// the request check nothing, so a refusal is no reason to give up.
+func (m *Monitor) sendHostKeys(client *gossh.Client) {
+	if m.hostKeys == nil {
+		return
+	}
+	var payload []byte
+	for _, k := range m.hostKeys() {
+		payload = append(payload, gossh.Marshal(struct{ Key []byte }{k.Marshal()})...)
+	}
+	ok, _, err := client.SendRequest(HostKeysRequest, true, payload)
+	switch {
+	case err != nil:
+		m.logger.Warnf("sending host keys: %s", err)
+	case !ok:
+		m.logger.Debugf("the bastion took no note of our host keys")
+	}
+}
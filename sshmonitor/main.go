@@ -5,10 +5,13 @@ import (
 	"fmt"
 	log "github.com/celerway/chainsaw"
 	"github.com/gliderlabs/ssh"
+	"github.com/perbu/sshpod/audit"
 	"github.com/perbu/sshpod/ctxio"
+	"github.com/perbu/sshpod/pcapng"
 	gossh "golang.org/x/crypto/ssh"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,23 +26,86 @@ func (endpoint *endPoint) String() string {
 	return fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
 }
 
-type monitor struct {
-	logger *log.CircularLogger
-	signer ssh.Signer
-	ports  []int
+// Monitor keeps a reverse tunnel to a bastion up and records how it is doing.
+type Monitor struct {
+	logger   *log.CircularLogger
+	signer   ssh.Signer
+	username string
+	target   string
+	ports    []int
+	history  *history
+	captures *captureSet
+	shaper   *shaper
+	selfTest *selfTest
+	auditLog *audit.Log
+	hostKeys func() []gossh.PublicKey
+
+	classes  map[int]Class
+	numConns int
+
+	mu          sync.Mutex
+	conns       []*conn
+	remotePorts map[int]int // local port -> port allocated on the bastion
 }
 
-// Connect sets up ssh monitor and starts an ssh connection.
-func Connect(ctx context.Context, signer ssh.Signer, username, target string, logger *log.CircularLogger, ports ...int) {
-	m := monitor{
-		logger: logger,
-		signer: signer,
-		ports:  ports,
+// New creates a monitor. Nothing happens until Run is called.
+func New(signer ssh.Signer, username, target string, logger *log.CircularLogger, ports ...int) *Monitor {
+	return &Monitor{
+		logger:   logger,
+		signer:   signer,
+		username: username,
+		target:   target,
+		ports:    ports,
+		history:  newHistory(historySize),
+		captures: newCaptureSet(),
+		shaper:   newShaper(ports),
+		selfTest: &selfTest{},
+		classes:  make(map[int]Class),
+		numConns: 1,
+
+		remotePorts: make(map[int]int),
 	}
-	for ctx.Err() == nil {
-		m.connect(ctx, target, username)
-		ctxSleep(ctx, time.Second*5)
+}
+
+// Ports returns the local ports that are forwarded.
+func (m *Monitor) Ports() []int {
+	return append([]int(nil), m.ports...)
+}
+
+// hasPort reports if the local port is one of the forwarded ones.
+func (m *Monitor) hasPort(port int) bool {
+	for _, p := range m.ports {
+		if p == port {
+			return true
+		}
 	}
+	return false
+}
+
+// Run keeps the connections to the target up, reconnecting as needed, until ctx is cancelled.
+func (m *Monitor) Run(ctx context.Context) {
+	conns := m.assign()
+	m.mu.Lock()
+	m.conns = conns
+	m.mu.Unlock()
+	wg := sync.WaitGroup{}
+	wg.Add(len(conns))
+	for _, c := range conns {
+		m.logger.Infof("connection %d (%s) carries forwards %v", c.index, c.class, c.ports)
+		go func(c *conn) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				m.connect(ctx, c, m.target, m.username)
+				ctxSleep(ctx, time.Second*5)
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+// Connect sets up ssh monitor and starts an ssh connection.
+func Connect(ctx context.Context, signer ssh.Signer, username, target string, logger *log.CircularLogger, ports ...int) {
+	New(signer, username, target, logger, ports...).Run(ctx)
 }
 
 func ctxSleep(ctx context.Context, duration time.Duration) {
@@ -54,7 +120,9 @@ func ctxSleep(ctx context.Context, duration time.Duration) {
 // connect sshs into a host (with the Signer) and registers two remote ports.
 // when ctx is cancelled then the connection is shut down and the function returns.
 // the function might also return if it encounters a serious error
-func (m monitor) connect(ctx context.Context, target, username string) {
+func (m *Monitor) connect(ctx context.Context, c *conn, target, username string) {
+	attempt := m.history.begin(target, c.index)
+	defer m.history.end(attempt)
 
 	sshConfig := &gossh.ClientConfig{
 		User: username,
@@ -68,13 +136,35 @@ func (m monitor) connect(ctx context.Context, target, username string) {
 	sshClient, err := gossh.Dial("tcp", target, sshConfig)
 	if err != nil {
 		m.logger.Errorf("Dial remote (%s) error: %s", target, err)
+		m.history.fail(attempt, err)
+		m.audit("tunnel", audit.Fields{"state": "failed", "connection": strconv.Itoa(c.index), "error": err.Error()},
+			"connection %d could not connect", c.index)
 		time.Sleep(time.Second)
 		return
 	}
-	m.logger.Infof("connected to %s, server %s", target, sshClient.ServerVersion())
+	m.logger.Infof("connection %d connected to %s, server %s", c.index, target, sshClient.ServerVersion())
+	connected := time.Now()
+	m.audit("tunnel", audit.Fields{"state": "up", "connection": strconv.Itoa(c.index), "server": string(sshClient.ServerVersion())},
+		"connection %d is up", c.index)
+	defer func() {
+		m.audit("tunnel", audit.Fields{"state": "down", "connection": strconv.Itoa(c.index),
+			"seconds": strconv.FormatFloat(time.Since(connected).Seconds(), 'f', 1, 64)},
+			"connection %d is down", c.index)
+	}()
+	m.mu.Lock()
+	c.client = sshClient
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		c.client = nil
+		m.mu.Unlock()
+	}()
+	m.sendHostKeys(sshClient)
+	m.history.advance(attempt, PhaseSession)
 	// We're connected. Let's start a shell session.
 	sess, err := sshClient.NewSession()
 	if err != nil {
+		m.history.fail(attempt, err)
 		m.logger.Fatalf("Could not start ssh session: %s", err)
 	} else {
 		m.logger.Info("Session started....")
@@ -100,8 +190,10 @@ func (m monitor) connect(ctx context.Context, target, username string) {
 	if err != nil {
 		m.logger.Fatalf("could not get the stdout pipe: %s", err)
 	}
+	m.history.advance(attempt, PhaseShell)
 	err = sess.Shell()
 	if err != nil {
+		m.history.fail(attempt, err)
 		m.logger.Fatalf("Could not start ssh shell session: %s", err)
 	}
 
@@ -132,12 +224,34 @@ func (m monitor) connect(ctx context.Context, target, username string) {
 	wg.Add(1)
 	childCtx, childCancel := context.WithCancel(ctx)
 	childWg := sync.WaitGroup{}
-	childWg.Add(len(m.ports))
-	for _, port := range m.ports {
-		go m.reverseListen(childCtx, &childWg, sshClient, port)
+	m.history.advance(attempt, PhaseForward)
+	// The tunnel is only up once every forward is bound on the bastion.
+	listeners := make(map[int]net.Listener, len(c.ports))
+	for _, port := range c.ports {
+		listener, err := m.listenRemote(sshClient, port)
+		if err != nil {
+			m.history.fail(attempt, err)
+			for p, l := range listeners {
+				_ = l.Close()
+				m.setRemotePort(p, 0)
+			}
+			childCancel()
+			_ = sshClient.Close()
+			return
+		}
+		listeners[port] = listener
+	}
+	childWg.Add(len(listeners))
+	for port, listener := range listeners {
+		go m.reverseListen(childCtx, &childWg, listener, port)
 	}
+	m.history.advance(attempt, PhaseConnected)
 	// Listen on remote server port
 	m.logger.Debug("Reverse port forwarding setup. Waiting for teardown.")
+	go m.runSelfTest(childCtx, c, sshClient, func(err error) {
+		m.history.fail(attempt, err)
+		_ = sess.Close()
+	})
 	go func() {
 		// wait for ctx to cancel.
 		<-ctx.Done()
@@ -150,6 +264,7 @@ func (m monitor) connect(ctx context.Context, target, username string) {
 		err := sess.Wait()
 		if err != nil && !strings.Contains(err.Error(), "remote command exited without exit status") {
 			m.logger.Errorf("Session wait: %s", err)
+			m.history.fail(attempt, err)
 		}
 		childCancel()
 		childWg.Wait()
@@ -162,20 +277,28 @@ func (m monitor) connect(ctx context.Context, target, username string) {
 	}
 }
 
-func (m monitor) reverseListen(ctx context.Context, wg *sync.WaitGroup, client *gossh.Client, port int) {
-	var endPoint = endPoint{
-		Host: "localhost",
-		Port: port,
-	}
-	m.logger.Debugf("Setting up reverse listen against %s", endPoint.String())
+// listenRemote binds a port on the bastion that forwards to the local port.
+func (m *Monitor) listenRemote(client *gossh.Client, port int) (net.Listener, error) {
+	m.logger.Debugf("Setting up reverse listen against localhost:%d", port)
 	listener, err := client.Listen("tcp", remoteEndpoint.String())
 	if err != nil {
 		m.logger.Errorf("Listen open port ON remote server error: %s", err)
-		return
+		return nil, fmt.Errorf("forwarding port %d: %w", port, err)
 	}
 	remotePort := getRemotePort(listener.Addr())
-	m.logger.Infof("localhost:%d -> %s:%d", port, endPoint.Host, remotePort)
+	m.setRemotePort(port, remotePort)
+	m.logger.Infof("localhost:%d -> localhost:%d", port, remotePort)
 	m.logger.Debug("listen OK")
+	return listener, nil
+}
+
+// reverseListen forwards the connections coming in on the listener to the local port.
+func (m *Monitor) reverseListen(ctx context.Context, wg *sync.WaitGroup, listener net.Listener, port int) {
+	defer wg.Done()
+	var endPoint = endPoint{
+		Host: "localhost",
+		Port: port,
+	}
 	done := false
 	go func() { // Wait for the context to be cancelled, then set done to
 		<-ctx.Done()
@@ -211,16 +334,16 @@ func (m monitor) reverseListen(ctx context.Context, wg *sync.WaitGroup, client *
 		} else {
 			m.logger.Debugf("successfully dialed %s", endPoint.String())
 			// Spin off a goroutine to handle to connection.
-			go m.handleClient(ctx, client, local)
+			go m.handleClient(ctx, client, local, port)
 		}
 	}
 	m.logger.Debug("Shutting down reverse port")
-	wg.Done()
+	m.setRemotePort(port, 0)
 }
 
-func (m monitor) handleClient(ctx context.Context, client net.Conn, remote net.Conn) {
+func (m *Monitor) handleClient(ctx context.Context, client net.Conn, remote net.Conn, port int) {
 
-	defer func(c, r net.Conn) {
+	closeConns := func(c, r net.Conn) {
 		err := c.Close()
 		if err != nil {
 			if err.Error() != "EOF" {
@@ -234,13 +357,23 @@ func (m monitor) handleClient(ctx context.Context, client net.Conn, remote net.C
 			}
 		}
 
-	}(client, remote)
+	}
+
+	var toClient, toRemote io.Writer = client, remote
+	if cs := m.captures.stream(port, client.RemoteAddr(), remote.RemoteAddr()); cs != nil {
+		m.logger.Debugf("capturing connection from %s to port %d", client.RemoteAddr(), port)
+		defer cs.close()
+		toClient = io.MultiWriter(client, cs.writer(pcapng.FromDst))
+		toRemote = io.MultiWriter(remote, cs.writer(pcapng.FromSrc))
+	}
+	toClient = m.shaper.writer(ctx, port, toClient)
+	toRemote = m.shaper.writer(ctx, port, toRemote)
 
-	chDone := make(chan bool)
+	chDone := make(chan bool, 2)
 	ctxClient := ctxio.NewReader(ctx, client)
 	ctxRemote := ctxio.NewReader(ctx, remote)
 	go func() { // Start remote -> local data transfer
-		_, err := io.Copy(client, ctxRemote)
+		_, err := io.Copy(toClient, ctxRemote)
 		if err != nil && !strings.HasSuffix(err.Error(), "use of closed network connection") {
 			m.logger.Errorf("error while copy remote->local: %s", err)
 		}
@@ -248,7 +381,7 @@ func (m monitor) handleClient(ctx context.Context, client net.Conn, remote net.C
 	}()
 
 	go func() { // Start local -> remote data transfer
-		_, err := io.Copy(remote, ctxClient)
+		_, err := io.Copy(toRemote, ctxClient)
 		if err != nil && !strings.HasSuffix(err.Error(), "use of closed network connection") {
 			m.logger.Errorf("error while copy local->remote: %s", err)
 		}
@@ -256,6 +389,28 @@ func (m monitor) handleClient(ctx context.Context, client net.Conn, remote net.C
 	}()
 	<-chDone
 	m.logger.Tracef("Closing connection")
+	// Closing the connections ends the other direction as well. It must be done
+	// before the capture stream is closed, or its last writes fail the capture.
+	closeConns(client, remote)
+	<-chDone
+}
+
+// setRemotePort records the port allocated on the bastion for a local port. 0 removes it.
+func (m *Monitor) setRemotePort(port, remotePort int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if remotePort == 0 {
+		delete(m.remotePorts, port)
+		return
+	}
+	m.remotePorts[port] = remotePort
+}
+
+// RemotePort returns the port on the bastion that forwards to the local port, or 0 if there is none.
+func (m *Monitor) RemotePort(port int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.remotePorts[port]
 }
 
 // remote forwarding port (on remote SSH server network)
@@ -0,0 +1,160 @@
+package sshmonitor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/perbu/sshpod/audit"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const selfTestTimeout = 10 * time.Second
+
+// SelfTestStatus is the result of the tunnel self-tests.
+type SelfTestStatus struct {
+	Enabled  bool      `json:"enabled"`
+	Port     int       `json:"port"`
+	LastRun  time.Time `json:"lastRun"`
+	LastOK   bool      `json:"lastOk"`
+	Error    string    `json:"error,omitempty"`
+	Latency  float64   `json:"latencyMs"`
+	Failures int       `json:"consecutiveFailures"`
+	Passed   int       `json:"passed"`
+	Failed   int       `json:"failed"`
+}
+
+type selfTest struct {
+	mu          sync.Mutex
+	port        int
+	interval    time.Duration
+	maxFailures int
+	status      SelfTestStatus
+}
+
+// SetSelfTest enables the self-test. Every interval the monitor connects to the port
+// allocated on the bastion for the local port, through the bastion, and does
+// GET /selftest on the httpd behind it. After maxFailures failures in a row
+// the connection is torn down and re-established.
+func (m *Monitor) SetSelfTest(port int, interval time.Duration, maxFailures int) {
+	m.selfTest.mu.Lock()
+	defer m.selfTest.mu.Unlock()
+	m.selfTest.port = port
+	m.selfTest.interval = interval
+	m.selfTest.maxFailures = maxFailures
+	m.selfTest.status.Enabled = interval > 0
+	m.selfTest.status.Port = port
+}
+
+// SelfTest returns the state of the self-test.
+func (m *Monitor) SelfTest() SelfTestStatus {
+	m.selfTest.mu.Lock()
+	defer m.selfTest.mu.Unlock()
+	return m.selfTest.status
+}
+
+// runSelfTest tests the tunnel every interval until ctx is cancelled. It only runs on the
+// connection that carries the self-test port. If the test keeps failing, giveUp is called
+// and the loop ends.
+func (m *Monitor) runSelfTest(ctx context.Context, c *conn, client *gossh.Client, giveUp func(error)) {
+	m.selfTest.mu.Lock()
+	port, interval, maxFailures := m.selfTest.port, m.selfTest.interval, m.selfTest.maxFailures
+	m.selfTest.mu.Unlock()
+	if interval <= 0 || !c.carries(port) {
+		return
+	}
+	m.selfTest.mu.Lock()
+	m.selfTest.status.Failures = 0
+	m.selfTest.mu.Unlock()
+	for {
+		ctxSleep(ctx, interval)
+		if ctx.Err() != nil {
+			return
+		}
+		start := time.Now()
+		err := m.selfTestOnce(ctx, client, port)
+		latency := time.Since(start)
+		if ctx.Err() != nil {
+			return
+		}
+		m.selfTest.mu.Lock()
+		st := &m.selfTest.status
+		st.LastRun = start
+		st.LastOK = err == nil
+		st.Latency = float64(latency) / float64(time.Millisecond)
+		if err == nil {
+			st.Error = ""
+			st.Failures = 0
+			st.Passed++
+		} else {
+			st.Error = err.Error()
+			st.Failures++
+			st.Failed++
+		}
+		failures := st.Failures
+		m.selfTest.mu.Unlock()
+
+		if err == nil {
+			m.logger.Debugf("self-test ok in %s", latency)
+			continue
+		}
+		m.logger.Warnf("self-test failed (%d in a row): %s", failures, err)
+		if maxFailures > 0 && failures >= maxFailures {
+			m.logger.Errorf("self-test failed %d times, reconnecting", failures)
+			m.audit("selftest", audit.Fields{"connection": strconv.Itoa(c.index), "failures": strconv.Itoa(failures), "error": err.Error()},
+				"self-test failed %d times, reconnecting", failures)
+			giveUp(fmt.Errorf("self-test failed %d times: %w", failures, err))
+			return
+		}
+	}
+}
+
+// selfTestOnce does a request to our own httpd via the bastion side of the tunnel.
+func (m *Monitor) selfTestOnce(ctx context.Context, client *gossh.Client, port int) error {
+	remotePort := m.RemotePort(port)
+	if remotePort == 0 {
+		return errors.New("no remote listener for port")
+	}
+	nonceBytes := make([]byte, 8)
+	_, _ = rand.Read(nonceBytes)
+	nonce := hex.EncodeToString(nonceBytes)
+
+	httpClient := &http.Client{
+		Timeout: selfTestTimeout,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+				return client.Dial(network, addr)
+			},
+		},
+	}
+	url := fmt.Sprintf("http://localhost:%d/selftest?nonce=%s", remotePort, nonce)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if !strings.Contains(string(body), nonce) {
+		return errors.New("response did not echo the nonce")
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package sshmonitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// minBurst is the smallest burst a bucket allows, so tiny rates still make progress.
+	minBurst = 4096
+	// meterSlots is the number of one second slots the rate meter averages over.
+	meterSlots = 5
+)
+
+// RateStatus is the shaping state of a forward, or of the whole tunnel if Port is 0.
+type RateStatus struct {
+	Port int `json:"port"`
+	// Limit is the configured limit in bytes per second. 0 means unlimited.
+	Limit int64 `json:"limit"`
+	// Rate is the measured rate in bytes per second over the last few seconds.
+	Rate float64 `json:"rate"`
+	// Throttled is true if traffic was held back during the last second.
+	Throttled bool `json:"throttled"`
+}
+
+// ParseRate parses a rate in bytes per second. It accepts a k, m or g suffix (powers of 1024).
+func ParseRate(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad rate '%s'", s)
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("rate '%s' is too large", s)
+	}
+	return n * mult, nil
+}
+
+// bucket is a token bucket counting bytes. It also meters what passes through it.
+type bucket struct {
+	mu     sync.Mutex
+	limit  int64
+	burst  float64
+	tokens float64
+	last   time.Time
+	waited time.Time
+	slots  [meterSlots]int64
+	slotAt [meterSlots]int64
+}
+
+func newBucket(limit int64) *bucket {
+	b := &bucket{last: time.Now()}
+	b.setLimit(limit)
+	return b
+}
+
+func (b *bucket) setLimit(limit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+	b.burst = float64(limit)
+	if b.burst < minBurst {
+		b.burst = minBurst
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// maxChunk is the largest write that should be passed through the bucket at once.
+func (b *bucket) maxChunk() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit == 0 {
+		return 0
+	}
+	return int(b.burst)
+}
+
+// take removes n tokens and returns how long the caller has to wait before sending.
+func (b *bucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.count(now, n)
+	if b.limit == 0 {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.limit)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	wait := time.Duration(-b.tokens / float64(b.limit) * float64(time.Second))
+	b.waited = now.Add(wait)
+	return wait
+}
+
+// count adds n bytes to the meter slot of the current second.
+func (b *bucket) count(now time.Time, n int) {
+	sec := now.Unix()
+	i := sec % meterSlots
+	if b.slotAt[i] != sec {
+		b.slotAt[i] = sec
+		b.slots[i] = 0
+	}
+	b.slots[i] += int64(n)
+}
+
+func (b *bucket) status(port int) RateStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	sec := now.Unix()
+	var total int64
+	for i := range b.slots {
+		// Skip the current, partial, second and anything that is too old.
+		if b.slotAt[i] < sec && b.slotAt[i] >= sec-meterSlots {
+			total += b.slots[i]
+		}
+	}
+	return RateStatus{
+		Port:      port,
+		Limit:     b.limit,
+		Rate:      float64(total) / meterSlots,
+		Throttled: now.Before(b.waited.Add(time.Second)),
+	}
+}
+
+// shaper holds the buckets for the tunnel and each forward. Both directions of a
+// forward draw from the same bucket, so a limit caps the traffic of the forward
+// as a whole, the way a metered link counts it.
+type shaper struct {
+	tunnel   *bucket
+	forwards map[int]*bucket
+}
+
+func newShaper(ports []int) *shaper {
+	s := &shaper{
+		tunnel:   newBucket(0),
+		forwards: make(map[int]*bucket, len(ports)),
+	}
+	for _, p := range ports {
+		s.forwards[p] = newBucket(0)
+	}
+	return s
+}
+
+// SetRateLimit sets the limit in bytes per second for the forward of the local port,
+// or for the whole tunnel if port is 0, for both directions together. A limit of 0
+// removes the limit.
+func (m *Monitor) SetRateLimit(port int, limit int64) error {
+	if limit < 0 {
+		return fmt.Errorf("negative rate limit")
+	}
+	b := m.shaper.tunnel
+	if port != 0 {
+		var ok bool
+		b, ok = m.shaper.forwards[port]
+		if !ok {
+			return fmt.Errorf("no forward for port %d", port)
+		}
+	}
+	b.setLimit(limit)
+	m.logger.Infof("rate limit for port %d set to %d bytes/s", port, limit)
+	return nil
+}
+
+// RateLimits returns the shaping state of the tunnel (port 0) followed by each forward.
+func (m *Monitor) RateLimits() []RateStatus {
+	res := []RateStatus{m.shaper.tunnel.status(0)}
+	ports := make([]int, 0, len(m.shaper.forwards))
+	for p := range m.shaper.forwards {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	for _, p := range ports {
+		res = append(res, m.shaper.forwards[p].status(p))
+	}
+	return res
+}
+
+// writer wraps w so writes are held back by the forward and tunnel buckets.
+func (s *shaper) writer(ctx context.Context, port int, w io.Writer) io.Writer {
+	buckets := []*bucket{s.tunnel}
+	if b, ok := s.forwards[port]; ok {
+		buckets = append(buckets, b)
+	}
+	return &shapedWriter{ctx: ctx, w: w, buckets: buckets}
+}
+
+type shapedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	buckets []*bucket
+}
+
+func (s *shapedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		for _, b := range s.buckets {
+			if c := b.maxChunk(); c > 0 && c < n {
+				n = c
+			}
+		}
+		var wait time.Duration
+		for _, b := range s.buckets {
+			if d := b.take(n); d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-s.ctx.Done():
+				t.Stop()
+				return written, s.ctx.Err()
+			case <-t.C:
+			}
+		}
+		m, err := s.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
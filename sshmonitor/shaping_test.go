@@ -0,0 +1,178 @@
+package sshmonitor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{in: "0", want: 0},
+		{in: "1000", want: 1000},
+		{in: "1k", want: 1 << 10},
+		{in: " 2K ", want: 2 << 10},
+		{in: "10m", want: 10 << 20},
+		{in: "1g", want: 1 << 30},
+		{in: "8589934591g", want: 8589934591 << 30},
+		{in: "8589934592g", err: true},
+		{in: "9223372036854775807", want: 9223372036854775807},
+		{in: "9223372036854775808", err: true},
+		{in: "-1", err: true},
+		{in: "-1k", err: true},
+		{in: "1.5m", err: true},
+		{in: "1t", err: true},
+		{in: "k", err: true},
+		{in: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRate(tt.in)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("accepted '%s' as %d", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseRate(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketTake(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int64
+		// full starts the bucket with its burst, idle is how long it has not been used.
+		full bool
+		idle time.Duration
+		take int
+		wait time.Duration
+	}{
+		{name: "unlimited", take: 1 << 30},
+		{name: "empty", limit: 8192, take: 8192, wait: time.Second},
+		{name: "empty, half", limit: 8192, take: 4096, wait: time.Second / 2},
+		{name: "full", limit: 8192, full: true, take: 8192},
+		{name: "more than full", limit: 8192, full: true, take: 16384, wait: time.Second},
+		{name: "refilled", limit: 8192, idle: time.Second, take: 8192},
+		{name: "refilled up to the burst", limit: 8192, idle: 10 * time.Second, take: 3 * 8192, wait: 2 * time.Second},
+		{name: "small limits get the minimum burst", limit: 1024, idle: 10 * time.Second, take: minBurst},
+		{name: "past the minimum burst", limit: 1024, idle: 10 * time.Second, take: minBurst + 1024, wait: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBucket(tt.limit)
+			b.last = time.Now().Add(-tt.idle)
+			if tt.full {
+				b.tokens = b.burst
+			}
+			wait := b.take(tt.take)
+			if wait > tt.wait || wait < tt.wait-50*time.Millisecond {
+				t.Errorf("take(%d) waits %s, want %s", tt.take, wait, tt.wait)
+			}
+		})
+	}
+}
+
+func TestBucketMaxChunk(t *testing.T) {
+	tests := []struct {
+		limit int64
+		want  int
+	}{
+		{limit: 0, want: 0},
+		{limit: 1, want: minBurst},
+		{limit: minBurst, want: minBurst},
+		{limit: 1 << 20, want: 1 << 20},
+	}
+	for _, tt := range tests {
+		if got := newBucket(tt.limit).maxChunk(); got != tt.want {
+			t.Errorf("maxChunk with limit %d = %d, want %d", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestBucketStatus(t *testing.T) {
+	// Start at the beginning of a second, so the meter doesn't move on in the middle.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	b := newBucket(1000)
+	now := time.Now().Unix()
+	for i := int64(1); i <= meterSlots; i++ {
+		// Last second 1000 bytes, the one before 2000 and so on.
+		sec := now - i
+		b.slotAt[sec%meterSlots], b.slots[sec%meterSlots] = sec, 1000*i
+	}
+	st := b.status(22)
+	if want := float64(1000+2000+3000+4000+5000) / meterSlots; st.Port != 22 || st.Limit != 1000 || st.Rate != want {
+		t.Errorf("got %+v, want port 22, limit 1000, rate %g", st, want)
+	}
+	if st.Throttled {
+		t.Errorf("throttled without waiting")
+	}
+	// The current second takes the slot of the oldest, and is left out until it's over.
+	b.count(time.Unix(now, 0), 1<<20)
+	// A slot that wasn't used for a while is left out as well.
+	sec := now - 1
+	b.slotAt[sec%meterSlots] = sec - meterSlots
+	if st := b.status(22); st.Rate != float64(2000+3000+4000)/meterSlots {
+		t.Errorf("measured %g, want %g", st.Rate, float64(2000+3000+4000)/meterSlots)
+	}
+	if b.take(2000) == 0 || !b.status(22).Throttled {
+		t.Errorf("not throttled after a wait")
+	}
+}
+
+// chunkWriter keeps the size of every write.
+type chunkWriter struct{ sizes []int }
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.sizes = append(w.sizes, len(p))
+	return len(p), nil
+}
+
+func TestShapedWriter(t *testing.T) {
+	s := newShaper([]int{22, 80})
+	s.tunnel.setLimit(1 << 20)
+	s.forwards[22].setLimit(1 << 16)
+	s.tunnel.tokens, s.forwards[22].tokens = s.tunnel.burst, s.forwards[22].burst
+
+	w := &chunkWriter{}
+	start := time.Now()
+	n, err := s.writer(context.Background(), 22, w).Write(make([]byte, 1<<16+4096))
+	if err != nil || n != 1<<16+4096 {
+		t.Fatalf("wrote %d: %v", n, err)
+	}
+	if len(w.sizes) != 2 || w.sizes[0] != 1<<16 || w.sizes[1] != 4096 {
+		t.Errorf("wrote in chunks %v, want [65536 4096]", w.sizes)
+	}
+	// The forward ran dry, the rest waits for it.
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("took %s, want 62ms", d)
+	}
+	// Port 80 has no limit of its own, only the tunnel's, which has room left.
+	w = &chunkWriter{}
+	if _, err := s.writer(context.Background(), 80, w).Write(make([]byte, 1<<17)); err != nil || len(w.sizes) != 1 {
+		t.Errorf("wrote in chunks %v (%v), want one", w.sizes, err)
+	}
+}
+
+func TestShapedWriterCancel(t *testing.T) {
+	s := newShaper([]int{22})
+	s.forwards[22].setLimit(minBurst)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := &chunkWriter{}
+	n, err := s.writer(ctx, 22, w).Write(make([]byte, minBurst))
+	if !errors.Is(err, context.Canceled) || n != 0 || len(w.sizes) != 0 {
+		t.Errorf("wrote %d in %v: %v, want nothing and cancelled", n, w.sizes, err)
+	}
+}